@@ -0,0 +1,287 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Station is a BOM weather station, identified by the product (area) its observations are published in,
+// and its WMO id
+type Station struct {
+	Area string
+	ID   string
+}
+
+// URL returns where the station's latest observations are published, under base
+func (s Station) URL(base string) string {
+	return fmt.Sprintf("%s/%s/%s.%s.json", strings.TrimSuffix(base, "/"), s.Area, s.Area, s.ID)
+}
+
+func (s Station) String() string {
+	return s.Area + "." + s.ID
+}
+
+// parseStations parses comma separated `<area>.<station>` pairs, like IDN60901.94768
+func parseStations(s string) ([]Station, error) {
+	var stations []Station
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if len(v) == 0 {
+			continue
+		}
+		area, id, ok := strings.Cut(v, ".")
+		if !ok || len(area) == 0 || len(id) == 0 {
+			return nil, fmt.Errorf("bad station %q, want <area>.<station>, like IDN60901.94768", v)
+		}
+		stations = append(stations, Station{Area: area, ID: id})
+	}
+	if len(stations) == 0 {
+		return nil, errors.New("no stations to export")
+	}
+	return stations, nil
+}
+
+// BOMObservations is the JSON feed of a station's latest observations, newest first
+type BOMObservations struct {
+	Observations struct {
+		Data []Observation `json:"data"`
+	} `json:"observations"`
+}
+
+// Observation is a single observation from a station. Values the station didn't observe are null.
+type Observation struct {
+	WMO         int      `json:"wmo"`
+	Name        string   `json:"name"`
+	AIFSTimeUTC string   `json:"aifstime_utc"`
+	AirTemp     *float64 `json:"air_temp"`
+	ApparentT   *float64 `json:"apparent_t"`
+	RelHum      *float64 `json:"rel_hum"`
+	WindSpdKmh  *float64 `json:"wind_spd_kmh"`
+	GustKmh     *float64 `json:"gust_kmh"`
+	WindDir     string   `json:"wind_dir"`
+	PressMSL    *float64 `json:"press_msl"`
+	RainTrace   string   `json:"rain_trace"`
+}
+
+// Time returns when the observation was made
+func (o Observation) Time() (time.Time, error) {
+	return time.Parse("20060102150405", o.AIFSTimeUTC)
+}
+
+// compassPoints are the wind directions BOM reports, clockwise from north
+var compassPoints = []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+
+// windDirection converts a compass point to degrees. Calm and unknown directions aren't converted.
+func windDirection(s string) (float64, bool) {
+	for i, p := range compassPoints {
+		if s == p {
+			return float64(i) * 22.5, true
+		}
+	}
+	return 0, false
+}
+
+// measurements returns the values the station observed, by field name
+func (o Observation) measurements() map[string]float64 {
+	m := map[string]float64{}
+	for field, v := range map[string]*float64{
+		"air_temp":     o.AirTemp,
+		"apparent_t":   o.ApparentT,
+		"rel_hum":      o.RelHum,
+		"wind_spd_kmh": o.WindSpdKmh,
+		"gust_kmh":     o.GustKmh,
+		"press_msl":    o.PressMSL,
+	} {
+		if v != nil {
+			m[field] = *v
+		}
+	}
+	if deg, ok := windDirection(o.WindDir); ok {
+		m["wind_dir"] = deg
+	}
+	// rain_trace is a string, and "-" when there's no rain gauge
+	if rain, err := strconv.ParseFloat(o.RainTrace, 64); err == nil {
+		m["rain_trace"] = rain
+	}
+	return m
+}
+
+// observationFields are the observations exported, with their metric names and help
+var observationFields = []struct {
+	field string
+	name  string
+	help  string
+}{
+	{"air_temp", "bom_air_temperature_celsius", "Air temperature, in degrees celsius."},
+	{"apparent_t", "bom_apparent_temperature_celsius", "Apparent (feels like) temperature, in degrees celsius."},
+	{"rel_hum", "bom_humidity_percentage", "Relative humidity, as a percentage."},
+	{"wind_spd_kmh", "bom_wind_speed_kilometers_per_hour", "Mean wind speed, in kilometers per hour."},
+	{"gust_kmh", "bom_wind_gust_kilometers_per_hour", "Wind gust speed, in kilometers per hour."},
+	{"wind_dir", "bom_wind_direction_degrees", "Wind direction, in degrees clockwise from north."},
+	{"press_msl", "bom_pressure_msl_hectopascals", "Mean sea level pressure, in hectopascals."},
+	{"rain_trace", "bom_rain_since_9am_millimetres", "Rain since 9am local time, in millimetres."},
+}
+
+// Metrics are the observations exported for each station
+type Metrics struct {
+	gauges *exporter.GaugeSet
+	errors *prometheus.CounterVec
+}
+
+// NewMetrics registers metrics for observations with reg
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		gauges: exporter.NewGaugeSet(reg, "station_id", "station"),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "bom_request_errors_total",
+			Help: "Number of failed requests for a station's observations.",
+		}, []string{"station_id"}),
+	}
+	reg.MustRegister(m.errors)
+	for _, f := range observationFields {
+		if err := m.gauges.Register(f.field, f.name, f.help); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+// Poller fetches the latest observations from each station
+type Poller struct {
+	BaseURL  string
+	Stations []Station
+	Client   *http.Client
+	metrics  *Metrics
+	refresh  chan time.Time
+
+	mu   sync.Mutex
+	last map[Station]time.Time
+}
+
+// NewPoller sets up a poller for stations, updating metrics with new observations
+func NewPoller(baseURL string, stations []Station, metrics *Metrics, refresh chan time.Time) *Poller {
+	return &Poller{
+		BaseURL:  baseURL,
+		Stations: stations,
+		Client:   &http.Client{Timeout: 10 * time.Second},
+		metrics:  metrics,
+		refresh:  refresh,
+		last:     map[Station]time.Time{},
+	}
+}
+
+// Run polls every station now, then every interval, forever
+func (p *Poller) Run(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		p.PollAll()
+		<-ticker.C
+	}
+}
+
+// PollAll polls every station, logging failures rather than stopping
+func (p *Poller) PollAll() {
+	for _, s := range p.Stations {
+		if err := p.Poll(s); err != nil {
+			fmt.Printf("error: unable to get observations for %s: %s\n", s, err)
+			p.metrics.errors.WithLabelValues(s.ID).Inc()
+		}
+	}
+}
+
+// Poll fetches a station's latest observation, and updates metrics if it's newer than the last one
+func (p *Poller) Poll(s Station) error {
+	req, err := http.NewRequest(http.MethodGet, s.URL(p.BaseURL), nil)
+	if err != nil {
+		return err
+	}
+	// BOM turns away requests without a User-Agent
+	req.Header.Set("User-Agent", "meteo-bom-observations-exporter")
+	resp, err := p.Client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var obs BOMObservations
+	if err := json.NewDecoder(resp.Body).Decode(&obs); err != nil {
+		return fmt.Errorf("unable to decode JSON: %w", err)
+	}
+	if len(obs.Observations.Data) == 0 {
+		return errors.New("no observations")
+	}
+	latest := obs.Observations.Data[0]
+	t, err := latest.Time()
+	if err != nil {
+		return fmt.Errorf("bad observation time: %w", err)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if !t.After(p.last[s]) {
+		if opts.Debug {
+			fmt.Printf("debug: no new observations for %s since %s\n", s, t)
+		}
+		return nil
+	}
+	p.last[s] = t
+
+	labels := prometheus.Labels{"station_id": strconv.Itoa(latest.WMO), "station": latest.Name}
+	for field, v := range latest.measurements() {
+		p.metrics.gauges.Set(field, labels, v, t)
+	}
+	p.refresh <- t
+	return nil
+}
+
+var (
+	opts        exporter.Options
+	stationList string
+	baseURL     string
+	interval    time.Duration
+)
+
+func init() {
+	opts.RegisterServeFlags(flag.CommandLine, ":10006", time.Hour)
+	flag.StringVar(&stationList, "station", "", "comma separated <area>.<station> pairs to export, from the station's observations URL, like http://www.bom.gov.au/products/IDN60901/IDN60901.94768.shtml")
+	flag.StringVar(&baseURL, "url", "http://www.bom.gov.au/fwo", "base URL of the BOM observations feeds")
+	flag.DurationVar(&interval, "interval", 5*time.Minute, "how often to check for new observations")
+}
+
+func main() {
+	flag.Parse()
+
+	stations, err := parseStations(stationList)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	e, err := exporter.New("bom_observations_exporter", "bom", opts)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+
+	// Create new metrics and register them using the exporter's registry.
+	metrics := NewMetrics(e.Registry)
+
+	// Poll for new observations, update metrics, and expose them on /metrics
+	poller := NewPoller(baseURL, stations, metrics, e.Refresh)
+	log.Fatal(e.RunInput(metrics.gauges, func() error {
+		poller.Run(interval)
+		return nil
+	}))
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"path"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exportertest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// helperBOM serves the observations in testdata, like BOM does
+func helperBOM(t *testing.T) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if len(r.UserAgent()) == 0 || r.UserAgent() == "Go-http-client/1.1" {
+			http.Error(w, "Forbidden", http.StatusForbidden)
+			return
+		}
+		http.ServeFile(w, r, filepath.Join("testdata", path.Base(r.URL.Path)))
+	}))
+}
+
+func TestParseStations(t *testing.T) {
+	assert := assert.New(t)
+
+	stations, err := parseStations("IDN60901.94768, IDN60801.95682,")
+	assert.NoError(err)
+	assert.Equal([]Station{{Area: "IDN60901", ID: "94768"}, {Area: "IDN60801", ID: "95682"}}, stations)
+	assert.Equal("http://www.bom.gov.au/fwo/IDN60901/IDN60901.94768.json", stations[0].URL("http://www.bom.gov.au/fwo/"))
+
+	testCases := []string{"", "IDN60901", "IDN60901.", ".94768"}
+	for _, tc := range testCases {
+		_, err := parseStations(tc)
+		assert.Error(err, tc)
+	}
+}
+
+func TestPoll(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	bom := helperBOM(t)
+	defer bom.Close()
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	refresh := make(chan time.Time, 1000)
+	stations := []Station{{Area: "IDN60901", ID: "94768"}, {Area: "IDN60801", ID: "95682"}, {Area: "IDN60901", ID: "12345"}}
+	poller := NewPoller(bom.URL+"/fwo", stations, metrics, refresh)
+
+	poller.PollAll()
+	assert.Len(refresh, 2)
+	assert.Equal(time.Date(2024, 1, 21, 0, 0, 0, 0, time.UTC), <-refresh, "observation times are honoured")
+
+	body := exportertest.Scrape(t, reg)
+	sydney := `{station="Sydney - Observatory Hill",station_id="94768"}`
+	assert.Contains(body, "bom_air_temperature_celsius"+sydney+" 25.6")
+	assert.Contains(body, "bom_apparent_temperature_celsius"+sydney+" 25.1")
+	assert.Contains(body, "bom_humidity_percentage"+sydney+" 61")
+	assert.Contains(body, "bom_wind_speed_kilometers_per_hour"+sydney+" 17")
+	assert.Contains(body, "bom_wind_gust_kilometers_per_hour"+sydney+" 24")
+	assert.Contains(body, "bom_wind_direction_degrees"+sydney+" 67.5")
+	assert.Contains(body, "bom_pressure_msl_hectopascals"+sydney+" 1012.3")
+	assert.Contains(body, "bom_rain_since_9am_millimetres"+sydney+" 0.4")
+	assert.Contains(body, "bom_air_temperature_celsius_last_seen_timestamp_seconds"+sydney+" 1.7057952e+09")
+
+	// nulls, calm, and no rain gauge are skipped, not zeroed
+	mountHope := `{station="Mount Hope",station_id="95682"}`
+	assert.Contains(body, "bom_air_temperature_celsius"+mountHope+" 33.4")
+	assert.Contains(body, "bom_wind_speed_kilometers_per_hour"+mountHope+" 0")
+	assert.NotContains(body, "bom_pressure_msl_hectopascals"+mountHope)
+	assert.NotContains(body, "bom_wind_gust_kilometers_per_hour"+mountHope)
+	assert.NotContains(body, "bom_wind_direction_degrees"+mountHope)
+	assert.NotContains(body, "bom_rain_since_9am_millimetres"+mountHope)
+
+	// failures are counted, and don't stop other stations being polled
+	assert.Contains(body, `bom_request_errors_total{station_id="12345"} 1`)
+
+	// the same observations aren't new
+	poller.PollAll()
+	assert.Len(refresh, 1)
+
+	// measurements expire relative to when they were observed
+	ttls := exporter.TTLs{Default: time.Hour}
+	assert.Equal(0, metrics.gauges.Expire(time.Date(2024, 1, 21, 0, 30, 0, 0, time.UTC), ttls))
+	assert.Equal(12, metrics.gauges.Expire(time.Date(2024, 1, 21, 1, 30, 0, 0, time.UTC), ttls))
+}
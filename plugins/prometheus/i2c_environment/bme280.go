@@ -0,0 +1,145 @@
+package main
+
+import "encoding/binary"
+
+// BME280 registers
+const (
+	bme280Calib1   = 0x88
+	bme280ChipID   = 0xd0
+	bme280Calib2   = 0xe1
+	bme280CtrlHum  = 0xf2
+	bme280CtrlMeas = 0xf4
+	bme280Config   = 0xf5
+	bme280Data     = 0xf7
+)
+
+// BME280 is a Bosch temperature, humidity and pressure sensor, common on breakout boards and HATs
+type BME280 struct {
+	addr uint16
+
+	t1                             uint16
+	t2, t3                         int16
+	p1                             uint16
+	p2, p3, p4, p5, p6, p7, p8, p9 int16
+	h1, h3                         uint8
+	h2, h4, h5                     int16
+	h6                             int8
+}
+
+// Name is the sensor's chip
+func (s *BME280) Name() string {
+	return "bme280"
+}
+
+// Address is the sensor's address on the bus
+func (s *BME280) Address() uint16 {
+	return s.addr
+}
+
+// Init checks the sensor is there, reads its calibration, and starts it measuring once a second
+func (s *BME280) Init(bus Bus) error {
+	if err := checkID(bus, s.addr, bme280ChipID, 0x60); err != nil {
+		return err
+	}
+	cal := make([]byte, 26)
+	if err := bus.ReadReg(s.addr, bme280Calib1, cal); err != nil {
+		return err
+	}
+	s.t1 = binary.LittleEndian.Uint16(cal[0:2])
+	s.t2 = int16le(cal[2:4])
+	s.t3 = int16le(cal[4:6])
+	s.p1 = binary.LittleEndian.Uint16(cal[6:8])
+	s.p2 = int16le(cal[8:10])
+	s.p3 = int16le(cal[10:12])
+	s.p4 = int16le(cal[12:14])
+	s.p5 = int16le(cal[14:16])
+	s.p6 = int16le(cal[16:18])
+	s.p7 = int16le(cal[18:20])
+	s.p8 = int16le(cal[20:22])
+	s.p9 = int16le(cal[22:24])
+	s.h1 = cal[25]
+
+	cal = make([]byte, 7)
+	if err := bus.ReadReg(s.addr, bme280Calib2, cal); err != nil {
+		return err
+	}
+	s.h2 = int16le(cal[0:2])
+	s.h3 = cal[2]
+	// h4 and h5 are 12 bits, sharing the nibbles of a register
+	s.h4 = int16(int8(cal[3]))<<4 | int16(cal[4]&0x0f)
+	s.h5 = int16(int8(cal[5]))<<4 | int16(cal[4]>>4)
+	s.h6 = int8(cal[6])
+
+	// humidity oversampling x1, which only takes effect after ctrl_meas is written
+	if err := bus.WriteReg(s.addr, bme280CtrlHum, 0x01); err != nil {
+		return err
+	}
+	// 1000ms between measurements, no filter
+	if err := bus.WriteReg(s.addr, bme280Config, 0xa0); err != nil {
+		return err
+	}
+	// temperature and pressure oversampling x1, normal mode
+	return bus.WriteReg(s.addr, bme280CtrlMeas, 0x27)
+}
+
+// Read returns the sensor's latest temperature, humidity, and pressure, compensated with the floating point
+// formulas from the datasheet
+func (s *BME280) Read(bus Bus) (map[string]float64, error) {
+	out := make([]byte, 8)
+	if err := bus.ReadReg(s.addr, bme280Data, out); err != nil {
+		return nil, err
+	}
+	adcP := float64(uint32(out[0])<<12 | uint32(out[1])<<4 | uint32(out[2])>>4)
+	adcT := float64(uint32(out[3])<<12 | uint32(out[4])<<4 | uint32(out[5])>>4)
+	adcH := float64(uint32(out[6])<<8 | uint32(out[7]))
+	// the data registers hold their reset values until the first measurement
+	if adcT == 0x80000 {
+		return nil, ErrNotReady
+	}
+
+	tFine := s.compensateTemperature(adcT)
+	m := map[string]float64{"temperature": tFine / 5120}
+	if p, ok := s.compensatePressure(adcP, tFine); ok {
+		m["pressure"] = p / 100
+	}
+	if adcH != 0x8000 {
+		m["humidity"] = clamp(s.compensateHumidity(adcH, tFine), 0, 100)
+	}
+	return m, nil
+}
+
+// compensateTemperature returns the fine temperature the pressure and humidity compensation use. Divided by
+// 5120, it's in degrees celsius.
+func (s *BME280) compensateTemperature(adcT float64) float64 {
+	t1, t2, t3 := float64(s.t1), float64(s.t2), float64(s.t3)
+	var1 := (adcT/16384 - t1/1024) * t2
+	var2 := (adcT/131072 - t1/8192) * (adcT/131072 - t1/8192) * t3
+	return var1 + var2
+}
+
+// compensatePressure returns the pressure in pascals
+func (s *BME280) compensatePressure(adcP float64, tFine float64) (float64, bool) {
+	var1 := tFine/2 - 64000
+	var2 := var1 * var1 * float64(s.p6) / 32768
+	var2 = var2 + var1*float64(s.p5)*2
+	var2 = var2/4 + float64(s.p4)*65536
+	var1 = (float64(s.p3)*var1*var1/524288 + float64(s.p2)*var1) / 524288
+	var1 = (1 + var1/32768) * float64(s.p1)
+	if var1 == 0 {
+		// avoid dividing by zero
+		return 0, false
+	}
+	p := 1048576 - adcP
+	p = (p - var2/4096) * 6250 / var1
+	var1 = float64(s.p9) * p * p / 2147483648
+	var2 = p * float64(s.p8) / 32768
+	return p + (var1+var2+float64(s.p7))/16, true
+}
+
+// compensateHumidity returns the relative humidity, as a percentage
+func (s *BME280) compensateHumidity(adcH float64, tFine float64) float64 {
+	h := tFine - 76800
+	h = (adcH - (float64(s.h4)*64 + float64(s.h5)/16384*h)) *
+		(float64(s.h2) / 65536 * (1 + float64(s.h6)/67108864*h*(1+float64(s.h3)/67108864*h)))
+	return h * (1 - float64(s.h1)*h/524288)
+}
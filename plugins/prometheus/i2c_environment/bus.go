@@ -0,0 +1,14 @@
+package main
+
+import "errors"
+
+// Bus reads and writes the registers of devices on an I2C bus
+type Bus interface {
+	// ReadReg reads len(buf) bytes, starting at register reg of the device at addr
+	ReadReg(addr uint16, reg byte, buf []byte) error
+	// WriteReg writes a byte to register reg of the device at addr
+	WriteReg(addr uint16, reg byte, value byte) error
+}
+
+// ErrNotReady is returned when a sensor hasn't finished its first measurement
+var ErrNotReady = errors.New("no measurement ready")
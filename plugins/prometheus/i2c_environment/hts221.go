@@ -0,0 +1,96 @@
+package main
+
+import "fmt"
+
+// HTS221 registers
+const (
+	hts221WhoAmI   = 0x0f
+	hts221CtrlReg1 = 0x20
+	hts221Status   = 0x27
+	hts221Out      = 0x28
+	hts221Calib    = 0x30
+	// hts221AutoIncrement is set on a register address to read several registers at once
+	hts221AutoIncrement = 0x80
+)
+
+// HTS221 is an ST humidity and temperature sensor, as on the Sense HAT
+type HTS221 struct {
+	addr uint16
+
+	// calibration points: humidity and temperature at two raw outputs each
+	h0, h1       float64
+	h0Out, h1Out float64
+	t0, t1       float64
+	t0Out, t1Out float64
+}
+
+// Name is the sensor's chip
+func (s *HTS221) Name() string {
+	return "hts221"
+}
+
+// Address is the sensor's address on the bus
+func (s *HTS221) Address() uint16 {
+	return s.addr
+}
+
+// Init checks the sensor is there, reads its calibration, and starts it measuring once a second
+func (s *HTS221) Init(bus Bus) error {
+	if err := checkID(bus, s.addr, hts221WhoAmI, 0xbc); err != nil {
+		return err
+	}
+	cal := make([]byte, 16)
+	if err := bus.ReadReg(s.addr, hts221Calib|hts221AutoIncrement, cal); err != nil {
+		return err
+	}
+	s.h0 = float64(cal[0]) / 2
+	s.h1 = float64(cal[1]) / 2
+	// the temperature points are 10 bits, with their top bits sharing a register
+	s.t0 = float64(uint16(cal[5]&0x03)<<8|uint16(cal[2])) / 8
+	s.t1 = float64(uint16(cal[5]&0x0c)<<6|uint16(cal[3])) / 8
+	s.h0Out = float64(int16le(cal[6:8]))
+	s.h1Out = float64(int16le(cal[10:12]))
+	s.t0Out = float64(int16le(cal[12:14]))
+	s.t1Out = float64(int16le(cal[14:16]))
+	if s.h0Out == s.h1Out || s.t0Out == s.t1Out {
+		return fmt.Errorf("bad calibration")
+	}
+
+	// power on, block data update, 1Hz
+	return bus.WriteReg(s.addr, hts221CtrlReg1, 0x85)
+}
+
+// Read returns the sensor's latest temperature and humidity
+func (s *HTS221) Read(bus Bus) (map[string]float64, error) {
+	status := make([]byte, 1)
+	if err := bus.ReadReg(s.addr, hts221Status, status); err != nil {
+		return nil, err
+	}
+	if status[0]&0x03 != 0x03 {
+		return nil, ErrNotReady
+	}
+	out := make([]byte, 4)
+	if err := bus.ReadReg(s.addr, hts221Out|hts221AutoIncrement, out); err != nil {
+		return nil, err
+	}
+	h := float64(int16le(out[0:2]))
+	t := float64(int16le(out[2:4]))
+
+	humidity := s.h0 + (h-s.h0Out)*(s.h1-s.h0)/(s.h1Out-s.h0Out)
+	temperature := s.t0 + (t-s.t0Out)*(s.t1-s.t0)/(s.t1Out-s.t0Out)
+	return map[string]float64{
+		"temperature": temperature,
+		"humidity":    clamp(humidity, 0, 100),
+	}, nil
+}
+
+// clamp limits v to between min and max
+func clamp(v, min, max float64) float64 {
+	if v < min {
+		return min
+	}
+	if v > max {
+		return max
+	}
+	return v
+}
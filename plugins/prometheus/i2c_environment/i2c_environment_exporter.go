@@ -0,0 +1,265 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// labels returns a sensor's metric labels
+func labels(s Sensor) prometheus.Labels {
+	return prometheus.Labels{"sensor": s.Name(), "address": fmt.Sprintf("0x%02x", s.Address())}
+}
+
+// Compensator corrects temperatures for the heat of the Pi's CPU, which warms the sensors on HATs sitting
+// over it. The Sense HAT reads several degrees high without it.
+type Compensator struct {
+	// CPUTempPath is where the CPU's temperature is read from, in millidegrees celsius
+	CPUTempPath string
+	// Factor is how much cooler the CPU would need to be, relative to the sensor, to warm it by a degree.
+	// Smaller factors correct more.
+	Factor float64
+}
+
+// CPUTemperature reads the CPU's temperature, in degrees celsius
+func (c *Compensator) CPUTemperature() (float64, error) {
+	b, err := os.ReadFile(c.CPUTempPath)
+	if err != nil {
+		return 0, err
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("bad CPU temperature: %w", err)
+	}
+	return float64(milli) / 1000, nil
+}
+
+// Compensate corrects a sensor's temperature for the CPU's temperature. Humidity measured by the same sensor
+// is corrected too: the air around the sensor holds the same water, but warmer air could hold more.
+func (c *Compensator) Compensate(m map[string]float64, cpu float64) {
+	t, ok := m["temperature"]
+	if !ok {
+		return
+	}
+	corrected := t - (cpu-t)/c.Factor
+	m["uncompensated_temperature"] = t
+	m["temperature"] = corrected
+	if h, ok := m["humidity"]; ok {
+		m["humidity"] = clamp(h*saturationVapourPressure(t)/saturationVapourPressure(corrected), 0, 100)
+	}
+}
+
+// saturationVapourPressure returns the most water vapour air can hold at a temperature, in hectopascals,
+// using the Magnus formula
+func saturationVapourPressure(t float64) float64 {
+	return 6.112 * math.Exp(17.62*t/(243.12+t))
+}
+
+// sensorFields are the measurements exported, with their metric names and help
+var sensorFields = []struct {
+	field string
+	name  string
+	help  string
+}{
+	{"temperature", "i2c_temperature_celsius", "Temperature, in degrees celsius."},
+	{"uncompensated_temperature", "i2c_uncompensated_temperature_celsius", "Temperature before correcting for the CPU's heat, in degrees celsius."},
+	{"humidity", "i2c_humidity_percentage", "Relative humidity, as a percentage."},
+	{"pressure", "i2c_pressure_hectopascals", "Station (not sea level) pressure, in hectopascals."},
+}
+
+// Metrics are the measurements exported for each sensor
+type Metrics struct {
+	gauges  *exporter.GaugeSet
+	sensors prometheus.Gauge
+	cpu     prometheus.Gauge
+	errors  *prometheus.CounterVec
+}
+
+// NewMetrics registers metrics for I2C sensors with reg
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		gauges: exporter.NewGaugeSet(reg, "sensor", "address"),
+		sensors: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "i2c_sensors",
+			Help: "Number of I2C environmental sensors found.",
+		}),
+		cpu: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "i2c_cpu_temperature_celsius",
+			Help: "CPU temperature that sensor temperatures are corrected for, in degrees celsius.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "i2c_read_errors_total",
+			Help: "Number of failed reads from a sensor.",
+		}, []string{"sensor", "address"}),
+	}
+	reg.MustRegister(m.sensors)
+	reg.MustRegister(m.cpu)
+	reg.MustRegister(m.errors)
+	for _, f := range sensorFields {
+		if err := m.gauges.Register(f.field, f.name, f.help); err != nil {
+			panic(err)
+		}
+	}
+	return m
+}
+
+// Reader reads every sensor on a bus
+type Reader struct {
+	Bus     Bus
+	Sensors []Sensor
+	// Compensator corrects temperatures for the CPU's heat, if set
+	Compensator *Compensator
+	metrics     *Metrics
+	refresh     chan time.Time
+}
+
+// NewReader sets up a reader for sensors on bus
+func NewReader(bus Bus, sensors []Sensor, metrics *Metrics, refresh chan time.Time) *Reader {
+	metrics.sensors.Set(float64(len(sensors)))
+	return &Reader{Bus: bus, Sensors: sensors, metrics: metrics, refresh: refresh}
+}
+
+// ReadAll reads every sensor, logging failures rather than stopping
+func (r *Reader) ReadAll() {
+	var cpu float64
+	var cpuErr error
+	if r.Compensator != nil {
+		cpu, cpuErr = r.Compensator.CPUTemperature()
+		if cpuErr != nil {
+			fmt.Printf("error: unable to read CPU temperature, skipping temperature and humidity: %s\n", cpuErr)
+		} else {
+			r.metrics.cpu.Set(cpu)
+		}
+	}
+
+	now := time.Now()
+	var updated bool
+	for _, s := range r.Sensors {
+		m, err := s.Read(r.Bus)
+		if errors.Is(err, ErrNotReady) {
+			if opts.Debug {
+				fmt.Printf("debug: %s at 0x%02x has no measurement yet\n", s.Name(), s.Address())
+			}
+			continue
+		}
+		if err != nil {
+			fmt.Printf("error: unable to read %s at 0x%02x: %s\n", s.Name(), s.Address(), err)
+			r.metrics.errors.With(labels(s)).Inc()
+			continue
+		}
+		if r.Compensator != nil {
+			if cpuErr != nil {
+				// uncorrected values would be misleadingly warm and dry, so let them expire instead
+				delete(m, "temperature")
+				delete(m, "humidity")
+			} else {
+				r.Compensator.Compensate(m, cpu)
+			}
+		}
+		for field, v := range m {
+			r.metrics.gauges.Set(field, labels(s), v, now)
+			updated = true
+		}
+	}
+	if updated {
+		r.refresh <- now
+	}
+}
+
+// filterSensors returns the sensors named in a comma separated list, or all of them if the list is empty
+func filterSensors(sensors []Sensor, list string) ([]Sensor, error) {
+	if len(strings.TrimSpace(list)) == 0 {
+		return sensors, nil
+	}
+	var filtered []Sensor
+	for _, name := range strings.Split(list, ",") {
+		name = strings.ToLower(strings.TrimSpace(name))
+		if len(name) == 0 {
+			continue
+		}
+		var known bool
+		for _, s := range sensors {
+			if s.Name() == name {
+				filtered = append(filtered, s)
+				known = true
+			}
+		}
+		if !known {
+			return nil, fmt.Errorf("unknown sensor %q", name)
+		}
+	}
+	return filtered, nil
+}
+
+var (
+	opts        exporter.Options
+	busPath     string
+	sensorList  string
+	cpuFactor   float64
+	cpuTempPath string
+	interval    time.Duration
+)
+
+func init() {
+	opts.RegisterServeFlags(flag.CommandLine, ":10005", 5*time.Minute)
+	flag.StringVar(&busPath, "bus", "/dev/i2c-1", "I2C bus the sensors are on")
+	flag.StringVar(&sensorList, "sensors", "", "comma separated sensors to look for: hts221, lps25h, bme280 (default all of them)")
+	flag.Float64Var(&cpuFactor, "cpu-factor", 0, "correct temperatures for the CPU's heat, subtracting (cpu - sensor) / factor. Try 1.5 for a Sense HAT. 0 turns correction off")
+	flag.StringVar(&cpuTempPath, "cpu-temp", "/sys/class/thermal/thermal_zone0/temp", "where to read the CPU's temperature from, in millidegrees celsius")
+	flag.DurationVar(&interval, "interval", 30*time.Second, "how often to read sensors")
+}
+
+func main() {
+	flag.Parse()
+
+	if cpuFactor < 0 {
+		log.Fatalf("error: -cpu-factor must be positive")
+	}
+	wanted, err := filterSensors(candidates(), sensorList)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	bus, err := OpenBus(busPath)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	defer bus.Close()
+	sensors := Detect(bus, wanted)
+	if len(sensors) == 0 {
+		log.Fatalf("error: no sensors found on %s", busPath)
+	}
+	for _, s := range sensors {
+		log.Printf("info: found %s at 0x%02x\n", s.Name(), s.Address())
+	}
+
+	e, err := exporter.New("i2c_environment_exporter", "i2c", opts)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+
+	// Create new metrics and register them using the exporter's registry.
+	metrics := NewMetrics(e.Registry)
+
+	// Read sensors, update metrics, and expose them on /metrics
+	reader := NewReader(bus, sensors, metrics, e.Refresh)
+	if cpuFactor > 0 {
+		reader.Compensator = &Compensator{CPUTempPath: cpuTempPath, Factor: cpuFactor}
+	}
+	log.Fatal(e.RunInput(metrics.gauges, func() error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			reader.ReadAll()
+			<-ticker.C
+		}
+	}))
+}
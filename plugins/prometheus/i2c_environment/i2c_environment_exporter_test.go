@@ -0,0 +1,252 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exportertest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// testBus is a simulated I2C bus, with a register map for each device on it
+type testBus struct {
+	devices map[uint16]*[256]byte
+	// autoIncrement are the devices that only read several registers at once when the top bit of the
+	// register address is set, like ST's sensors. Without it they return the same register over and over.
+	autoIncrement map[uint16]bool
+	fail          error
+}
+
+func (b *testBus) ReadReg(addr uint16, reg byte, buf []byte) error {
+	if b.fail != nil {
+		return b.fail
+	}
+	regs, ok := b.devices[addr]
+	if !ok {
+		return fmt.Errorf("no device at 0x%02x", addr)
+	}
+	step := 1
+	if b.autoIncrement[addr] {
+		if reg&0x80 == 0 {
+			step = 0
+		}
+		reg &^= 0x80
+	}
+	for i := range buf {
+		buf[i] = regs[int(reg)+i*step]
+	}
+	return nil
+}
+
+func (b *testBus) WriteReg(addr uint16, reg byte, value byte) error {
+	if b.fail != nil {
+		return b.fail
+	}
+	regs, ok := b.devices[addr]
+	if !ok {
+		return fmt.Errorf("no device at 0x%02x", addr)
+	}
+	regs[reg] = value
+	return nil
+}
+
+// helperPut16 writes a little endian 16 bit value into registers
+func helperPut16(regs *[256]byte, reg byte, v int) {
+	binary.LittleEndian.PutUint16(regs[reg:], uint16(v))
+}
+
+// helperSenseHAT simulates the Sense HAT's HTS221 and LPS25H, reading 27.5°C and 54% humidity, and
+// 1013.25hPa and 22.5°C
+func helperSenseHAT() *testBus {
+	hts221 := &[256]byte{}
+	hts221[0x0f] = 0xbc
+	hts221[0x30] = 66  // 33%
+	hts221[0x31] = 150 // 75%
+	hts221[0x32] = 160 // 20°C
+	hts221[0x33] = 0x18
+	hts221[0x35] = 0x04 // 0x118 = 35°C
+	helperPut16(hts221, 0x36, 0)
+	helperPut16(hts221, 0x3a, 8000)
+	helperPut16(hts221, 0x3c, -100)
+	helperPut16(hts221, 0x3e, 500)
+	hts221[0x27] = 0x03
+	helperPut16(hts221, 0x28, 4000)
+	helperPut16(hts221, 0x2a, 200)
+
+	lps25h := &[256]byte{}
+	lps25h[0x0f] = 0xbd
+	lps25h[0x27] = 0x03
+	p := int(1013.25 * 4096)
+	lps25h[0x28], lps25h[0x29], lps25h[0x2a] = byte(p), byte(p>>8), byte(p>>16)
+	helperPut16(lps25h, 0x2b, (22.5-42.5)*480)
+
+	return &testBus{
+		devices:       map[uint16]*[256]byte{0x5f: hts221, 0x5c: lps25h},
+		autoIncrement: map[uint16]bool{0x5f: true, 0x5c: true},
+	}
+}
+
+// helperBME280 simulates a BME280 with the calibration and readings from the datasheet's example
+func helperBME280() *[256]byte {
+	regs := &[256]byte{}
+	regs[0xd0] = 0x60
+	for i, v := range []int{27504, 26435, -1000, 36477, -10685, 3024, 2855, 140, -7, 15500, -14600, 6000} {
+		helperPut16(regs, byte(0x88+2*i), v)
+	}
+	regs[0xa1] = 75
+	helperPut16(regs, 0xe1, 370)
+	regs[0xe3] = 0
+	regs[0xe4], regs[0xe5], regs[0xe6] = 0x13, 0x29, 0x03 // h4 313, h5 50
+	regs[0xe7] = 30
+	adcP, adcT, adcH := 415148, 519888, 28000
+	regs[0xf7], regs[0xf8], regs[0xf9] = byte(adcP>>12), byte(adcP>>4), byte(adcP<<4)
+	regs[0xfa], regs[0xfb], regs[0xfc] = byte(adcT>>12), byte(adcT>>4), byte(adcT<<4)
+	regs[0xfd], regs[0xfe] = byte(adcH>>8), byte(adcH)
+	return regs
+}
+
+func TestSensors(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	bus := helperSenseHAT()
+	bus.devices[0x77] = helperBME280()
+
+	testCases := []struct {
+		sensor Sensor
+		config map[byte]byte
+		expect map[string]float64
+	}{
+		{
+			&HTS221{addr: 0x5f},
+			map[byte]byte{0x20: 0x85},
+			map[string]float64{"temperature": 27.5, "humidity": 54},
+		},
+		{
+			&LPS25H{addr: 0x5c},
+			map[byte]byte{0x20: 0x94},
+			map[string]float64{"temperature": 22.5, "pressure": 1013.25},
+		},
+		{
+			&BME280{addr: 0x77},
+			map[byte]byte{0xf2: 0x01, 0xf4: 0x27, 0xf5: 0xa0},
+			map[string]float64{"temperature": 25.08, "pressure": 1006.5327, "humidity": 44.82},
+		},
+	}
+	for _, tc := range testCases {
+		assert.NoError(tc.sensor.Init(bus), tc.sensor.Name())
+		for reg, v := range tc.config {
+			assert.Equal(v, bus.devices[tc.sensor.Address()][reg], "%s register 0x%02x", tc.sensor.Name(), reg)
+		}
+		m, err := tc.sensor.Read(bus)
+		assert.NoError(err)
+		assert.Len(m, len(tc.expect), tc.sensor.Name())
+		for field, v := range tc.expect {
+			assert.InDelta(v, m[field], 0.01, "%s %s", tc.sensor.Name(), field)
+		}
+	}
+}
+
+func TestNotReady(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	bus := helperSenseHAT()
+	bus.devices[0x76] = helperBME280()
+	bus.devices[0x5f][0x27] = 0x01
+	bus.devices[0x5c][0x27] = 0x00
+	// the data registers' reset values
+	copy(bus.devices[0x76][0xf7:], []byte{0x80, 0x00, 0x00, 0x80, 0x00, 0x00, 0x80, 0x00})
+
+	for _, s := range []Sensor{&HTS221{addr: 0x5f}, &LPS25H{addr: 0x5c}, &BME280{addr: 0x76}} {
+		assert.NoError(s.Init(bus))
+		_, err := s.Read(bus)
+		assert.ErrorIs(err, ErrNotReady, s.Name())
+	}
+}
+
+func TestDetect(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	bus := helperSenseHAT()
+	// a BMP280, which has no humidity sensor
+	bus.devices[0x76] = helperBME280()
+	bus.devices[0x76][0xd0] = 0x58
+
+	var names []string
+	for _, s := range Detect(bus, candidates()) {
+		names = append(names, fmt.Sprintf("%s@0x%02x", s.Name(), s.Address()))
+	}
+	assert.Equal([]string{"hts221@0x5f", "lps25h@0x5c"}, names)
+
+	sensors, err := filterSensors(candidates(), "BME280")
+	assert.NoError(err)
+	assert.Len(sensors, 2)
+	_, err = filterSensors(candidates(), "sht31")
+	assert.Error(err)
+}
+
+func TestCompensate(t *testing.T) {
+	assert := assert.New(t)
+
+	c := &Compensator{Factor: 2}
+	m := map[string]float64{"temperature": 30, "humidity": 40, "pressure": 1000}
+	c.Compensate(m, 50)
+	assert.Equal(20.0, m["temperature"])
+	assert.Equal(30.0, m["uncompensated_temperature"])
+	// the same water in cooler air is a higher relative humidity
+	assert.InDelta(72.6, m["humidity"], 0.01)
+	assert.Equal(1000.0, m["pressure"])
+}
+
+func TestReadAll(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	bus := helperSenseHAT()
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	refresh := make(chan time.Time, 1000)
+	reader := NewReader(bus, Detect(bus, candidates()), metrics, refresh)
+
+	reader.ReadAll()
+	assert.Len(refresh, 1)
+	body := exportertest.Scrape(t, reg)
+	assert.Contains(body, `i2c_temperature_celsius{address="0x5f",sensor="hts221"} 27.5`)
+	assert.Contains(body, `i2c_humidity_percentage{address="0x5f",sensor="hts221"} 54`)
+	assert.Contains(body, `i2c_temperature_celsius{address="0x5c",sensor="lps25h"} 22.5`)
+	assert.Contains(body, `i2c_pressure_hectopascals{address="0x5c",sensor="lps25h"} 1013.25`)
+	assert.Contains(body, "i2c_sensors 2")
+	assert.NotContains(body, "i2c_uncompensated_temperature_celsius{")
+
+	// temperatures are corrected for the CPU's heat, once it can be read
+	cpuTemp := filepath.Join(t.TempDir(), "temp")
+	reader.Compensator = &Compensator{CPUTempPath: cpuTemp, Factor: 2}
+	reader.ReadAll()
+	body = exportertest.Scrape(t, reg)
+	assert.NotContains(body, "i2c_cpu_temperature_celsius 50")
+	assert.Contains(body, `i2c_pressure_hectopascals{address="0x5c",sensor="lps25h"} 1013.25`)
+
+	assert.NoError(os.WriteFile(cpuTemp, []byte("50000\n"), 0644))
+	reader.ReadAll()
+	body = exportertest.Scrape(t, reg)
+	assert.Contains(body, "i2c_cpu_temperature_celsius 50")
+	assert.Contains(body, `i2c_temperature_celsius{address="0x5f",sensor="hts221"} 16.25`)
+	assert.Contains(body, `i2c_uncompensated_temperature_celsius{address="0x5f",sensor="hts221"} 27.5`)
+	assert.Contains(body, `i2c_temperature_celsius{address="0x5c",sensor="lps25h"} 8.75`)
+
+	// failed reads are counted
+	bus.fail = errors.New("remote I/O error")
+	reader.ReadAll()
+	body = exportertest.Scrape(t, reg)
+	assert.Contains(body, `i2c_read_errors_total{address="0x5f",sensor="hts221"} 1`)
+	assert.Contains(body, `i2c_read_errors_total{address="0x5c",sensor="lps25h"} 1`)
+	assert.Len(refresh, 3)
+}
@@ -0,0 +1,71 @@
+//go:build linux
+
+package main
+
+import (
+	"fmt"
+	"os"
+	"sync"
+	"syscall"
+)
+
+// i2cSlave is the ioctl that sets the address of the device later reads and writes go to
+const i2cSlave = 0x0703
+
+// DevBus is an I2C bus exposed by the kernel's i2c-dev module, like /dev/i2c-1
+type DevBus struct {
+	mu   sync.Mutex
+	f    *os.File
+	addr uint16
+}
+
+// OpenBus opens an I2C bus, like /dev/i2c-1
+func OpenBus(path string) (*DevBus, error) {
+	f, err := os.OpenFile(path, os.O_RDWR, 0)
+	if err != nil {
+		return nil, err
+	}
+	return &DevBus{f: f}, nil
+}
+
+// setAddress points the bus at a device. The caller holds mu.
+func (b *DevBus) setAddress(addr uint16) error {
+	if b.addr == addr {
+		return nil
+	}
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, b.f.Fd(), i2cSlave, uintptr(addr)); errno != 0 {
+		return fmt.Errorf("unable to address device 0x%02x: %w", addr, errno)
+	}
+	b.addr = addr
+	return nil
+}
+
+// ReadReg reads len(buf) bytes, starting at register reg of the device at addr
+func (b *DevBus) ReadReg(addr uint16, reg byte, buf []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.setAddress(addr); err != nil {
+		return err
+	}
+	if _, err := b.f.Write([]byte{reg}); err != nil {
+		return err
+	}
+	_, err := b.f.Read(buf)
+	return err
+}
+
+// WriteReg writes a byte to register reg of the device at addr
+func (b *DevBus) WriteReg(addr uint16, reg byte, value byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err := b.setAddress(addr); err != nil {
+		return err
+	}
+	_, err := b.f.Write([]byte{reg, value})
+	return err
+}
+
+// Close closes the bus
+func (b *DevBus) Close() error {
+	return b.f.Close()
+}
@@ -0,0 +1,20 @@
+//go:build !linux
+
+package main
+
+import "errors"
+
+// DevBus is an I2C bus exposed by the kernel's i2c-dev module, which only exists on Linux
+type DevBus struct {
+	Bus
+}
+
+// OpenBus returns an error, as I2C buses can only be opened on Linux
+func OpenBus(path string) (*DevBus, error) {
+	return nil, errors.New("I2C buses can only be read on Linux")
+}
+
+// Close does nothing
+func (b *DevBus) Close() error {
+	return nil
+}
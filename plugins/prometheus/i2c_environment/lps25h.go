@@ -0,0 +1,57 @@
+package main
+
+// LPS25H registers
+const (
+	lps25hWhoAmI   = 0x0f
+	lps25hCtrlReg1 = 0x20
+	lps25hStatus   = 0x27
+	lps25hOut      = 0x28
+	// lps25hAutoIncrement is set on a register address to read several registers at once
+	lps25hAutoIncrement = 0x80
+)
+
+// LPS25H is an ST pressure sensor, as on the Sense HAT. It's factory calibrated.
+type LPS25H struct {
+	addr uint16
+}
+
+// Name is the sensor's chip
+func (s *LPS25H) Name() string {
+	return "lps25h"
+}
+
+// Address is the sensor's address on the bus
+func (s *LPS25H) Address() uint16 {
+	return s.addr
+}
+
+// Init checks the sensor is there, and starts it measuring once a second
+func (s *LPS25H) Init(bus Bus) error {
+	if err := checkID(bus, s.addr, lps25hWhoAmI, 0xbd); err != nil {
+		return err
+	}
+	// power on, 1Hz, block data update
+	return bus.WriteReg(s.addr, lps25hCtrlReg1, 0x94)
+}
+
+// Read returns the sensor's latest pressure and temperature
+func (s *LPS25H) Read(bus Bus) (map[string]float64, error) {
+	status := make([]byte, 1)
+	if err := bus.ReadReg(s.addr, lps25hStatus, status); err != nil {
+		return nil, err
+	}
+	if status[0]&0x03 != 0x03 {
+		return nil, ErrNotReady
+	}
+	out := make([]byte, 5)
+	if err := bus.ReadReg(s.addr, lps25hOut|lps25hAutoIncrement, out); err != nil {
+		return nil, err
+	}
+	// pressure is 24 bits, two's complement
+	p := int32(uint32(out[0])<<8|uint32(out[1])<<16|uint32(out[2])<<24) >> 8
+	t := int16le(out[3:5])
+	return map[string]float64{
+		"pressure":    float64(p) / 4096,
+		"temperature": 42.5 + float64(t)/480,
+	}, nil
+}
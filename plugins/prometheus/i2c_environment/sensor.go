@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/binary"
+	"fmt"
+)
+
+// Sensor is an environmental sensor on an I2C bus
+type Sensor interface {
+	// Name is the sensor's chip, like hts221
+	Name() string
+	// Address is the sensor's address on the bus
+	Address() uint16
+	// Init checks the sensor is there, reads its calibration, and starts it measuring
+	Init(bus Bus) error
+	// Read returns the sensor's latest measurements, by field name: temperature, humidity or pressure
+	Read(bus Bus) (map[string]float64, error)
+}
+
+// candidates are the sensors looked for on a bus, at the addresses they're usually found at. The Sense HAT
+// has an HTS221 and an LPS25H; BME280 breakouts use either address.
+func candidates() []Sensor {
+	return []Sensor{
+		&HTS221{addr: 0x5f},
+		&LPS25H{addr: 0x5c},
+		&BME280{addr: 0x76},
+		&BME280{addr: 0x77},
+	}
+}
+
+// Detect initialises every sensor that answers on bus
+func Detect(bus Bus, sensors []Sensor) []Sensor {
+	var found []Sensor
+	for _, s := range sensors {
+		if err := s.Init(bus); err != nil {
+			if opts.Debug {
+				fmt.Printf("debug: no %s at 0x%02x: %s\n", s.Name(), s.Address(), err)
+			}
+			continue
+		}
+		found = append(found, s)
+	}
+	return found
+}
+
+// checkID reads a sensor's identification register, and checks it holds want
+func checkID(bus Bus, addr uint16, reg byte, want byte) error {
+	id := make([]byte, 1)
+	if err := bus.ReadReg(addr, reg, id); err != nil {
+		return err
+	}
+	if id[0] != want {
+		return fmt.Errorf("unexpected chip id 0x%02x, want 0x%02x", id[0], want)
+	}
+	return nil
+}
+
+// int16le decodes a little endian, two's complement int16
+func int16le(b []byte) int16 {
+	return int16(binary.LittleEndian.Uint16(b))
+}
@@ -0,0 +1,178 @@
+package exporter
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"log/slog"
+	"os"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	mochi "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// Broker is an MQTT broker embedded in the exporter, so devices can publish to it directly, without
+// running a separate broker. Subscriptions are handled in-process.
+type Broker struct {
+	server *mochi.Server
+	client inlineClient
+}
+
+// NewBroker starts a broker listening on addr. If username or password are set, clients must authenticate
+// with them, otherwise anyone can connect.
+func NewBroker(addr string, username string, password string, debug bool) (*Broker, error) {
+	level := slog.LevelWarn
+	if debug {
+		level = slog.LevelDebug
+	}
+	server := mochi.New(&mochi.Options{
+		InlineClient: true,
+		Logger:       slog.New(slog.NewTextHandler(os.Stdout, &slog.HandlerOptions{Level: level})),
+	})
+
+	var err error
+	if len(username) > 0 || len(password) > 0 {
+		err = server.AddHook(new(auth.Hook), &auth.Options{Ledger: &auth.Ledger{
+			Auth: auth.AuthRules{{Username: auth.RString(username), Password: auth.RString(password), Allow: true}},
+		}})
+	} else {
+		err = server.AddHook(new(auth.AllowHook), nil)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if err := server.AddListener(listeners.NewTCP(listeners.Config{ID: "tcp", Address: addr})); err != nil {
+		return nil, fmt.Errorf("unable to listen on %s: %w", addr, err)
+	}
+	if err := server.Serve(); err != nil {
+		return nil, err
+	}
+	log.Printf("Embedded MQTT broker listening on %s\n", addr)
+	client := inlineClient{
+		server:  server,
+		options: mqtt.NewClient(mqtt.NewClientOptions().SetClientID("inline")).OptionsReader(),
+	}
+	return &Broker{server: server, client: client}, nil
+}
+
+// Subscribe passes messages published to the subscription's topics to its handler.
+//
+// OnConnect is called once straight away, and again whenever a client subscribes, so commands published
+// by it reach devices that connect after the exporter started.
+func (b *Broker) Subscribe(sub Subscription) error {
+	id := 1
+	for topic := range sub.Topics {
+		err := b.server.Subscribe(topic, id, func(cl *mochi.Client, s packets.Subscription, pk packets.Packet) {
+			sub.Handler(b.client, message{topic: pk.TopicName, payload: pk.Payload})
+		})
+		if err != nil {
+			return fmt.Errorf("unable to subscribe to %s: %w", topic, err)
+		}
+		log.Printf("Subscribed to topic: %s\n", topic)
+		id++
+	}
+
+	if sub.OnConnect != nil {
+		if err := b.server.AddHook(&subscribedHook{onSubscribed: func() { sub.OnConnect(b.client) }}, nil); err != nil {
+			return err
+		}
+		sub.OnConnect(b.client)
+	}
+	return nil
+}
+
+// Close disconnects clients and stops listening
+func (b *Broker) Close() error {
+	return b.server.Close()
+}
+
+// subscribedHook calls onSubscribed whenever a client (other than the exporter) subscribes
+type subscribedHook struct {
+	mochi.HookBase
+	onSubscribed func()
+}
+
+func (h *subscribedHook) ID() string {
+	return "subscribed"
+}
+
+func (h *subscribedHook) Provides(b byte) bool {
+	return b == mochi.OnSubscribed
+}
+
+func (h *subscribedHook) OnSubscribed(cl *mochi.Client, pk packets.Packet, reasonCodes []byte) {
+	if cl.Net.Inline {
+		return
+	}
+	go h.onSubscribed()
+}
+
+// inlineClient is the client handlers are given by an embedded broker. It's always connected, and publishes
+// messages straight to the broker. Subscriptions are made with Broker.Subscribe instead, so subscribing
+// through the client returns an error.
+type inlineClient struct {
+	server  *mochi.Server
+	options mqtt.ClientOptionsReader
+}
+
+var _ mqtt.Client = inlineClient{}
+
+// errInlineSubscribe is returned when a handler tries to subscribe through the embedded broker's client
+var errInlineSubscribe = errors.New("subscribing isn't supported by the embedded broker's client")
+
+func (c inlineClient) IsConnected() bool      { return true }
+func (c inlineClient) IsConnectionOpen() bool { return true }
+func (c inlineClient) Connect() mqtt.Token    { return doneToken{} }
+func (c inlineClient) Disconnect(uint)        {}
+
+func (c inlineClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	var b []byte
+	switch p := payload.(type) {
+	case []byte:
+		b = p
+	case string:
+		b = []byte(p)
+	default:
+		return doneToken{err: fmt.Errorf("unknown payload type %T", payload)}
+	}
+	return doneToken{err: c.server.Publish(topic, b, retained, qos)}
+}
+
+func (c inlineClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return doneToken{err: errInlineSubscribe}
+}
+
+func (c inlineClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return doneToken{err: errInlineSubscribe}
+}
+
+func (c inlineClient) Unsubscribe(...string) mqtt.Token {
+	return doneToken{err: errInlineSubscribe}
+}
+
+func (c inlineClient) AddRoute(topic string, callback mqtt.MessageHandler) {
+	fmt.Printf("warning: unable to add route for %s: %s\n", topic, errInlineSubscribe)
+}
+
+func (c inlineClient) OptionsReader() mqtt.ClientOptionsReader {
+	return c.options
+}
+
+// doneToken is a token for an operation that has already completed
+type doneToken struct {
+	err error
+}
+
+func (t doneToken) Wait() bool                     { return true }
+func (t doneToken) WaitTimeout(time.Duration) bool { return true }
+func (t doneToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (t doneToken) Error() error { return t.err }
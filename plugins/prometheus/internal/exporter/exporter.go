@@ -0,0 +1,110 @@
+package exporter
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// Exporter runs the parts every exporter shares
+type Exporter struct {
+	// Name identifies the exporter to the MQTT broker
+	Name     string
+	Options  Options
+	TTLs     TTLs
+	Registry *prometheus.Registry
+	Health   *Health
+	// Refresh is sent the time whenever a measurement is received
+	Refresh chan time.Time
+}
+
+// New sets up an exporter, with a `<namespace>_exporter_healthy` gauge
+func New(name string, namespace string, opts Options) (*Exporter, error) {
+	ttls, err := opts.TTLs()
+	if err != nil {
+		return nil, err
+	}
+	reg := prometheus.NewRegistry()
+	return &Exporter{
+		Name:     name,
+		Options:  opts,
+		TTLs:     ttls,
+		Registry: reg,
+		Health:   NewHealth(reg, namespace+"_exporter_healthy", opts.HealthTimeout()),
+		Refresh:  make(chan time.Time),
+	}, nil
+}
+
+// Run expires stale measurements, subscribes to the broker (or runs an embedded one, or replays a
+// recording), and serves metrics until the server fails
+func (e *Exporter) Run(gauges *GaugeSet, sub Subscription) error {
+	if len(e.Options.Record) > 0 {
+		f, err := os.OpenFile(e.Options.Record, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		sub.Handler = NewRecorder(f).Record(sub.Handler)
+		log.Printf("Recording messages to %s\n", e.Options.Record)
+	}
+
+	// Set up the TTL checker early, in case MQTT is unavailable
+	go Watch(gauges, e.Refresh, e.TTLs, e.Health, e.Options.Exit)
+
+	switch {
+	case len(e.Options.Replay) > 0:
+		f, err := os.Open(e.Options.Replay)
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer f.Close()
+			n, err := Replay(f, sub.Handler, e.Options.ReplaySpeed)
+			if err != nil {
+				fmt.Printf("error: replay stopped: %s\n", err)
+			}
+			log.Printf("Replayed %d messages from %s\n", n, e.Options.Replay)
+		}()
+	case len(e.Options.EmbeddedBroker) > 0:
+		broker, err := NewBroker(e.Options.EmbeddedBroker, e.Options.Username, e.Options.Password, e.Options.Debug)
+		if err != nil {
+			return err
+		}
+		defer broker.Close()
+		if err := broker.Subscribe(sub); err != nil {
+			return err
+		}
+	default:
+		opts, err := e.Options.ClientOptions(e.Name)
+		if err != nil {
+			return err
+		}
+		go NewSubscriber(e.Registry, sub).Run(opts)
+	}
+
+	return e.Serve()
+}
+
+// RunInput expires stale measurements, and serves metrics, while input reads measurements from somewhere other
+// than MQTT. It returns when input does, so the exporter exits if its input goes away.
+func (e *Exporter) RunInput(gauges *GaugeSet, input func() error) error {
+	go Watch(gauges, e.Refresh, e.TTLs, e.Health, e.Options.Exit)
+
+	errs := make(chan error, 2)
+	go func() { errs <- input() }()
+	go func() { errs <- e.Serve() }()
+	return <-errs
+}
+
+// Serve exposes metrics on /metrics, and health on /healthz
+func (e *Exporter) Serve() error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.HandlerFor(e.Registry, promhttp.HandlerOpts{Registry: e.Registry}))
+	mux.Handle("/healthz", e.Health)
+	return http.ListenAndServe(e.Options.Listen, mux)
+}
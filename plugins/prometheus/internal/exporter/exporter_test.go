@@ -0,0 +1,494 @@
+package exporter
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"flag"
+	"io"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exportertest"
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGaugeSet(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	gauges := NewGaugeSet(reg, "device")
+	derived := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: "test_rain_last_hour_millimetres", Help: "Test."}, []string{"device"})
+	reg.MustRegister(derived)
+
+	assert.NoError(gauges.Register("rain_mm", "test_rain_millimetres", "Test."))
+	assert.NoError(gauges.Register("temperature_C", "test_temperature_celsius", "Test."))
+	assert.NoError(gauges.Register("rain_mm", "test_rain_millimetres", "Test."), "registering again does nothing")
+	gauges.Derive("rain_mm", derived)
+
+	// conflicts are only reported once
+	assert.Error(gauges.Register("humidity", "test_temperature_celsius", "Conflict."))
+	assert.NoError(gauges.Register("humidity", "test_temperature_celsius", "Conflict."))
+	assert.False(gauges.Registered("humidity"))
+	assert.True(gauges.Registered("rain_mm"))
+
+	start := time.Unix(1705800000, 0)
+	gauges.Set("rain_mm", prometheus.Labels{"device": "garden"}, 3.5, start)
+	gauges.Set("temperature_C", prometheus.Labels{"device": "garden"}, 21.5, start.Add(time.Minute))
+	gauges.Set("humidity", prometheus.Labels{"device": "garden"}, 42, start)
+	derived.With(prometheus.Labels{"device": "garden"}).Set(1.5)
+
+	body := exportertest.Scrape(t, reg)
+	assert.Contains(body, `test_rain_millimetres{device="garden"} 3.5`)
+	assert.Contains(body, `test_rain_millimetres_last_seen_timestamp_seconds{device="garden"} 1.7058e+09`)
+	assert.NotContains(body, "} 42")
+
+	ttls := TTLs{Default: 90 * time.Second, Fields: map[string]time.Duration{"temperature_C": time.Hour}}
+	assert.Equal(0, gauges.Expire(start.Add(time.Minute), ttls))
+	assert.Equal(1, gauges.Expire(start.Add(2*time.Minute), ttls))
+
+	body = exportertest.Scrape(t, reg)
+	assert.Contains(body, `test_rain_millimetres{device="garden"} NaN`)
+	assert.Contains(body, `test_rain_last_hour_millimetres{device="garden"} NaN`)
+	assert.Contains(body, `test_temperature_celsius{device="garden"} 21.5`)
+	assert.Contains(body, `test_rain_millimetres_last_seen_timestamp_seconds{device="garden"} 1.7058e+09`)
+}
+
+func TestHealth(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	health := NewHealth(reg, "test_exporter_healthy", time.Minute)
+	ts := httptest.NewServer(health)
+	defer ts.Close()
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	assert.Equal(http.StatusOK, resp.StatusCode)
+
+	health.Refresh(time.Now().Add(-time.Hour))
+	resp, err = http.Get(ts.URL)
+	assert.NoError(err)
+	assert.Equal(http.StatusServiceUnavailable, resp.StatusCode)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Contains(string(body), "no updates for 1h0m0s")
+	assert.Contains(exportertest.Scrape(t, reg), "test_exporter_healthy 0")
+
+	health.Refresh(time.Now())
+	_, ok := health.Check(time.Now())
+	assert.True(ok)
+	assert.Contains(exportertest.Scrape(t, reg), "test_exporter_healthy 1")
+}
+
+func TestParseTTLs(t *testing.T) {
+	assert := assert.New(t)
+
+	ttls, err := ParseTTLs("rain_mm=1h, battery_ok = 6h,", 10*time.Minute)
+	assert.NoError(err)
+	assert.Equal(time.Hour, ttls.For("rain_mm"))
+	assert.Equal(6*time.Hour, ttls.For("battery_ok"))
+	assert.Equal(10*time.Minute, ttls.For("temperature_C"))
+
+	_, err = ParseTTLs("rain_mm", time.Minute)
+	assert.Error(err)
+	_, err = ParseTTLs("rain_mm=soon", time.Minute)
+	assert.Error(err)
+}
+
+func TestOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	var opts Options
+	fs := flag.NewFlagSet("test", flag.ContinueOnError)
+	opts.RegisterFlags(fs, ":10000")
+	assert.NoError(fs.Parse([]string{"-t", "5m", "-field-ttl", "rain_mm=1h"}))
+
+	assert.Equal(":10000", opts.Listen)
+	assert.True(opts.Exit)
+	assert.Equal(50*time.Minute, opts.HealthTimeout())
+	ttls, err := opts.TTLs()
+	assert.NoError(err)
+	assert.Equal(time.Hour, ttls.For("rain_mm"))
+	assert.Equal(5*time.Minute, ttls.For("humidity"))
+
+	assert.NoError(fs.Parse([]string{"-unhealthy-after", "2h", "-listen", "127.0.0.1:9100", "-exit=false"}))
+	assert.Equal(2*time.Hour, opts.HealthTimeout())
+	assert.Equal("127.0.0.1:9100", opts.Listen)
+	assert.False(opts.Exit)
+}
+
+// helperWriteCert writes a self-signed certificate and its key as PEM files, and returns their paths
+func helperWriteCert(t *testing.T, dir string, name string) (string, string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	certPath := filepath.Join(dir, name+".pem")
+	keyPath := filepath.Join(dir, name+"-key.pem")
+	if err := os.WriteFile(certPath, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(keyPath, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER}), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return certPath, keyPath
+}
+
+func TestClientOptions(t *testing.T) {
+	assert := assert.New(t)
+
+	dir := t.TempDir()
+	caPath, _ := helperWriteCert(t, dir, "ca")
+	certPath, keyPath := helperWriteCert(t, dir, "client")
+
+	// defaults: plain tcp, a stable client ID, and a persistent session
+	opts, err := Options{Host: "broker", Port: 1883}.ClientOptions("test_exporter")
+	assert.NoError(err)
+	hostname, _ := os.Hostname()
+	assert.Equal("test_exporter-"+hostname, opts.ClientID)
+	assert.Equal("tcp://broker:1883", opts.Servers[0].String())
+	assert.False(opts.CleanSession)
+	assert.Nil(opts.TLSConfig)
+
+	// TLS, with a CA bundle, client certificate, and credentials from the environment
+	t.Setenv("MQTT_PASSWORD", "s3cr3t")
+	opts, err = Options{Broker: "ssl://broker:8883", Username: "exporter", CAFile: caPath, CertFile: certPath, KeyFile: keyPath, ClientID: "garage"}.ClientOptions("test_exporter")
+	assert.NoError(err)
+	assert.Equal("garage", opts.ClientID)
+	assert.Equal("ssl://broker:8883", opts.Servers[0].String())
+	assert.Equal("exporter", opts.Username)
+	assert.Equal("s3cr3t", opts.Password)
+	if assert.NotNil(opts.TLSConfig) {
+		assert.NotNil(opts.TLSConfig.RootCAs)
+		assert.Len(opts.TLSConfig.Certificates, 1)
+	}
+
+	// websockets over TLS use the system CAs by default
+	config, err := Options{Broker: "wss://broker/mqtt"}.TLSConfig()
+	assert.NoError(err)
+	if assert.NotNil(config) {
+		assert.Nil(config.RootCAs)
+	}
+
+	testCases := []struct {
+		opts   Options
+		expect string
+	}{
+		{Options{Broker: "ssl://broker:8883", CAFile: filepath.Join(dir, "missing.pem")}, "unable to read CA bundle"},
+		{Options{Broker: "ssl://broker:8883", CAFile: keyPath}, "no certificates found"},
+		{Options{Broker: "ssl://broker:8883", CertFile: certPath}, "unable to load client certificate"},
+		{Options{Broker: "ssl://broker:8883", CertFile: certPath, KeyFile: filepath.Join(dir, "ca-key.pem")}, "unable to load client certificate"},
+	}
+	for _, tc := range testCases {
+		_, err := tc.opts.ClientOptions("test_exporter")
+		assert.ErrorContains(err, tc.expect)
+	}
+}
+
+func TestShutdownHooks(t *testing.T) {
+	assert := assert.New(t)
+
+	var ran []string
+	OnShutdown(func() { ran = append(ran, "logout") })
+	OnShutdown(func() { ran = append(ran, "close") })
+	Shutdown()
+	assert.Equal([]string{"logout", "close"}, ran)
+
+	// hooks only run once
+	Shutdown()
+	assert.Len(ran, 2)
+}
+
+func TestBackoff(t *testing.T) {
+	assert := assert.New(t)
+
+	backoff := Backoff{Min: time.Second, Max: 5 * time.Second}
+	var delays []time.Duration
+	for i := 0; i < 5; i++ {
+		delays = append(delays, backoff.Next())
+	}
+	assert.Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second, 5 * time.Second}, delays)
+
+	backoff.Reset()
+	assert.Equal(time.Second, backoff.Next())
+}
+
+type testToken struct {
+	err error
+}
+
+func (tt testToken) Wait() bool                     { return true }
+func (tt testToken) WaitTimeout(time.Duration) bool { return true }
+func (tt testToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (tt testToken) Error() error { return tt.err }
+
+// testClient fails the first connects and subscribes, then records subscriptions
+type testClient struct {
+	mqtt.Client
+	connectErrors   int
+	subscribeErrors int
+	connects        int
+	subscribed      []string
+}
+
+func (tc *testClient) Connect() mqtt.Token {
+	tc.connects++
+	if tc.connects <= tc.connectErrors {
+		return testToken{err: errors.New("connection refused")}
+	}
+	return testToken{}
+}
+
+func (tc *testClient) IsConnectionOpen() bool { return true }
+
+func (tc *testClient) SubscribeMultiple(filters map[string]byte, callback mqtt.MessageHandler) mqtt.Token {
+	if tc.subscribeErrors > 0 {
+		tc.subscribeErrors--
+		return testToken{err: errors.New("not authorised")}
+	}
+	for topic := range filters {
+		tc.subscribed = append(tc.subscribed, topic)
+	}
+	return testToken{}
+}
+
+type testMessage struct {
+	mqtt.Message
+	topic   string
+	payload []byte
+}
+
+func (tm testMessage) Topic() string   { return tm.topic }
+func (tm testMessage) Payload() []byte { return tm.payload }
+
+func TestSubscriber(t *testing.T) {
+	assert := assert.New(t)
+
+	reg := prometheus.NewRegistry()
+	var handled, configured int
+	sub := NewSubscriber(reg, Subscription{
+		Topics:    map[string]byte{"sensors/#": 1},
+		Handler:   func(mqtt.Client, mqtt.Message) { handled++ },
+		OnConnect: func(mqtt.Client) { configured++ },
+	})
+	sub.Backoff = Backoff{Min: time.Millisecond, Max: time.Millisecond}
+
+	// connect and subscribe errors are retried
+	client := &testClient{connectErrors: 2, subscribeErrors: 1}
+	sub.connect(client)
+	assert.Equal(3, client.connects)
+	sub.onConnect(client)
+	assert.Equal([]string{"sensors/#"}, client.subscribed)
+	assert.Equal(1, configured)
+
+	sub.handle(client, testMessage{topic: "sensors/rtl_433/events"})
+	sub.handle(client, testMessage{topic: "sensors/rtl_433/devices/Fineoffset-WHx080/5/temperature_C"})
+	assert.Equal(2, handled)
+
+	body := exportertest.Scrape(t, reg)
+	assert.Contains(body, "mqtt_connected 1")
+	assert.Contains(body, "mqtt_reconnects_total 0")
+	assert.Contains(body, `mqtt_messages_received_total{topic="sensors/#"} 2`, "labelled by subscription filter, not the topic received on")
+	assert.NotContains(body, "rtl_433/events")
+
+	// reconnecting subscribes again
+	sub.onConnectionLost(client, errors.New("EOF"))
+	assert.Contains(exportertest.Scrape(t, reg), "mqtt_connected 0")
+	sub.onConnect(client)
+	assert.Equal([]string{"sensors/#", "sensors/#"}, client.subscribed)
+	assert.Equal(2, configured)
+
+	body = exportertest.Scrape(t, reg)
+	assert.Contains(body, "mqtt_connected 1")
+	assert.Contains(body, "mqtt_reconnects_total 1")
+}
+
+func TestMatchTopic(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		filter string
+		topic  string
+		match  bool
+	}{
+		{"sensors/rtl_433/events", "sensors/rtl_433/events", true},
+		{"sensors/rtl_433/events", "sensors/rtl_433/states", false},
+		{"sensors/#", "sensors/rtl_433/events", true},
+		{"sensors/#", "sensors", true},
+		{"sensors/#", "other/rtl_433", false},
+		{"/qingping/+/up", "/qingping/582D34000001/up", true},
+		{"/qingping/+/up", "/qingping/582D34000001/down", false},
+		{"/qingping/+/up", "/qingping/up", false},
+		{"#", "anything/at/all", true},
+	}
+	for _, tc := range tests {
+		assert.Equal(tc.match, matchTopic(tc.filter, tc.topic), "%s matching %s", tc.filter, tc.topic)
+	}
+}
+
+func TestRecordAndReplay(t *testing.T) {
+	assert := assert.New(t)
+
+	var received []string
+	handler := func(c mqtt.Client, msg mqtt.Message) {
+		received = append(received, msg.Topic()+" "+string(msg.Payload()))
+	}
+
+	var buf bytes.Buffer
+	record := NewRecorder(&buf).Record(handler)
+	record(nil, testMessage{topic: "sensors/rtl_433/events", payload: []byte(`{"model":"Fineoffset-WHx080","id":240}`)})
+	record(nil, testMessage{topic: "sensors/rtl_433/temperature_C", payload: []byte("18.3")})
+	assert.Len(received, 2)
+	assert.Equal(2, strings.Count(buf.String(), "\n"))
+
+	n, err := Replay(bytes.NewReader(buf.Bytes()), handler, 0)
+	assert.NoError(err)
+	assert.Equal(2, n)
+	assert.Equal(received[:2], received[2:])
+
+	// binary payloads replay byte for byte
+	var replayed []byte
+	buf.Reset()
+	binary := []byte{0x00, 0xff, 0xfe, 0x80, 'o', 'k'}
+	NewRecorder(&buf).Record(func(mqtt.Client, mqtt.Message) {})(nil, testMessage{topic: "sensors/raw", payload: binary})
+	_, err = Replay(&buf, func(c mqtt.Client, msg mqtt.Message) { replayed = msg.Payload() }, 0)
+	assert.NoError(err)
+	assert.Equal(binary, replayed)
+
+	// the gaps between messages are divided by the speed
+	recording := `{"topic":"a","payload":"MQ==","timestamp":"2024-01-21T01:00:00Z"}
+
+{"topic":"b","payload":"Mg==","timestamp":"2024-01-21T01:00:02Z"}
+`
+	start := time.Now()
+	n, err = Replay(strings.NewReader(recording), handler, 40)
+	assert.NoError(err)
+	assert.Equal(2, n)
+	assert.GreaterOrEqual(time.Since(start), 50*time.Millisecond)
+
+	_, err = Replay(strings.NewReader(recording+"not json\n"), handler, 0)
+	assert.ErrorContains(err, "line 4")
+}
+
+func helperFreeAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func TestEmbeddedBroker(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	addr := helperFreeAddr(t)
+	broker, err := NewBroker(addr, "exporter", "s3cr3t", false)
+	if !assert.NoError(err) {
+		return
+	}
+	defer broker.Close()
+
+	received := make(chan string, 10)
+	configured := make(chan string, 10)
+	assert.NoError(broker.Subscribe(Subscription{
+		Topics: map[string]byte{"sensors/#": 1},
+		Handler: func(c mqtt.Client, msg mqtt.Message) {
+			received <- msg.Topic() + " " + string(msg.Payload())
+		},
+		OnConnect: func(c mqtt.Client) {
+			c.Publish("devices/down", 1, false, []byte("configure")).Wait()
+			configured <- "configure"
+		},
+	}))
+	assert.Len(configured, 1)
+
+	// handlers are given a client that's connected, and can't subscribe behind the broker's back
+	client := broker.client
+	assert.True(client.IsConnected())
+	assert.NoError(client.Connect().Error())
+	assert.ErrorIs(client.Subscribe("sensors/#", 1, nil).Error(), errInlineSubscribe)
+	assert.ErrorIs(client.SubscribeMultiple(map[string]byte{"sensors/#": 1}, nil).Error(), errInlineSubscribe)
+	assert.ErrorIs(client.Unsubscribe("sensors/#").Error(), errInlineSubscribe)
+	assert.Error(client.Publish("devices/down", 1, false, 42).Error())
+	options := client.OptionsReader()
+	assert.Equal("inline", options.ClientID())
+
+	// clients must authenticate
+	opts, err := Options{Broker: "tcp://" + addr, Username: "exporter", Password: "wrong", ClientID: "intruder"}.ClientOptions("test")
+	assert.NoError(err)
+	intruder := mqtt.NewClient(opts)
+	token := intruder.Connect()
+	token.Wait()
+	assert.Error(token.Error())
+
+	// a device subscribing gets the exporter's commands, and its measurements reach the handler
+	opts, err = Options{Broker: "tcp://" + addr, Username: "exporter", Password: "s3cr3t", ClientID: "device"}.ClientOptions("test")
+	assert.NoError(err)
+	commands := make(chan string, 10)
+	device := mqtt.NewClient(opts)
+	token = device.Connect()
+	token.Wait()
+	if !assert.NoError(token.Error()) {
+		return
+	}
+	defer device.Disconnect(0)
+	token = device.Subscribe("devices/down", 1, func(c mqtt.Client, msg mqtt.Message) {
+		commands <- string(msg.Payload())
+	})
+	token.Wait()
+	assert.NoError(token.Error())
+	token = device.Publish("sensors/garden/temperature_C", 1, false, "21.5")
+	token.Wait()
+	assert.NoError(token.Error())
+
+	select {
+	case msg := <-received:
+		assert.Equal("sensors/garden/temperature_C 21.5", msg)
+	case <-time.After(5 * time.Second):
+		assert.Fail("measurement not received")
+	}
+	select {
+	case cmd := <-commands:
+		assert.Equal("configure", cmd)
+	case <-time.After(5 * time.Second):
+		assert.Fail("command not received")
+	}
+}
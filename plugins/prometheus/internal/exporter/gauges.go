@@ -0,0 +1,136 @@
+package exporter
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// series is a field measured for a set of label values
+type series struct {
+	field  string
+	labels prometheus.Labels
+}
+
+// GaugeSet is a gauge per field, that tracks when each of its series was last updated.
+//
+// Each field also gets a `<name>_last_seen_timestamp_seconds` gauge, and series that aren't updated within
+// their field's TTL are set to NaN, along with any gauges derived from the field.
+type GaugeSet struct {
+	reg    prometheus.Registerer
+	labels []string
+
+	mu       sync.Mutex
+	gauges   map[string]*prometheus.GaugeVec
+	lastSeen map[string]*prometheus.GaugeVec
+	derived  map[string][]*prometheus.GaugeVec
+	series   map[string]series
+	updated  map[string]time.Time
+}
+
+// NewGaugeSet creates a set of gauges with the same labels
+func NewGaugeSet(reg prometheus.Registerer, labels ...string) *GaugeSet {
+	return &GaugeSet{
+		reg:      reg,
+		labels:   labels,
+		gauges:   map[string]*prometheus.GaugeVec{},
+		lastSeen: map[string]*prometheus.GaugeVec{},
+		derived:  map[string][]*prometheus.GaugeVec{},
+		series:   map[string]series{},
+		updated:  map[string]time.Time{},
+	}
+}
+
+// Register registers the gauge for a field.
+//
+// Registering a field again does nothing. If registration fails, the field is never exported, and the error is
+// only returned the first time.
+func (s *GaugeSet) Register(field string, name string, help string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, ok := s.gauges[field]; ok {
+		return nil
+	}
+
+	g := prometheus.NewGaugeVec(prometheus.GaugeOpts{Name: name, Help: help}, s.labels)
+	seen := prometheus.NewGaugeVec(prometheus.GaugeOpts{
+		Name: name + "_last_seen_timestamp_seconds",
+		Help: fmt.Sprintf("When the %s field was last received, in seconds since the epoch.", field),
+	}, s.labels)
+	s.gauges[field] = nil
+	if err := s.reg.Register(g); err != nil {
+		return err
+	}
+	if err := s.reg.Register(seen); err != nil {
+		s.reg.Unregister(g)
+		return err
+	}
+	s.gauges[field] = g
+	s.lastSeen[field] = seen
+	return nil
+}
+
+// Registered checks if a field has a gauge
+func (s *GaugeSet) Registered(field string) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.gauges[field] != nil
+}
+
+// Derive expires gauges calculated from a field along with it
+func (s *GaugeSet) Derive(field string, gauges ...*prometheus.GaugeVec) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.derived[field] = append(s.derived[field], gauges...)
+}
+
+// key identifies a series by its field and label values
+func (s *GaugeSet) key(field string, labels prometheus.Labels) string {
+	values := []string{field}
+	for _, l := range s.labels {
+		values = append(values, labels[l])
+	}
+	return strings.Join(values, "\xff")
+}
+
+// Set updates a field's gauge, and records when it was updated. Fields without a gauge are ignored.
+func (s *GaugeSet) Set(field string, labels prometheus.Labels, v float64, now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	g := s.gauges[field]
+	if g == nil {
+		return
+	}
+	g.With(labels).Set(v)
+	s.lastSeen[field].With(labels).Set(float64(now.UnixNano()) / 1e9)
+
+	k := s.key(field, labels)
+	s.series[k] = series{field, labels}
+	s.updated[k] = now
+}
+
+// Expire sets series that haven't been updated within their field's TTL to NaN, along with gauges derived from them.
+//
+// It returns the number of series expired.
+func (s *GaugeSet) Expire(now time.Time, ttls TTLs) int {
+	NaN := math.Log(-1.0)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	expired := 0
+	for k, t := range s.updated {
+		ser := s.series[k]
+		if now.Sub(t) <= ttls.For(ser.field) {
+			continue
+		}
+		expired++
+		s.gauges[ser.field].With(ser.labels).Set(NaN)
+		for _, g := range s.derived[ser.field] {
+			g.With(ser.labels).Set(NaN)
+		}
+	}
+	return expired
+}
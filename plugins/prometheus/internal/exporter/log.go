@@ -0,0 +1,23 @@
+package exporter
+
+import (
+	"fmt"
+	"sync"
+	"time"
+)
+
+var rateLimited = struct {
+	sync.Mutex
+	last map[string]time.Time
+}{last: map[string]time.Time{}}
+
+// RateLimitedPrintln prints a message, unless the same message was printed within d
+func RateLimitedPrintln(s string, d time.Duration) {
+	rateLimited.Lock()
+	defer rateLimited.Unlock()
+	now := time.Now()
+	if now.Sub(rateLimited.last[s]) > d {
+		fmt.Println(s)
+		rateLimited.last[s] = now
+	}
+}
@@ -0,0 +1,298 @@
+package exporter
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Subscription is the topics an exporter reads, and the handler messages are passed to
+type Subscription struct {
+	Topics  map[string]byte
+	Handler mqtt.MessageHandler
+	// OnConnect is called every time the client connects, including reconnects
+	OnConnect func(mqtt.Client)
+}
+
+// message is an MQTT message that didn't come from a client, like a replayed or in-process one
+type message struct {
+	topic   string
+	payload []byte
+}
+
+func (m message) Duplicate() bool   { return false }
+func (m message) Qos() byte         { return 1 }
+func (m message) Retained() bool    { return false }
+func (m message) Topic() string     { return m.topic }
+func (m message) MessageID() uint16 { return 0 }
+func (m message) Payload() []byte   { return m.payload }
+func (m message) Ack()              {}
+
+// BrokerURL returns the URL of the MQTT broker, from -broker, or -h and -p
+func (o Options) BrokerURL() string {
+	if len(o.Broker) > 0 {
+		return o.Broker
+	}
+	return fmt.Sprintf("tcp://%s:%d", o.Host, o.Port)
+}
+
+// TLSConfig returns the TLS config for connecting to the broker, or nil if it isn't connected to over TLS
+func (o Options) TLSConfig() (*tls.Config, error) {
+	u, err := url.Parse(o.BrokerURL())
+	if err != nil {
+		return nil, fmt.Errorf("bad broker URL: %w", err)
+	}
+	secure := u.Scheme == "ssl" || u.Scheme == "tls" || u.Scheme == "mqtts" || u.Scheme == "wss"
+	if !secure && len(o.CAFile) == 0 && len(o.CertFile) == 0 {
+		return nil, nil
+	}
+
+	config := &tls.Config{MinVersion: tls.VersionTLS12}
+	if len(o.CAFile) > 0 {
+		pem, err := os.ReadFile(o.CAFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read CA bundle: %w", err)
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", o.CAFile)
+		}
+	}
+	if len(o.CertFile) > 0 || len(o.KeyFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(o.CertFile, o.KeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("unable to load client certificate: %w", err)
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// ClientOptions returns MQTT client options for connecting to the broker.
+//
+// The client ID is stable across restarts, and sessions aren't cleaned by default, so the broker delivers
+// QoS 1 messages it queued while the exporter was down.
+func (o Options) ClientOptions(name string) (*mqtt.ClientOptions, error) {
+	opts := mqtt.NewClientOptions()
+
+	clientID := o.ClientID
+	if len(clientID) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return nil, err
+		}
+		clientID = fmt.Sprintf("%s-%s", name, hostname)
+	}
+	log.Printf("Connecting to %s with ClientID: %s\n", o.BrokerURL(), clientID)
+	opts.SetClientID(clientID)
+	opts.AddBroker(o.BrokerURL())
+
+	tlsConfig, err := o.TLSConfig()
+	if err != nil {
+		return nil, err
+	}
+	if tlsConfig != nil {
+		opts.SetTLSConfig(tlsConfig)
+	}
+	opts.SetUsername(o.Username)
+	password := o.Password
+	if len(password) == 0 {
+		password = os.Getenv("MQTT_PASSWORD")
+	}
+	opts.SetPassword(password)
+
+	opts.SetCleanSession(o.CleanSession)
+	opts.SetResumeSubs(true)
+	opts.SetPingTimeout(1 * time.Second)
+	opts.SetKeepAlive(60 * time.Second)
+	opts.SetOrderMatters(false)
+	opts.SetAutoReconnect(true)
+	return opts, nil
+}
+
+// Backoff is an exponential backoff between retries
+type Backoff struct {
+	Min  time.Duration
+	Max  time.Duration
+	next time.Duration
+}
+
+// Next returns how long to wait before the next retry
+func (b *Backoff) Next() time.Duration {
+	d := b.next
+	if d == 0 {
+		d = b.Min
+	}
+	b.next = d * 2
+	if b.next > b.Max {
+		b.next = b.Max
+	}
+	return d
+}
+
+// Reset starts the backoff again from Min, after a retry succeeds
+func (b *Backoff) Reset() {
+	b.next = 0
+}
+
+// Subscriber keeps an exporter subscribed to the broker, resubscribing every time it reconnects, and
+// exports the state of the connection
+type Subscriber struct {
+	Subscription
+	Backoff    Backoff
+	connected  prometheus.Gauge
+	reconnects prometheus.Counter
+	received   *prometheus.CounterVec
+	filters    []string
+
+	mu       sync.Mutex
+	connects int
+}
+
+// NewSubscriber sets up a subscriber, with metrics for the connection to the broker
+func NewSubscriber(reg prometheus.Registerer, sub Subscription) *Subscriber {
+	s := &Subscriber{
+		Subscription: sub,
+		Backoff:      Backoff{Min: time.Second, Max: 2 * time.Minute},
+		connected: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "mqtt_connected",
+			Help: "Whether the exporter is connected to the MQTT broker.",
+		}),
+		reconnects: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "mqtt_reconnects_total",
+			Help: "Number of times the exporter reconnected to the MQTT broker.",
+		}),
+		received: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "mqtt_messages_received_total",
+			Help: "Number of MQTT messages received, by the subscription filter they matched.",
+		}, []string{"topic"}),
+	}
+	reg.MustRegister(s.connected, s.reconnects, s.received)
+	for filter := range sub.Topics {
+		s.filters = append(s.filters, filter)
+		s.received.WithLabelValues(filter)
+	}
+	sort.Strings(s.filters)
+	return s
+}
+
+// Run connects to the broker, retrying with backoff until the first connection succeeds. Later
+// disconnections are handled by the client reconnecting.
+func (s *Subscriber) Run(opts *mqtt.ClientOptions) {
+	opts.SetOnConnectHandler(s.onConnect)
+	opts.SetConnectionLostHandler(s.onConnectionLost)
+	opts.SetMaxReconnectInterval(s.Backoff.Max)
+	s.connect(mqtt.NewClient(opts))
+}
+
+func (s *Subscriber) connect(client mqtt.Client) {
+	backoff := s.Backoff
+	for {
+		token := client.Connect()
+		if token.Wait() && token.Error() == nil {
+			return
+		}
+		delay := backoff.Next()
+		fmt.Printf("error: unable to connect to MQTT broker, retrying in %s: %s\n", delay, token.Error())
+		time.Sleep(delay)
+	}
+}
+
+// onConnect subscribes on every connection, as the broker may have lost the session while we were away
+func (s *Subscriber) onConnect(client mqtt.Client) {
+	s.mu.Lock()
+	if s.connects > 0 {
+		s.reconnects.Inc()
+	}
+	s.connects++
+	s.mu.Unlock()
+	s.connected.Set(1)
+
+	backoff := s.Backoff
+	for {
+		err := subscribe(client, s.Topics, s.handle)
+		if err == nil {
+			break
+		}
+		if !client.IsConnectionOpen() {
+			// we'll subscribe again when we reconnect
+			fmt.Printf("error: unable to subscribe, connection lost: %s\n", err)
+			return
+		}
+		delay := backoff.Next()
+		fmt.Printf("error: unable to subscribe, retrying in %s: %s\n", delay, err)
+		time.Sleep(delay)
+	}
+	for topic := range s.Topics {
+		log.Printf("Subscribed to topic: %s\n", topic)
+	}
+
+	if s.OnConnect != nil {
+		s.OnConnect(client)
+	}
+}
+
+func (s *Subscriber) onConnectionLost(client mqtt.Client, err error) {
+	s.connected.Set(0)
+	fmt.Printf("warning: lost connection to MQTT broker: %s\n", err)
+}
+
+func (s *Subscriber) handle(client mqtt.Client, msg mqtt.Message) {
+	// the topic label is the subscription filter the message matched, as a wildcard can match any number of topics
+	for _, filter := range s.filters {
+		if matchTopic(filter, msg.Topic()) {
+			s.received.WithLabelValues(filter).Inc()
+			break
+		}
+	}
+	s.Handler(client, msg)
+}
+
+// matchTopic reports whether topic matches the subscription filter, which may contain + and # wildcards
+func matchTopic(filter, topic string) bool {
+	filterLevels := strings.Split(filter, "/")
+	topicLevels := strings.Split(topic, "/")
+	for i, level := range filterLevels {
+		if level == "#" {
+			return true
+		}
+		if i >= len(topicLevels) || (level != "+" && level != topicLevels[i]) {
+			return false
+		}
+	}
+	return len(filterLevels) == len(topicLevels)
+}
+
+// subscribe subscribes to topics, and checks the broker accepted every one of them
+func subscribe(client mqtt.Client, topics map[string]byte, handler mqtt.MessageHandler) error {
+	token := client.SubscribeMultiple(topics, handler)
+	if token.Wait() && token.Error() != nil {
+		return token.Error()
+	}
+	if st, ok := token.(*mqtt.SubscribeToken); ok {
+		for topic, code := range st.Result() {
+			if code == 0x80 {
+				return fmt.Errorf("broker rejected subscription to %s", topic)
+			}
+		}
+	}
+	return nil
+}
+
+// SetupLogging sends MQTT client errors and warnings to stdout
+func SetupLogging() {
+	mqtt.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
+	mqtt.CRITICAL = log.New(os.Stdout, "[CRIT] ", 0)
+	mqtt.WARN = log.New(os.Stdout, "[WARN]  ", 0)
+	//mqtt.DEBUG = log.New(os.Stdout, "[DEBUG] ", 0)
+}
@@ -0,0 +1,80 @@
+// Package exporter has the parts shared by the exporters: subscribing to an MQTT broker, expiring stale
+// measurements, health checks, and serving metrics. An exporter only needs to decode messages into gauges.
+package exporter
+
+import (
+	"flag"
+	"time"
+)
+
+// Options are the command line options every exporter has
+type Options struct {
+	Host           string
+	Port           int
+	Broker         string
+	Username       string
+	Password       string
+	CAFile         string
+	CertFile       string
+	KeyFile        string
+	ClientID       string
+	CleanSession   bool
+	Debug          bool
+	TTL            time.Duration
+	FieldTTLs      string
+	UnhealthyAfter time.Duration
+	Exit           bool
+	Listen         string
+	EmbeddedBroker string
+	Record         string
+	Replay         string
+	ReplaySpeed    float64
+}
+
+// RegisterFlags defines flags for the options, with the address the exporter listens on by default
+func (o *Options) RegisterFlags(fs *flag.FlagSet, listen string) {
+	o.RegisterMQTTFlags(fs)
+	o.RegisterServeFlags(fs, listen, 10*time.Minute)
+}
+
+// RegisterMQTTFlags defines flags for connecting to the MQTT broker, recording, and replaying
+func (o *Options) RegisterMQTTFlags(fs *flag.FlagSet) {
+	fs.StringVar(&o.Host, "h", "[::1]", "hostname/address of MQTT broker")
+	fs.IntVar(&o.Port, "p", 1883, "tcp port of MQTT broker")
+	fs.StringVar(&o.Broker, "broker", "", "URL of MQTT broker, like ssl://broker:8883 or wss://broker/mqtt (overrides -h and -p)")
+	fs.StringVar(&o.Username, "username", "", "username to authenticate to the MQTT broker with")
+	fs.StringVar(&o.Password, "password", "", "password to authenticate to the MQTT broker with (default $MQTT_PASSWORD)")
+	fs.StringVar(&o.CAFile, "ca-file", "", "PEM bundle of CAs to verify the MQTT broker with (default the system CAs)")
+	fs.StringVar(&o.CertFile, "cert-file", "", "PEM client certificate to authenticate to the MQTT broker with")
+	fs.StringVar(&o.KeyFile, "key-file", "", "PEM private key for -cert-file")
+	fs.StringVar(&o.ClientID, "client-id", "", "MQTT client ID, which should be stable across restarts (default <exporter>-<hostname>)")
+	fs.BoolVar(&o.CleanSession, "clean-session", false, "discard messages queued by the broker while the exporter was down")
+	fs.StringVar(&o.EmbeddedBroker, "embedded-broker", "", "run an MQTT broker on this address, like :1883, rather than connecting to one (clients authenticate with -username and -password, if set)")
+	fs.StringVar(&o.Record, "record", "", "append every message received to a JSON lines file, for replaying later")
+	fs.StringVar(&o.Replay, "replay", "", "read messages from a file written by -record, instead of the MQTT broker")
+	fs.Float64Var(&o.ReplaySpeed, "replay-speed", 1, "how much faster than real time to replay messages (0 is as fast as possible)")
+}
+
+// RegisterServeFlags defines flags for expiring measurements, health checks, and serving metrics, with the
+// address the exporter listens on and the TTL of measurements by default
+func (o *Options) RegisterServeFlags(fs *flag.FlagSet, listen string, ttl time.Duration) {
+	fs.BoolVar(&o.Debug, "d", false, "turn on debug output")
+	fs.DurationVar(&o.TTL, "t", ttl, "how long to wait for updates to a field before returning NaNs")
+	fs.StringVar(&o.FieldTTLs, "field-ttl", "", "comma separated field=duration pairs to override -t for slow fields")
+	fs.DurationVar(&o.UnhealthyAfter, "unhealthy-after", 0, "how long to wait for any update before reporting unhealthy (default 10 × -t)")
+	fs.BoolVar(&o.Exit, "exit", true, "exit when unhealthy, rather than only reporting it on /healthz")
+	fs.StringVar(&o.Listen, "listen", listen, "address to serve /metrics and /healthz on")
+}
+
+// TTLs returns the TTL of each field, from -t and -field-ttl
+func (o Options) TTLs() (TTLs, error) {
+	return ParseTTLs(o.FieldTTLs, o.TTL)
+}
+
+// HealthTimeout returns how long to wait for any update before reporting unhealthy
+func (o Options) HealthTimeout() time.Duration {
+	if o.UnhealthyAfter == 0 {
+		return o.TTL * 10
+	}
+	return o.UnhealthyAfter
+}
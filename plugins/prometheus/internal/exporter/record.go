@@ -0,0 +1,108 @@
+package exporter
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+)
+
+// Recording is a message received from the broker, as written by -record, one JSON object per line. The
+// payload is base64 encoded, so binary payloads replay byte for byte.
+type Recording struct {
+	Topic     string    `json:"topic"`
+	Payload   []byte    `json:"payload"`
+	Timestamp time.Time `json:"timestamp"`
+}
+
+// Recorder writes every message received to w, before passing it to an exporter's handler
+type Recorder struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+// NewRecorder sets up a recorder writing to w
+func NewRecorder(w io.Writer) *Recorder {
+	return &Recorder{enc: json.NewEncoder(w)}
+}
+
+// Record wraps handler, so every message it's passed is recorded first
+func (r *Recorder) Record(handler mqtt.MessageHandler) mqtt.MessageHandler {
+	return func(c mqtt.Client, msg mqtt.Message) {
+		r.mu.Lock()
+		err := r.enc.Encode(Recording{Topic: msg.Topic(), Payload: msg.Payload(), Timestamp: time.Now()})
+		r.mu.Unlock()
+		if err != nil {
+			RateLimitedPrintln(fmt.Sprintf("error: unable to record message: %s", err), time.Minute)
+		}
+		handler(c, msg)
+	}
+}
+
+// Replay passes recorded messages to handler, with a client that isn't connected to a broker. The time between messages is divided
+// by speed, so 1 replays in real time, and 0 replays as fast as possible. It returns the number of messages
+// replayed.
+func Replay(r io.Reader, handler mqtt.MessageHandler, speed float64) (int, error) {
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+
+	client := replayClient{options: mqtt.NewClient(mqtt.NewClientOptions().SetClientID("replay")).OptionsReader()}
+	var n, line int
+	var last time.Time
+	for scanner.Scan() {
+		line++
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var rec Recording
+		if err := json.Unmarshal(scanner.Bytes(), &rec); err != nil {
+			return n, fmt.Errorf("bad recording on line %d: %w", line, err)
+		}
+		if speed > 0 && !last.IsZero() && rec.Timestamp.After(last) {
+			time.Sleep(time.Duration(float64(rec.Timestamp.Sub(last)) / speed))
+		}
+		last = rec.Timestamp
+		handler(client, message{topic: rec.Topic, payload: rec.Payload})
+		n++
+	}
+	return n, scanner.Err()
+}
+
+// replayClient is the client handlers are given when replaying. There's no broker, so messages published by
+// handlers, like commands to devices, are dropped, and subscribing does nothing.
+type replayClient struct {
+	options mqtt.ClientOptionsReader
+}
+
+var _ mqtt.Client = replayClient{}
+
+func (c replayClient) IsConnected() bool      { return false }
+func (c replayClient) IsConnectionOpen() bool { return false }
+func (c replayClient) Connect() mqtt.Token    { return doneToken{} }
+func (c replayClient) Disconnect(uint)        {}
+
+func (c replayClient) Publish(string, byte, bool, interface{}) mqtt.Token {
+	return doneToken{}
+}
+
+func (c replayClient) Subscribe(string, byte, mqtt.MessageHandler) mqtt.Token {
+	return doneToken{}
+}
+
+func (c replayClient) SubscribeMultiple(map[string]byte, mqtt.MessageHandler) mqtt.Token {
+	return doneToken{}
+}
+
+func (c replayClient) Unsubscribe(...string) mqtt.Token {
+	return doneToken{}
+}
+
+func (c replayClient) AddRoute(string, mqtt.MessageHandler) {}
+
+func (c replayClient) OptionsReader() mqtt.ClientOptionsReader {
+	return c.options
+}
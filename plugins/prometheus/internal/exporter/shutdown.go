@@ -0,0 +1,36 @@
+package exporter
+
+import (
+	"os"
+	"sync"
+)
+
+var (
+	shutdownMu    sync.Mutex
+	shutdownHooks []func()
+)
+
+// OnShutdown registers a function to run before the exporter exits, like logging out of a device
+func OnShutdown(hook func()) {
+	shutdownMu.Lock()
+	defer shutdownMu.Unlock()
+	shutdownHooks = append(shutdownHooks, hook)
+}
+
+// Shutdown runs the shutdown hooks, in the order they were registered. Each runs once, however many times
+// Shutdown is called.
+func Shutdown() {
+	shutdownMu.Lock()
+	hooks := shutdownHooks
+	shutdownHooks = nil
+	shutdownMu.Unlock()
+	for _, hook := range hooks {
+		hook()
+	}
+}
+
+// Exit runs the shutdown hooks, then exits with code
+func Exit(code int) {
+	Shutdown()
+	os.Exit(code)
+}
@@ -0,0 +1,127 @@
+package exporter
+
+import (
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// TTLs are how long each field's measurements are valid for without an update
+type TTLs struct {
+	Default time.Duration
+	Fields  map[string]time.Duration
+}
+
+// For returns the TTL of a field
+func (t TTLs) For(field string) time.Duration {
+	if d, ok := t.Fields[field]; ok {
+		return d
+	}
+	return t.Default
+}
+
+// ParseTTLs parses a comma separated list of field=duration pairs, which override the default TTL
+func ParseTTLs(s string, def time.Duration) (TTLs, error) {
+	ttls := TTLs{Default: def, Fields: map[string]time.Duration{}}
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		field, value, ok := strings.Cut(pair, "=")
+		if !ok || len(strings.TrimSpace(field)) == 0 {
+			return ttls, fmt.Errorf("bad field TTL %q: expected field=duration", pair)
+		}
+		d, err := time.ParseDuration(strings.TrimSpace(value))
+		if err != nil {
+			return ttls, fmt.Errorf("bad field TTL %q: %w", pair, err)
+		}
+		ttls.Fields[strings.TrimSpace(field)] = d
+	}
+	return ttls, nil
+}
+
+// Health tracks whether the exporter is receiving any updates at all
+type Health struct {
+	Timeout time.Duration
+
+	mu    sync.Mutex
+	last  time.Time
+	gauge prometheus.Gauge
+}
+
+// NewHealth registers a gauge reporting whether an update has been received within the timeout
+func NewHealth(reg prometheus.Registerer, name string, timeout time.Duration) *Health {
+	h := &Health{
+		Timeout: timeout,
+		last:    time.Now(),
+		gauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: name,
+			Help: "Whether the exporter has received an update recently (1), or not (0).",
+		}),
+	}
+	h.gauge.Set(1)
+	reg.MustRegister(h.gauge)
+	return h
+}
+
+// Refresh records an update
+func (h *Health) Refresh(t time.Time) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.last = t
+}
+
+// Check updates the health gauge, and returns how long it's been since the last update if unhealthy
+func (h *Health) Check(now time.Time) (time.Duration, bool) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	since := now.Sub(h.last)
+	if since > h.Timeout {
+		h.gauge.Set(0)
+		return since, false
+	}
+	h.gauge.Set(1)
+	return since, true
+}
+
+// ServeHTTP responds with 503 Service Unavailable when unhealthy, for use as a health check
+func (h *Health) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if since, ok := h.Check(time.Now()); !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		fmt.Fprintf(w, "no updates for %s\n", since.Round(time.Second))
+		return
+	}
+	fmt.Fprintln(w, "ok")
+}
+
+// Watch nils out measurements that aren't updated within their TTL, and checks the exporter is still receiving updates.
+//
+// If no updates are received on refresh within the health timeout, the exporter reports itself unhealthy, and optionally exits.
+func Watch(gauges *GaugeSet, refresh chan time.Time, ttls TTLs, health *Health, exit bool) {
+	// read for updates
+	go func() {
+		for t := range refresh {
+			health.Refresh(t)
+		}
+	}()
+
+	// check if the TTL has expired
+	ticker := time.NewTicker(time.Second)
+	for {
+		now := <-ticker.C
+		if n := gauges.Expire(now, ttls); n > 0 {
+			RateLimitedPrintln(fmt.Sprintf("error: TTL expired on %d measurements - setting them to NaN", n), 30*time.Second)
+		}
+		if since, ok := health.Check(now); !ok {
+			if exit {
+				fmt.Printf("error: no updates for %s - exiting\n", since.Round(time.Second))
+				Exit(2)
+			}
+			RateLimitedPrintln(fmt.Sprintf("error: no updates for %s - reporting unhealthy", since.Round(time.Second)), 30*time.Second)
+		}
+	}
+}
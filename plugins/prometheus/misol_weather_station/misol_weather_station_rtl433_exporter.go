@@ -1,265 +1,421 @@
 package main
 
 import (
+	"bytes"
+	"encoding/json"
 	"flag"
 	"fmt"
 	"log"
-	"math"
-	"net/http"
-	"os"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
-// Metrics represents metrics to be exported
+// Device identifies a device decoded by rtl_433
+type Device struct {
+	Model   string
+	ID      string
+	Channel string
+}
+
+// labels returns the labels to export a device's measurements with
+func (d Device) labels() prometheus.Labels {
+	return prometheus.Labels{"model": d.Model, "id": d.ID, "channel": d.Channel}
+}
+
+// Filter selects the devices to export measurements from
+type Filter struct {
+	Models []string
+	IDs    []string
+}
+
+// Allows checks if a device passes the filter. An empty filter allows every device.
+func (f Filter) Allows(d Device) bool {
+	return allowed(f.Models, d.Model) && allowed(f.IDs, d.ID)
+}
+
+func allowed(list []string, v string) bool {
+	if len(list) == 0 {
+		return true
+	}
+	for _, l := range list {
+		if l == v {
+			return true
+		}
+	}
+	return false
+}
+
+// Metrics represents metrics to be exported.
+//
+// A gauge is registered for each field as it's first seen, so fields don't need to be known ahead of time.
 type Metrics struct {
-	battery       prometheus.Gauge
-	temperature   prometheus.Gauge
-	humidity      prometheus.Gauge
-	windDirection prometheus.Gauge
-	windAvg       prometheus.Gauge
-	windMax       prometheus.Gauge
-	rain          prometheus.Gauge
+	preset Preset
+	gauges *exporter.GaugeSet
+
+	mu sync.Mutex
+
+	rainTotal    *prometheus.CounterVec
+	rainLastHour *prometheus.GaugeVec
+	rainToday    *prometheus.GaugeVec
+	rainRate     *prometheus.GaugeVec
+	rain         map[Device]*rainTracker
+
+	windGust      *prometheus.GaugeVec
+	windSpeed     *prometheus.GaugeVec
+	windDirection *prometheus.GaugeVec
+	windRose      *prometheus.HistogramVec
+	wind          map[Device]*windTracker
 }
 
 // NewMetrics registers new metrics to export
-func NewMetrics(reg prometheus.Registerer) *Metrics {
+func NewMetrics(reg prometheus.Registerer, preset Preset) *Metrics {
 	m := &Metrics{
-		battery: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "outdoor_battery",
-			Help: "Current battery status of weather station.",
-		}),
-		temperature: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "outdoor_temperature_celsius",
-			Help: "Current temperature outside of house.",
-		}),
-		humidity: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "outdoor_humidity_percentage",
-			Help: "Relative humidity outside of house.",
-		}),
-		windDirection: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "outdoor_wind_direction_degree",
-			Help: "Direction of wind in degrees.",
-		}),
-		windAvg: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "outdoor_wind_speed_average_kilometers_per_hour",
-			Help: "Average wind speed in kilometers per hour.",
-		}),
-		windMax: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "outdoor_wind_speed_burst_kilometers_per_hour",
-			Help: "Max burst wind speed in kilometers per hour.",
-		}),
-		rain: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "outdoor_rain_millimetres",
-			Help: "Rainfall in millimeters",
-		}),
+		preset: preset,
+		gauges: exporter.NewGaugeSet(reg, "model", "id", "channel"),
+		rain:   map[Device]*rainTracker{},
+		wind:   map[Device]*windTracker{},
+	}
+	// Register the preset's fields up front, so naming conflicts show up at startup
+	for _, f := range preset.Fields {
+		m.register(f)
 	}
-	reg.MustRegister(m.battery)
-	reg.MustRegister(m.temperature)
-	reg.MustRegister(m.humidity)
-	reg.MustRegister(m.windDirection)
-	reg.MustRegister(m.windAvg)
-	reg.MustRegister(m.windMax)
-	reg.MustRegister(m.rain)
 
+	if preset.Exports("rain_mm") {
+		labels := []string{"model", "id", "channel"}
+		m.rainTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: preset.Namespace + "_rain_millimetres_total",
+			Help: "Rainfall in millimeters, counted across station resets.",
+		}, labels)
+		m.rainLastHour = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: preset.Namespace + "_rain_last_hour_millimetres",
+			Help: "Rainfall in millimeters over the last hour.",
+		}, labels)
+		m.rainToday = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: preset.Namespace + "_rain_since_midnight_millimetres",
+			Help: "Rainfall in millimeters since local midnight.",
+		}, labels)
+		m.rainRate = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: preset.Namespace + "_rain_rate_millimetres_per_hour",
+			Help: "Rain rate in millimeters per hour, over the last 10 minutes.",
+		}, labels)
+		reg.MustRegister(m.rainTotal)
+		reg.MustRegister(m.rainLastHour)
+		reg.MustRegister(m.rainToday)
+		reg.MustRegister(m.rainRate)
+		m.gauges.Derive("rain_mm", m.rainLastHour, m.rainToday, m.rainRate)
+	}
+
+	if preset.Exports("wind_avg_km_h") && preset.Exports("wind_max_km_h") && preset.Exports("wind_dir_deg") {
+		labels := []string{"model", "id", "channel"}
+		m.windGust = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: preset.Namespace + "_wind_gust_max_10m_kilometers_per_hour",
+			Help: "Max wind gust in kilometers per hour over the last 10 minutes.",
+		}, labels)
+		m.windSpeed = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: preset.Namespace + "_wind_speed_mean_10m_kilometers_per_hour",
+			Help: "Mean wind speed in kilometers per hour over the last 10 minutes.",
+		}, labels)
+		m.windDirection = prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: preset.Namespace + "_wind_direction_mean_10m_degrees",
+			Help: "Vector averaged wind direction in degrees over the last 10 minutes.",
+		}, labels)
+		m.windRose = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+			Name:    preset.Namespace + "_wind_rose_kilometers_per_hour",
+			Help:    "Average wind speed in kilometers per hour, by compass direction.",
+			Buckets: []float64{1, 6, 12, 20, 29, 39, 50, 62, 75, 89, 103, 118}, // Beaufort scale
+		}, append(labels, "direction"))
+		reg.MustRegister(m.windGust)
+		reg.MustRegister(m.windSpeed)
+		reg.MustRegister(m.windDirection)
+		reg.MustRegister(m.windRose)
+		m.gauges.Derive("wind_max_km_h", m.windGust)
+		m.gauges.Derive("wind_avg_km_h", m.windSpeed)
+		m.gauges.Derive("wind_dir_deg", m.windDirection)
+	}
 	return m
 }
 
-// readMeasurementLoop sets up a mqtt client, reads measurements from a topic, and updates exported metrics
-func readMeasurementLoop(metrics *Metrics, host string, port int, ttl time.Duration) {
-	opts := mqtt.NewClientOptions()
-	hostname, err := os.Hostname()
-	if err != nil {
-		panic(err)
+// register registers the gauge for a field as it's first seen, and checks the field is exported
+func (m *Metrics) register(field string) bool {
+	if !m.preset.Exports(field) {
+		return false
 	}
-	pid := os.Getpid()
-
-	clientID := fmt.Sprintf("misol_weather_station_rtl433_exporter-%s-%d", hostname, pid)
-	fmt.Printf("Connecting with ClientID: %s\n", clientID)
-	opts.SetClientID(clientID)
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", host, port))
-	opts.SetPingTimeout(1 * time.Second)
-	opts.SetKeepAlive(60 * time.Second)
-	opts.SetOrderMatters(false)
-	opts.SetAutoReconnect(true)
-	opts.SetConnectRetry(true)
-
-	// Set up the TTL checker early, in case MQTT is unavailable
-	refresh := make(chan time.Time)
-	readMeasurement := measurementReader(metrics, refresh)
-	exit := ttl * 10
-	go nilIfTTLExpired(metrics, refresh, ttl, exit)
-
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+	if err := m.gauges.Register(field, m.preset.MetricName(field), m.preset.MetricHelp(field)); err != nil {
+		fmt.Printf("error: unable to export %s: %s\n", field, err)
 	}
+	return m.gauges.Registered(field)
+}
+
+// set updates the gauge for a field measured by a device
+func (m *Metrics) set(d Device, field string, v float64) {
+	if !m.register(field) {
+		return
+	}
+	now := time.Now()
+	m.gauges.Set(field, d.labels(), v, now)
 
-	topic := "sensors/rtl_433/#"
-	if token := client.Subscribe(topic, 1, readMeasurement); token.Wait() && token.Error() != nil {
-		fmt.Printf("error: %s", token.Error())
-		os.Exit(1)
+	switch field {
+	case "rain_mm":
+		m.observeRain(d, v, now)
+	case "wind_avg_km_h", "wind_max_km_h", "wind_dir_deg":
+		m.observeWind(d, field, v, now)
 	}
-	fmt.Printf("Subscribed to topic: %s\n", topic)
 }
 
-func rateLimitedPrintln(s string, d time.Duration) {
-	last := rateLimitedPrintlnTable[s]
-	now := time.Now()
-	if now.Sub(last) > d {
-		fmt.Println(s)
-		rateLimitedPrintlnTable[s] = now
+// observeWind updates the rolling wind statistics and wind rose for a device
+func (m *Metrics) observeWind(d Device, field string, v float64, now time.Time) {
+	if m.windGust == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	w, ok := m.wind[d]
+	if !ok {
+		w = &windTracker{}
+		m.wind[d] = w
+	}
+	// the wind rose is observed once a direction and the speed from the same transmission have both arrived
+	var direction, speed float64
+	var paired bool
+	switch field {
+	case "wind_avg_km_h":
+		speed = v
+		direction, paired = w.observeSpeed(now, v)
+	case "wind_max_km_h":
+		w.observeGust(now, v)
+	case "wind_dir_deg":
+		direction = v
+		speed, paired = w.observeDirection(now, v)
 	}
+	if paired {
+		labels := d.labels()
+		labels["direction"] = compassPoint(direction)
+		m.windRose.With(labels).Observe(speed)
+	}
+	m.windGust.With(d.labels()).Set(w.maxGust())
+	m.windSpeed.With(d.labels()).Set(w.meanSpeed())
+	m.windDirection.With(d.labels()).Set(w.meanDirection())
 }
 
-// nilIfTTLExpired nils out a metric if an update isn't received within a timeout
-func nilIfTTLExpired(metrics *Metrics, refresh chan time.Time, ttl time.Duration, exit time.Duration) {
-	NaN := math.Log(-1.0)
-	last := time.Now()
+// observeRain updates the rain counter and derived rainfall from a station's cumulative rain total
+func (m *Metrics) observeRain(d Device, v float64, now time.Time) {
+	if m.rainTotal == nil {
+		return
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	r, ok := m.rain[d]
+	if !ok {
+		r = &rainTracker{}
+		m.rain[d] = r
+	}
+	m.rainTotal.With(d.labels()).Add(r.observe(now, v))
+	m.rainLastHour.With(d.labels()).Set(r.lastHour(now))
+	m.rainToday.With(d.labels()).Set(r.sinceMidnight(now))
+	m.rainRate.With(d.labels()).Set(r.rate(now))
+}
+
+// parseTopic finds the device and field a message was published for.
+//
+// rtl_433 publishes each field to `<prefix>/devices[/model][/channel][/id]/<field>` by default.
+// Topics without a `devices` segment are read as a bare field, from an unknown device.
+func parseTopic(topic string) (Device, string) {
+	parts := strings.Split(topic, "/")
+	field := parts[len(parts)-1]
 
-	// read for updates
-	go func() {
-		for t := range refresh {
-			last = t
+	var d Device
+	for i, p := range parts[:len(parts)-1] {
+		if p != "devices" {
+			continue
 		}
-	}()
-
-	// check if the TTL has expired
-	ticker := time.NewTicker(time.Second)
-	for {
-		now := <-ticker.C
-		if now.Sub(last) > ttl {
-			rateLimitedPrintln("error: TTL expired on last measurement - setting all measurements to NaN", 30*time.Second)
-			metrics.battery.Set(NaN)
-			metrics.temperature.Set(NaN)
-			metrics.humidity.Set(NaN)
-			metrics.windDirection.Set(NaN)
-			metrics.windAvg.Set(NaN)
-			metrics.windMax.Set(NaN)
-			metrics.rain.Set(NaN)
+		segments := parts[i+1 : len(parts)-1]
+		switch len(segments) {
+		case 0:
+		case 1:
+			d.Model = segments[0]
+		case 2:
+			d.Model, d.ID = segments[0], segments[1]
+		default:
+			d.Model = segments[0]
+			d.Channel = segments[len(segments)-2]
+			d.ID = segments[len(segments)-1]
 		}
-		if now.Sub(last) > exit {
-			fmt.Printf("error: no updates for %s - exiting\n", exit)
-			os.Exit(2)
+		break
+	}
+	return d, field
+}
+
+// parseEvent reads a device and its fields from a rtl_433 JSON event, as published to `<prefix>/events`
+func parseEvent(payload []byte) (Device, map[string]float64, error) {
+	var event map[string]interface{}
+	d := json.NewDecoder(bytes.NewReader(payload))
+	d.UseNumber()
+	if err := d.Decode(&event); err != nil {
+		return Device{}, nil, err
+	}
+
+	device := Device{
+		Model:   fmt.Sprint(valueOrEmpty(event["model"])),
+		ID:      fmt.Sprint(valueOrEmpty(event["id"])),
+		Channel: fmt.Sprint(valueOrEmpty(event["channel"])),
+	}
+	fields := map[string]float64{}
+	for k, v := range event {
+		n, ok := v.(json.Number)
+		if !ok {
+			continue
 		}
+		f, err := n.Float64()
+		if err != nil {
+			continue
+		}
+		fields[k] = f
 	}
+	return device, fields, nil
 }
 
-// Measurements tracks the types of measurements we receive
-var Measurements = map[string]string{
-	"time":          "time",    // "2023-02-23 11:22:24"
-	"model":         "string",  // "Fineoffset-WHx080"
-	"id":            "int",     // 240
-	"battery_ok":    "bool",    // 1
-	"temperature_C": "decimal", // 20.800
-	"humidity":      "int",     // 68
-	"wind_dir_deg":  "int",     // 135
-	"wind_avg_km_h": "decimal", // 1.224
-	"wind_max_km_h": "decimal", // 2.448
-	"rain_mm":       "decimal", // 70.200
+func valueOrEmpty(v interface{}) interface{} {
+	if v == nil {
+		return ""
+	}
+	return v
+}
+
+// eventReader returns a function that updates metrics from a whole rtl_433 JSON event, so fields from one
+// transmission update together
+func eventReader(metrics *Metrics, filter Filter, refresh chan time.Time) func([]byte) {
+	return func(payload []byte) {
+		device, values, err := parseEvent(payload)
+		if err != nil {
+			fmt.Printf("error: unable to decode event: %s\n", err)
+			return
+		}
+		if len(device.Model) == 0 || !filter.Allows(device) {
+			return
+		}
+		// in a fixed order, so speeds are set before the direction that's paired with them
+		fields := make([]string, 0, len(values))
+		for k := range values {
+			fields = append(fields, k)
+		}
+		sort.Slice(fields, func(i, j int) bool {
+			return fieldOrder(fields[i]) < fieldOrder(fields[j]) ||
+				fieldOrder(fields[i]) == fieldOrder(fields[j]) && fields[i] < fields[j]
+		})
+		for _, k := range fields {
+			metrics.set(device, k, values[k])
+		}
+		refresh <- time.Now()
+	}
+}
+
+// fieldOrder sorts wind direction after the other fields of an event
+func fieldOrder(field string) int {
+	if field == "wind_dir_deg" {
+		return 1
+	}
+	return 0
 }
 
 // measurementReader returns a function to be used as a callback when messages are received in client.Subscribe
-func measurementReader(metrics *Metrics, refresh chan time.Time) func(mqtt.Client, mqtt.Message) {
+func measurementReader(metrics *Metrics, filter Filter, refresh chan time.Time) func(mqtt.Client, mqtt.Message) {
+	readEvent := eventReader(metrics, filter, refresh)
 	return func(c mqtt.Client, msg mqtt.Message) {
-		parts := strings.Split(msg.Topic(), "/")
-		name := parts[len(parts)-1]
-		fmt.Printf("topic: %s, payload: %s\n", msg.Topic(), msg.Payload())
-		refresh <- time.Now()
-		switch name {
-		case "battery_ok":
-			float, err := strconv.ParseFloat(string(msg.Payload()), 64)
-			if err != nil {
-				fmt.Printf("error: unable to parse float for temperature_C: %s", err)
-				return
-			}
-			metrics.battery.Set(float)
-		case "temperature_C":
-			float, err := strconv.ParseFloat(string(msg.Payload()), 64)
-			if err != nil {
-				fmt.Printf("error: unable to parse float for temperature_C: %s", err)
-				return
-			}
-			metrics.temperature.Set(float)
-		case "humidity":
-			float, err := strconv.ParseFloat(string(msg.Payload()), 64)
-			if err != nil {
-				fmt.Printf("error: unable to parse float for temperature_C: %s", err)
-				return
-			}
-			metrics.humidity.Set(float)
-		case "wind_dir_deg":
-			float, err := strconv.ParseFloat(string(msg.Payload()), 64)
-			if err != nil {
-				fmt.Printf("error: unable to parse float for temperature_C: %s", err)
-				return
-			}
-			metrics.windDirection.Set(float)
-		case "wind_avg_km_h":
-			float, err := strconv.ParseFloat(string(msg.Payload()), 64)
-			if err != nil {
-				fmt.Printf("error: unable to parse float for wind_avg_km_h: %s", err)
-				return
-			}
-			metrics.windAvg.Set(float)
-		case "wind_max_km_h":
-			float, err := strconv.ParseFloat(string(msg.Payload()), 64)
-			if err != nil {
-				fmt.Printf("error: unable to parse float for wind_max_km_h: %s", err)
-				return
-			}
-			metrics.windMax.Set(float)
-		case "rain_mm":
-			float, err := strconv.ParseFloat(string(msg.Payload()), 64)
-			if err != nil {
-				fmt.Printf("error: unable to parse float for rain_mm: %s", err)
-				return
+		if opts.Debug {
+			fmt.Printf("topic: %s, payload: %s\n", msg.Topic(), msg.Payload())
+		}
+		device, name := parseTopic(msg.Topic())
+
+		if name == "events" {
+			readEvent(msg.Payload())
+			return
+		}
+
+		if !metrics.preset.Exports(name) || !filter.Allows(device) {
+			return
+		}
+		float, err := strconv.ParseFloat(string(msg.Payload()), 64)
+		if err != nil {
+			if opts.Debug {
+				fmt.Printf("debug: ignoring non-numeric %s: %s\n", name, err)
 			}
-			metrics.rain.Set(float)
+			return
 		}
+		metrics.set(device, name, float)
+		refresh <- time.Now()
 	}
 }
 
+// splitList splits a comma separated flag value into a list
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		if v = strings.TrimSpace(v); len(v) > 0 {
+			list = append(list, v)
+		}
+	}
+	return list
+}
+
 var (
-	host                    string
-	port                    int
-	debug                   bool
-	ttl                     time.Duration
-	rateLimitedPrintlnTable map[string]time.Time
+	opts   exporter.Options
+	models string
+	ids    string
+	preset string
+	fields string
+	rename string
+	input  string
 )
 
 func init() {
-	flag.StringVar(&host, "h", "[::1]", "hostname/address of MQTT broker")
-	flag.IntVar(&port, "p", 1883, "tcp port of MQTT broker")
-	flag.BoolVar(&debug, "d", false, "turn on debug output")
-	flag.DurationVar(&ttl, "t", 10*time.Minute, "how long to wait for updates before returning NaNs")
-	rateLimitedPrintlnTable = make(map[string]time.Time)
+	opts.RegisterFlags(flag.CommandLine, ":10000")
+	flag.StringVar(&models, "model", "", "comma separated rtl_433 models to export (default all)")
+	flag.StringVar(&ids, "id", "", "comma separated rtl_433 device ids to export (default all)")
+	flag.StringVar(&preset, "preset", "misol", "preset field names and allowlist to export with (misol, generic)")
+	flag.StringVar(&fields, "fields", "", "comma separated rtl_433 fields to export (default the preset's fields)")
+	flag.StringVar(&rename, "rename", "", "comma separated field=metric_name pairs to rename exported fields")
+	flag.StringVar(&input, "input", "mqtt", "where to read rtl_433 events from: mqtt, - for the output of rtl_433 -F json on stdin, a file or pipe, or the URL of rtl_433's HTTP server, like http://localhost:8433/events or ws://localhost:8433/ws")
 }
 
 func main() {
 	flag.Parse()
+	exporter.SetupLogging()
 
-	mqtt.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
-	mqtt.CRITICAL = log.New(os.Stdout, "[CRIT] ", 0)
-	mqtt.WARN = log.New(os.Stdout, "[WARN]  ", 0)
-	//mqtt.DEBUG = log.New(os.Stdout, "[DEBUG] ", 0)
-
-	// Create a non-global registry.
-	reg := prometheus.NewRegistry()
+	renames, err := parseRename(rename)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	p, err := NewPreset(preset, splitList(fields), renames)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	e, err := exporter.New("misol_weather_station_rtl433_exporter", p.Namespace, opts)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
 
-	// Create new metrics and register them using the custom registry.
-	metrics := NewMetrics(reg)
+	// Create new metrics and register them using the exporter's registry.
+	metrics := NewMetrics(e.Registry, p)
 
-	// Read measurements via MQTT, update metrics
-	go readMeasurementLoop(metrics, host, port, ttl)
+	filter := Filter{Models: splitList(models), IDs: splitList(ids)}
+	if input != "mqtt" {
+		// Read whole events straight from rtl_433, update metrics, and expose them on /metrics
+		readEvent := eventReader(metrics, filter, e.Refresh)
+		log.Fatal(e.RunInput(metrics.gauges, func() error {
+			return readInput(input, readEvent)
+		}))
+	}
 
-	// Expose metrics and custom registry via an HTTP server
-	// using the HandleFor function. "/metrics" is the usual endpoint for that.
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
-	log.Fatal(http.ListenAndServe(":10000", nil))
+	// Read measurements via MQTT, update metrics, and expose them on /metrics
+	log.Fatal(e.Run(metrics.gauges, exporter.Subscription{
+		Topics:  map[string]byte{"sensors/rtl_433/#": 1},
+		Handler: measurementReader(metrics, filter, e.Refresh),
+	}))
 }
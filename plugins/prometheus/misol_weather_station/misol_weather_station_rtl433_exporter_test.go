@@ -1,14 +1,21 @@
 package main
 
 import (
+	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/http/httptest"
+	"os"
+	"path/filepath"
 	"strconv"
+	"strings"
 	"testing"
 	"time"
 
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
 	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/gorilla/websocket"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
 	"github.com/stretchr/testify/assert"
@@ -45,25 +52,29 @@ func TestMeasurementReader(t *testing.T) {
 
 	// setup
 	reg := prometheus.NewRegistry()
-	metrics := NewMetrics(reg)
+	metrics := NewMetrics(reg, Presets["misol"])
 	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
 	defer ts.Close()
 	refresh := make(chan time.Time, 1000)
 
-	readMeasurement := measurementReader(metrics, refresh)
+	readMeasurement := measurementReader(metrics, Filter{}, refresh)
 	c := mqtt.NewClient(mqtt.NewClientOptions())
 
+	prefix := "sensors/rtl_433/devices/Fineoffset-WHx080/240/"
+	labels := `{channel="",id="240",model="Fineoffset-WHx080"}`
 	testCases := []struct {
 		msg      TestMsg
 		expected string
 	}{
-		{TestMsg{TopicString: "battery_ok", PayloadBytes: []byte(strconv.Itoa(1))}, "outdoor_battery 1"},
-		{TestMsg{TopicString: "temperature_C", PayloadBytes: []byte(strconv.FormatFloat(18.3, 'f', -1, 64))}, "outdoor_temperature_celsius 18.3"},
-		{TestMsg{TopicString: "humidity", PayloadBytes: []byte(strconv.FormatFloat(47, 'f', -1, 64))}, "outdoor_humidity_percentage 47"},
-		{TestMsg{TopicString: "wind_dir_deg", PayloadBytes: []byte(strconv.FormatFloat(170, 'f', -1, 64))}, "outdoor_wind_direction_degree 170"},
-		{TestMsg{TopicString: "wind_avg_km_h", PayloadBytes: []byte(strconv.FormatFloat(20, 'f', -1, 64))}, "outdoor_wind_speed_average_kilometers_per_hour 20"},
-		{TestMsg{TopicString: "wind_max_km_h", PayloadBytes: []byte(strconv.FormatFloat(45, 'f', -1, 64))}, "outdoor_wind_speed_burst_kilometers_per_hour 45"},
-		{TestMsg{TopicString: "rain_mm", PayloadBytes: []byte(strconv.FormatFloat(3.5, 'f', -1, 64))}, "outdoor_rain_millimetres 3.5"},
+		{TestMsg{TopicString: prefix + "battery_ok", PayloadBytes: []byte(strconv.Itoa(1))}, "outdoor_battery" + labels + " 1"},
+		{TestMsg{TopicString: prefix + "temperature_C", PayloadBytes: []byte(strconv.FormatFloat(18.3, 'f', -1, 64))}, "outdoor_temperature_celsius" + labels + " 18.3"},
+		{TestMsg{TopicString: prefix + "humidity", PayloadBytes: []byte(strconv.FormatFloat(47, 'f', -1, 64))}, "outdoor_humidity_percentage" + labels + " 47"},
+		{TestMsg{TopicString: prefix + "wind_dir_deg", PayloadBytes: []byte(strconv.FormatFloat(170, 'f', -1, 64))}, "outdoor_wind_direction_degree" + labels + " 170"},
+		{TestMsg{TopicString: prefix + "wind_avg_km_h", PayloadBytes: []byte(strconv.FormatFloat(20, 'f', -1, 64))}, "outdoor_wind_speed_average_kilometers_per_hour" + labels + " 20"},
+		{TestMsg{TopicString: prefix + "wind_max_km_h", PayloadBytes: []byte(strconv.FormatFloat(45, 'f', -1, 64))}, "outdoor_wind_speed_burst_kilometers_per_hour" + labels + " 45"},
+		{TestMsg{TopicString: prefix + "rain_mm", PayloadBytes: []byte(strconv.FormatFloat(3.5, 'f', -1, 64))}, "outdoor_rain_millimetres" + labels + " 3.5"},
+		{TestMsg{TopicString: "sensors/rtl_433/temperature_C", PayloadBytes: []byte("17.1")}, `outdoor_temperature_celsius{channel="",id="",model=""} 17.1`},
+		{TestMsg{TopicString: "sensors/rtl_433/devices/Acurite-Tower/A/1234/temperature_C", PayloadBytes: []byte("21.5")}, `outdoor_temperature_celsius{channel="A",id="1234",model="Acurite-Tower"} 21.5`},
 	}
 
 	for _, tc := range testCases {
@@ -82,12 +93,329 @@ func TestMeasurementReader(t *testing.T) {
 
 }
 
+func TestMeasurementReaderFiltersDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, Presets["misol"])
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	filter := Filter{Models: []string{"Fineoffset-WHx080"}, IDs: []string{"240"}}
+	readMeasurement := measurementReader(metrics, filter, refresh)
+	c := mqtt.NewClient(mqtt.NewClientOptions())
+
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/devices/Fineoffset-WHx080/240/temperature_C", PayloadBytes: []byte("18.3")})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/devices/Fineoffset-WHx080/17/temperature_C", PayloadBytes: []byte("35.1")})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/devices/Nexus-TH/1/17/temperature_C", PayloadBytes: []byte("-4")})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/temperature_C", PayloadBytes: []byte("12")})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/events", PayloadBytes: []byte(`{"time":"2023-02-23 11:22:24","model":"Fineoffset-WHx080","id":240,"battery_ok":1,"humidity":68,"wind_dir_deg":135}`)})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/events", PayloadBytes: []byte(`{"time":"2023-02-23 11:22:25","model":"Toyota","type":"TPMS","id":"8b3e41c2","pressure_kPa":230.5}`)})
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	labels := `{channel="",id="240",model="Fineoffset-WHx080"}`
+	assert.Contains(string(body), "outdoor_temperature_celsius"+labels+" 18.3")
+	assert.Contains(string(body), "outdoor_humidity_percentage"+labels+" 68")
+	assert.Contains(string(body), "outdoor_wind_direction_degree"+labels+" 135")
+	assert.Contains(string(body), "outdoor_battery"+labels+" 1")
+	assert.NotContains(string(body), "35.1")
+	assert.NotContains(string(body), "Nexus-TH")
+	assert.NotContains(string(body), `id=""`)
+	assert.NotContains(string(body), "Toyota")
+	assert.Len(refresh, 2)
+}
+
+func TestGenericPresetDiscoversFields(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	p, err := NewPreset("generic", nil, map[string]string{"moisture": "garden_soil_moisture_percentage"})
+	assert.NoError(err)
+	metrics := NewMetrics(reg, p)
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	readMeasurement := measurementReader(metrics, Filter{}, refresh)
+	c := mqtt.NewClient(mqtt.NewClientOptions())
+
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/events", PayloadBytes: []byte(`{"time":"2023-02-23 11:22:24","model":"Fineoffset-WHx080","id":240,"battery_ok":1,"temperature_C":20.8,"wind_avg_km_h":1.224,"rain_mm":70.2}`)})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/events", PayloadBytes: []byte(`{"time":"2023-02-23 11:22:25","model":"Fineoffset-WH51","id":"0d1b3c","battery_ok":0.9,"moisture":42,"boost":0}`)})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/devices/Inkbird-ITH20R/1/84/temperature_F", PayloadBytes: []byte("79.7")})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/devices/Inkbird-ITH20R/1/84/time", PayloadBytes: []byte("2023-02-23 11:22:26")})
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	expected := []string{
+		`rtl433_battery_ok{channel="",id="240",model="Fineoffset-WHx080"} 1`,
+		`rtl433_temperature_celsius{channel="",id="240",model="Fineoffset-WHx080"} 20.8`,
+		`rtl433_wind_avg_kilometers_per_hour{channel="",id="240",model="Fineoffset-WHx080"} 1.224`,
+		`rtl433_rain_millimetres{channel="",id="240",model="Fineoffset-WHx080"} 70.2`,
+		`garden_soil_moisture_percentage{channel="",id="0d1b3c",model="Fineoffset-WH51"} 42`,
+		`rtl433_boost{channel="",id="0d1b3c",model="Fineoffset-WH51"} 0`,
+		`rtl433_temperature_fahrenheit{channel="1",id="84",model="Inkbird-ITH20R"} 79.7`,
+		`# HELP rtl433_boost The boost field decoded by rtl_433.`,
+	}
+	for _, e := range expected {
+		assert.Contains(string(body), e)
+	}
+	assert.NotContains(string(body), "rtl433_time")
+	assert.NotContains(string(body), "rtl433_id")
+}
+
+func TestPresetMetricNames(t *testing.T) {
+	assert := assert.New(t)
+
+	generic := Presets["generic"]
+	misol, err := NewPreset("misol", nil, map[string]string{"rain_mm": "rain_gauge_millimetres"})
+	assert.NoError(err)
+
+	testCases := []struct {
+		preset   Preset
+		field    string
+		expected string
+	}{
+		{generic, "temperature_C", "rtl433_temperature_celsius"},
+		{generic, "temperature_1_C", "rtl433_temperature_1_celsius"},
+		{generic, "humidity", "rtl433_humidity_percentage"},
+		{generic, "pressure_hPa", "rtl433_pressure_hectopascals"},
+		{generic, "wind_max_m_s", "rtl433_wind_max_meters_per_second"},
+		{generic, "storm_dist_km", "rtl433_storm_dist_kilometers"},
+		{generic, "uvi", "rtl433_uvi"},
+		{misol, "temperature_C", "outdoor_temperature_celsius"},
+		{misol, "rain_mm", "rain_gauge_millimetres"},
+		{Presets["misol"], "rain_mm", "outdoor_rain_millimetres"},
+		{Presets["misol"], "pressure_hPa", "outdoor_pressure_hectopascals"},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			assert.Equal(tc.expected, tc.preset.MetricName(tc.field))
+		})
+	}
+
+	assert.True(misol.Exports("wind_dir_deg"))
+	assert.True(misol.Exports("pressure_hPa"))
+	assert.False(misol.Exports("moisture"))
+	assert.True(generic.Exports("pressure_hPa"))
+	assert.False(generic.Exports("model"))
+
+	_, err = NewPreset("acurite", nil, nil)
+	assert.Error(err)
+	_, err = parseRename("rain_mm")
+	assert.Error(err)
+	rename, err := parseRename("rain_mm=rain_total_millimetres, moisture = soil_moisture_percentage")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"rain_mm": "rain_total_millimetres", "moisture": "soil_moisture_percentage"}, rename)
+}
+
+func TestRainTrackerHandlesResets(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2024, 1, 21, 22, 30, 0, 0, time.Local)
+	r := &rainTracker{}
+	testCases := []struct {
+		offset   time.Duration
+		reported float64
+		delta    float64
+		total    float64
+	}{
+		{0, 70.2, 0, 0},                    // first observation: nothing counted yet
+		{5 * time.Minute, 70.2, 0, 0},      // no rain
+		{10 * time.Minute, 70.5, 0.3, 0.3}, // rain
+		{15 * time.Minute, 71.1, 0.6, 0.9}, // more rain
+		{20 * time.Minute, 0, 0, 0.9},      // batteries changed
+		{25 * time.Minute, 0.3, 0.3, 1.2},  // rain after the reset
+		{90 * time.Minute, 1.5, 1.2, 2.4},  // rain after midnight
+		{95 * time.Minute, 1.5, 0, 2.4},    // no rain
+		{100 * time.Minute, 0.6, 0.6, 3.0}, // reset, and rain since
+	}
+	for _, tc := range testCases {
+		delta := r.observe(start.Add(tc.offset), tc.reported)
+		assert.InDelta(tc.delta, delta, 0.0001)
+		assert.InDelta(tc.total, r.total, 0.0001)
+	}
+
+	now := start.Add(100 * time.Minute) // 00:10
+	assert.InDelta(1.8, r.lastHour(now), 0.0001)
+	assert.InDelta(0.6, r.sinceMidnight(now), 0.0001) // the 00:00 observation is the baseline
+	assert.InDelta(3.6, r.rate(now), 0.0001)          // 0.6mm in the last 10 minutes
+}
+
+func TestRainIsExportedAsCounter(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, Presets["misol"])
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+
+	d := Device{Model: "Fineoffset-WHx080", ID: "240"}
+	now := time.Now()
+	metrics.observeRain(d, 70.25, now.Add(-2*time.Minute))
+	metrics.observeRain(d, 70.75, now.Add(-time.Minute))
+	metrics.observeRain(d, 0.25, now)
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	labels := `{channel="",id="240",model="Fineoffset-WHx080"}`
+	assert.Contains(string(body), "# TYPE outdoor_rain_millimetres_total counter")
+	assert.Contains(string(body), "outdoor_rain_millimetres_total"+labels+" 0.75")
+	assert.Contains(string(body), "outdoor_rain_last_hour_millimetres"+labels+" 0.75")
+	assert.Contains(string(body), "outdoor_rain_rate_millimetres_per_hour"+labels+" 4.5")
+	assert.Contains(string(body), "outdoor_rain_since_midnight_millimetres"+labels)
+}
+
+func TestWindTrackerStatistics(t *testing.T) {
+	assert := assert.New(t)
+
+	start := time.Date(2024, 1, 21, 12, 0, 0, 0, time.Local)
+	w := &windTracker{}
+	assert.True(math.IsNaN(w.maxGust()))
+	assert.True(math.IsNaN(w.meanDirection()))
+
+	// a 60 km/h gust, 15 minutes ago, falls out of the window
+	w.observeGust(start, 60)
+	testCases := []struct {
+		offset    time.Duration
+		speed     float64
+		gust      float64
+		direction float64
+	}{
+		{15 * time.Minute, 10, 20, 350},
+		{16 * time.Minute, 20, 45, 10},
+		{17 * time.Minute, 10, 15, 20},
+		{18 * time.Minute, 0, 0, 180}, // calm, so its direction shouldn't count
+	}
+	for _, tc := range testCases {
+		now := start.Add(tc.offset)
+		w.observeSpeed(now, tc.speed)
+		w.observeGust(now, tc.gust)
+		w.observeDirection(now, tc.direction)
+	}
+
+	assert.Equal(45.0, w.maxGust())
+	assert.Equal(10.0, w.meanSpeed())
+	assert.InDelta(7.54, w.meanDirection(), 0.01)
+
+	// all calm: directions are weighted equally
+	calm := &windTracker{}
+	calm.observeDirection(start, 350)
+	calm.observeDirection(start, 20)
+	assert.InDelta(5.0, calm.meanDirection(), 0.01)
+}
+
+func TestCompassPoints(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		deg      float64
+		expected string
+	}{
+		{0, "N"}, {11, "N"}, {12, "NNE"}, {45, "NE"}, {90, "E"}, {135, "SE"},
+		{180, "S"}, {225, "SW"}, {270, "W"}, {315, "NW"}, {349, "N"}, {360, "N"},
+	}
+	for _, tc := range testCases {
+		assert.Equal(tc.expected, compassPoint(tc.deg), "%f", tc.deg)
+	}
+}
+
+func TestWindStatisticsAreExported(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, Presets["misol"])
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	readMeasurement := measurementReader(metrics, Filter{}, refresh)
+	c := mqtt.NewClient(mqtt.NewClientOptions())
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/events", PayloadBytes: []byte(`{"model":"Fineoffset-WHx080","id":240,"wind_avg_km_h":12.5,"wind_max_km_h":30,"wind_dir_deg":90}`)})
+	readMeasurement(c, TestMsg{TopicString: "sensors/rtl_433/events", PayloadBytes: []byte(`{"model":"Fineoffset-WHx080","id":240,"wind_avg_km_h":7.5,"wind_max_km_h":10,"wind_dir_deg":90}`)})
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	labels := `{channel="",id="240",model="Fineoffset-WHx080"}`
+	assert.Contains(string(body), "outdoor_wind_speed_burst_kilometers_per_hour"+labels+" 10")
+	assert.Contains(string(body), "outdoor_wind_gust_max_10m_kilometers_per_hour"+labels+" 30")
+	assert.Contains(string(body), "outdoor_wind_speed_mean_10m_kilometers_per_hour"+labels+" 10")
+	assert.Contains(string(body), "outdoor_wind_direction_mean_10m_degrees"+labels+" 90")
+	assert.Contains(string(body), `outdoor_wind_rose_kilometers_per_hour_count{channel="",direction="E",id="240",model="Fineoffset-WHx080"} 2`)
+}
+
+func TestWindRosePairsDirectionWithSpeed(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, Presets["misol"])
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	// per-field topics, with speed and direction arriving in either order, and changing between transmissions
+	readMeasurement := measurementReader(metrics, Filter{}, refresh)
+	c := mqtt.NewClient(mqtt.NewClientOptions())
+	topic := "sensors/rtl_433/devices/Fineoffset-WHx080/240/"
+	for _, msg := range [][2]string{
+		{"wind_dir_deg", "90"}, {"wind_avg_km_h", "12.5"},
+		{"wind_avg_km_h", "3"}, {"wind_dir_deg", "180"},
+		{"wind_dir_deg", "270"}, {"wind_avg_km_h", "20"},
+	} {
+		readMeasurement(c, TestMsg{TopicString: topic + msg[0], PayloadBytes: []byte(msg[1])})
+	}
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	rose := func(direction string) string {
+		return `{channel="",direction="` + direction + `",id="240",model="Fineoffset-WHx080"}`
+	}
+	assert.Contains(string(body), "outdoor_wind_rose_kilometers_per_hour_sum"+rose("E")+" 12.5")
+	assert.Contains(string(body), "outdoor_wind_rose_kilometers_per_hour_count"+rose("E")+" 1")
+	assert.Contains(string(body), "outdoor_wind_rose_kilometers_per_hour_sum"+rose("S")+" 3")
+	assert.Contains(string(body), "outdoor_wind_rose_kilometers_per_hour_count"+rose("S")+" 1")
+	assert.Contains(string(body), "outdoor_wind_rose_kilometers_per_hour_sum"+rose("W")+" 20")
+	assert.Contains(string(body), "outdoor_wind_rose_kilometers_per_hour_count"+rose("W")+" 1")
+
+	// a direction whose speed arrives too late to be from the same transmission isn't paired with it
+	w := &windTracker{}
+	start := time.Date(2024, 1, 21, 12, 0, 0, 0, time.Local)
+	_, paired := w.observeSpeed(start, 10)
+	assert.False(paired)
+	_, paired = w.observeDirection(start.Add(48*time.Second), 90)
+	assert.False(paired)
+	_, paired = w.observeSpeed(start.Add(96*time.Second), 5)
+	assert.False(paired)
+	assert.Equal(0.0, w.directions[0].speed)
+}
+
 func TestTTLExpiry(t *testing.T) {
 	assert := assert.New(t)
 
 	// setup
 	reg := prometheus.NewRegistry()
-	metrics := NewMetrics(reg)
+	metrics := NewMetrics(reg, Presets["misol"])
 	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
 	defer ts.Close()
 
@@ -97,21 +425,169 @@ func TestTTLExpiry(t *testing.T) {
 
 	body, err := io.ReadAll(resp.Body)
 	assert.NoError(err)
-	assert.Contains(string(body), "outdoor_rain_millimetres 0")
+	assert.NotContains(string(body), "outdoor_rain_millimetres")
+
+	// receive measurements
+	metrics.set(Device{Model: "Fineoffset-WHx080", ID: "240"}, "rain_mm", 3.5)
+	metrics.set(Device{Model: "Fineoffset-WHx080", ID: "240"}, "temperature_C", 21.5)
+	resp, err = http.Get(ts.URL)
+	assert.NoError(err)
+	body, err = io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Contains(string(body), `outdoor_rain_millimetres{channel="",id="240",model="Fineoffset-WHx080"} 3.5`)
 
-	// setup the TTL checker
+	// setup the TTL checker, with a longer TTL on temperature
 	refresh := make(chan time.Time, 1000)
-	ttl := time.Nanosecond * 2
-	exit := time.Second * 10
-	go nilIfTTLExpired(metrics, refresh, ttl, exit)
+	ttls := exporter.TTLs{Default: time.Nanosecond * 2, Fields: map[string]time.Duration{"temperature_C": time.Hour}}
+	health := exporter.NewHealth(reg, "outdoor_exporter_healthy", time.Second*10)
+	go exporter.Watch(metrics.gauges, refresh, ttls, health, false)
 
 	// wait
 	time.Sleep(time.Millisecond * 1200)
 
-	// then check the TTL has expired
+	// then check the TTL has expired on rain only
 	resp, err = http.Get(ts.URL)
 	assert.NoError(err)
 	body, err = io.ReadAll(resp.Body)
 	assert.NoError(err)
-	assert.Contains(string(body), "outdoor_rain_millimetres NaN")
+	assert.Contains(string(body), `outdoor_rain_millimetres{channel="",id="240",model="Fineoffset-WHx080"} NaN`)
+	assert.Contains(string(body), `outdoor_rain_last_hour_millimetres{channel="",id="240",model="Fineoffset-WHx080"} NaN`)
+	assert.Contains(string(body), `outdoor_temperature_celsius{channel="",id="240",model="Fineoffset-WHx080"} 21.5`)
+	assert.Contains(string(body), `outdoor_rain_millimetres_last_seen_timestamp_seconds{channel="",id="240",model="Fineoffset-WHx080"} 1.`)
+	assert.Contains(string(body), "outdoor_exporter_healthy 1")
+}
+
+func TestReplayCapture(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, Presets["misol"])
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	// replay traffic recorded with -record
+	f, err := os.Open(filepath.Join("testdata", "rtl_433_capture.jsonl"))
+	assert.NoError(err)
+	defer f.Close()
+	filter := Filter{Models: []string{"Fineoffset-WHx080"}}
+	n, err := exporter.Replay(f, measurementReader(metrics, filter, refresh), 0)
+	assert.NoError(err)
+	assert.Equal(7, n)
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	labels := `{channel="",id="240",model="Fineoffset-WHx080"}`
+	assert.Contains(string(body), "outdoor_temperature_celsius"+labels+" 20.9")
+	assert.Contains(string(body), "outdoor_humidity_percentage"+labels+" 67")
+	assert.Contains(string(body), "outdoor_rain_millimetres"+labels+" 70.5")
+	assert.NotContains(string(body), "Nexus-TH")
+	assert.Len(refresh, 6)
+}
+
+func TestEventReaderUpdatesFieldsTogether(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg, Presets["misol"])
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	// rtl_433 -F json output, with a log line, an event that isn't from a device, and a sensor with a barometer
+	output := `rtl_433 version 23.11 inputs file rtl_tcp RTL-SDR
+{"time":"2024-01-21 11:22:24","model":"Fineoffset-WHx080","subtype":0,"id":240,"battery_ok":1,"temperature_C":20.8,"humidity":68,"rain_mm":70.2,"mic":"CRC"}
+{"time":"2024-01-21 11:22:25","src":"SDR","lvl":5,"msg":"Tuned to 433.920MHz."}
+{"time":"2024-01-21 11:22:26","model":"Fineoffset-WHx080","subtype":0,"id":240,"battery_ok":1,"temperature_C":20.9,"humidity":67,"rain_mm":70.5,"mic":"CRC"}
+{"time":"2024-01-21 11:22:31","model":"Fineoffset-WH32B","id":146,"battery_ok":1,"temperature_C":22.1,"humidity":48,"pressure_hPa":1009.6,"mic":"CRC"}
+`
+	assert.NoError(readEvents(strings.NewReader(output), eventReader(metrics, Filter{}, refresh)))
+	assert.Len(refresh, 3)
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	labels := `{channel="",id="240",model="Fineoffset-WHx080"}`
+	assert.Contains(string(body), "outdoor_temperature_celsius"+labels+" 20.9")
+	assert.Contains(string(body), "outdoor_humidity_percentage"+labels+" 67")
+	assert.Contains(string(body), "outdoor_rain_millimetres"+labels+" 70.5")
+	assert.Contains(string(body), `outdoor_pressure_hectopascals{channel="",id="146",model="Fineoffset-WH32B"} 1009.6`)
+	assert.NotContains(string(body), `outdoor_pressure_hectopascals`+labels)
+	assert.NotContains(string(body), `model=""`)
+}
+
+func TestEventReaderPairsWindInOneEvent(t *testing.T) {
+	assert := assert.New(t)
+
+	// fields are applied in the same order every time, however the event is decoded
+	for i := 0; i < 20; i++ {
+		reg := prometheus.NewRegistry()
+		metrics := NewMetrics(reg, Presets["misol"])
+		refresh := make(chan time.Time, 1)
+		readEvent := eventReader(metrics, Filter{}, refresh)
+		readEvent([]byte(`{"model":"Fineoffset-WHx080","id":240,"wind_dir_deg":180,"wind_avg_km_h":15,"wind_max_km_h":20}`))
+
+		ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+		resp, err := http.Get(ts.URL)
+		assert.NoError(err)
+		body, err := io.ReadAll(resp.Body)
+		assert.NoError(err)
+		ts.Close()
+
+		rose := `{channel="",direction="S",id="240",model="Fineoffset-WHx080"}`
+		assert.Contains(string(body), "outdoor_wind_rose_kilometers_per_hour_sum"+rose+" 15")
+		assert.Contains(string(body), "outdoor_wind_rose_kilometers_per_hour_count"+rose+" 1")
+	}
+}
+
+func TestReadStream(t *testing.T) {
+	assert := assert.New(t)
+
+	event := `{"time":"2024-01-21 11:22:24","model":"Fineoffset-WHx080","id":240,"temperature_C":20.8}`
+	upgrader := websocket.Upgrader{}
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintln(w, event)
+		fmt.Fprintln(w, event)
+	})
+	mux.HandleFunc("/stream", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		fmt.Fprintf(w, "data: %s\n\n", event)
+	})
+	mux.HandleFunc("/ws", func(w http.ResponseWriter, r *http.Request) {
+		conn, err := upgrader.Upgrade(w, r, nil)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(event)))
+		assert.NoError(conn.WriteMessage(websocket.TextMessage, []byte(`{"src":"SDR","lvl":5,"msg":"Tuned to 433.920MHz."}`)))
+	})
+	ts := httptest.NewServer(mux)
+	defer ts.Close()
+
+	testCases := []struct {
+		url    string
+		events int
+	}{
+		{ts.URL + "/events", 2},
+		{ts.URL + "/stream", 1},
+		{"ws" + strings.TrimPrefix(ts.URL, "http") + "/ws", 2},
+	}
+	for _, tc := range testCases {
+		t.Run(tc.url, func(t *testing.T) {
+			var events []string
+			err := readStream(tc.url, func(e []byte) { events = append(events, string(e)) })
+			assert.Error(err, "the stream ending is an error")
+			assert.Len(events, tc.events)
+			assert.Equal(event, events[0])
+		})
+	}
 }
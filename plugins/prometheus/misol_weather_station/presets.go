@@ -0,0 +1,169 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Preset configures which rtl_433 fields are exported, and the metric names they're exported as
+type Preset struct {
+	// Namespace prefixes the names of metrics that aren't renamed
+	Namespace string
+	// Fields is an allowlist of fields to export. Every numeric field is exported if empty.
+	Fields []string
+	// Rename maps a field to the metric name it's exported as
+	Rename map[string]string
+	// Help maps a field to the help text of its metric
+	Help map[string]string
+}
+
+// Presets are the named presets that can be selected with -preset
+var Presets = map[string]Preset{
+	// misol keeps the metric names used by earlier versions of this exporter
+	"misol": {
+		Namespace: "outdoor",
+		Fields:    []string{"battery_ok", "temperature_C", "humidity", "wind_dir_deg", "wind_avg_km_h", "wind_max_km_h", "rain_mm", "pressure_hPa"},
+		Rename: map[string]string{
+			"battery_ok":    "outdoor_battery",
+			"temperature_C": "outdoor_temperature_celsius",
+			"humidity":      "outdoor_humidity_percentage",
+			"wind_dir_deg":  "outdoor_wind_direction_degree",
+			"wind_avg_km_h": "outdoor_wind_speed_average_kilometers_per_hour",
+			"wind_max_km_h": "outdoor_wind_speed_burst_kilometers_per_hour",
+			"rain_mm":       "outdoor_rain_millimetres",
+			"pressure_hPa":  "outdoor_pressure_hectopascals",
+		},
+		Help: map[string]string{
+			"battery_ok":    "Current battery status of weather station.",
+			"temperature_C": "Current temperature outside of house.",
+			"humidity":      "Relative humidity outside of house.",
+			"wind_dir_deg":  "Direction of wind in degrees.",
+			"wind_avg_km_h": "Average wind speed in kilometers per hour.",
+			"wind_max_km_h": "Max burst wind speed in kilometers per hour.",
+			"rain_mm":       "Rainfall in millimeters",
+			"pressure_hPa":  "Barometric pressure at the station (not corrected to sea level) in hectopascals.",
+		},
+	},
+	// generic exports every numeric field from every device
+	"generic": {
+		Namespace: "rtl433",
+	},
+}
+
+// metadataFields are fields rtl_433 uses to describe a device or transmission, rather than a measurement
+var metadataFields = map[string]bool{
+	"time":     true,
+	"model":    true,
+	"id":       true,
+	"channel":  true,
+	"subtype":  true,
+	"type":     true,
+	"mic":      true,
+	"mod":      true,
+	"protocol": true,
+}
+
+// unitSuffixes maps rtl_433 field name suffixes to Prometheus units, longest suffixes first
+var unitSuffixes = []struct {
+	suffix string
+	unit   string
+}{
+	{"_km_h", "kilometers_per_hour"},
+	{"_mi_h", "miles_per_hour"},
+	{"_inHg", "inches_of_mercury"},
+	{"_m_s", "meters_per_second"},
+	{"_hPa", "hectopascals"},
+	{"_kPa", "kilopascals"},
+	{"_PSI", "psi"},
+	{"_lux", "lux"},
+	{"_deg", "degrees"},
+	{"_mm", "millimetres"},
+	{"_in", "inches"},
+	{"_km", "kilometers"},
+	{"_dB", "decibels"},
+	{"_C", "celsius"},
+	{"_F", "fahrenheit"},
+	{"_V", "volts"},
+}
+
+// unitlessFields maps rtl_433 fields without a unit suffix to a Prometheus unit
+var unitlessFields = map[string]string{
+	"humidity": "percentage",
+	"moisture": "percentage",
+}
+
+var invalidMetricChars = regexp.MustCompile(`[^a-zA-Z0-9_]`)
+
+// Exports checks if a field is exported by the preset
+func (p Preset) Exports(field string) bool {
+	if metadataFields[field] {
+		return false
+	}
+	return allowed(p.Fields, field)
+}
+
+// MetricName returns the metric name a field is exported as
+func (p Preset) MetricName(field string) string {
+	if name, ok := p.Rename[field]; ok {
+		return name
+	}
+
+	base, unit := field, unitlessFields[field]
+	for _, u := range unitSuffixes {
+		if strings.HasSuffix(field, u.suffix) && len(field) > len(u.suffix) {
+			base, unit = strings.TrimSuffix(field, u.suffix), u.unit
+			break
+		}
+	}
+
+	name := strings.ToLower(invalidMetricChars.ReplaceAllString(base, "_"))
+	if len(p.Namespace) > 0 {
+		name = p.Namespace + "_" + name
+	}
+	if len(unit) > 0 {
+		name += "_" + unit
+	}
+	return name
+}
+
+// MetricHelp returns the help text for the metric a field is exported as
+func (p Preset) MetricHelp(field string) string {
+	if help, ok := p.Help[field]; ok {
+		return help
+	}
+	return fmt.Sprintf("The %s field decoded by rtl_433.", field)
+}
+
+// parseRename parses a comma separated list of field=metric_name pairs
+func parseRename(s string) (map[string]string, error) {
+	rename := map[string]string{}
+	for _, pair := range splitList(s) {
+		field, name, ok := strings.Cut(pair, "=")
+		if !ok || len(field) == 0 || len(name) == 0 {
+			return nil, fmt.Errorf("bad rename %q: expected field=metric_name", pair)
+		}
+		rename[strings.TrimSpace(field)] = strings.TrimSpace(name)
+	}
+	return rename, nil
+}
+
+// NewPreset looks up a preset by name, and applies a field allowlist and renames over it
+func NewPreset(name string, fields []string, rename map[string]string) (Preset, error) {
+	base, ok := Presets[name]
+	if !ok {
+		return base, fmt.Errorf("unknown preset %q", name)
+	}
+
+	p := Preset{Namespace: base.Namespace, Fields: base.Fields, Rename: map[string]string{}, Help: base.Help}
+	if len(fields) > 0 {
+		p.Fields = fields
+	}
+	for k, v := range base.Rename {
+		p.Rename[k] = v
+	}
+	for k, v := range rename {
+		p.Rename[k] = v
+	}
+	return p, nil
+}
@@ -0,0 +1,81 @@
+package main
+
+import (
+	"time"
+)
+
+// rainRateWindow is the window rain rate is measured over, before scaling to mm/h
+const rainRateWindow = 10 * time.Minute
+
+// rainSample is the rain counter at a point in time
+type rainSample struct {
+	t     time.Time
+	total float64
+}
+
+// rainTracker turns a station's cumulative rain total into a counter, and derives recent rainfall from it.
+//
+// The station's total resets to 0 when its batteries are changed. Any decrease is treated as a reset, and
+// the new total is counted as rain that fell since the reset, so the counter only ever goes up.
+type rainTracker struct {
+	started bool
+	last    float64
+	total   float64
+	history []rainSample
+}
+
+// observe records a cumulative total reported by the station, and returns how much the counter went up by
+func (r *rainTracker) observe(t time.Time, v float64) float64 {
+	var delta float64
+	switch {
+	case !r.started: // we don't know how much rain fell before we started
+		r.started = true
+	case v < r.last: // reset
+		delta = v
+	default:
+		delta = v - r.last
+	}
+	r.last = v
+	r.total += delta
+	r.history = append(r.history, rainSample{t, r.total})
+
+	// keep enough history for since midnight, and the window before it
+	cutoff := t.Add(-25 * time.Hour)
+	for len(r.history) > 1 && r.history[1].t.Before(cutoff) {
+		r.history = r.history[1:]
+	}
+	return delta
+}
+
+// since returns how much rain fell between t and the latest observation.
+//
+// If there's no observation at or before t, rain is counted from the oldest observation.
+func (r *rainTracker) since(t time.Time) float64 {
+	if len(r.history) == 0 {
+		return 0
+	}
+	base := r.history[0].total
+	for _, s := range r.history {
+		if s.t.After(t) {
+			break
+		}
+		base = s.total
+	}
+	return r.total - base
+}
+
+// lastHour returns how much rain fell in the hour before now
+func (r *rainTracker) lastHour(now time.Time) float64 {
+	return r.since(now.Add(-time.Hour))
+}
+
+// sinceMidnight returns how much rain fell since local midnight
+func (r *rainTracker) sinceMidnight(now time.Time) float64 {
+	y, m, d := now.Date()
+	return r.since(time.Date(y, m, d, 0, 0, 0, 0, now.Location()))
+}
+
+// rate returns the current rain rate in mm/h, measured over the rain rate window
+func (r *rainTracker) rate(now time.Time) float64 {
+	return r.since(now.Add(-rainRateWindow)) * float64(time.Hour/rainRateWindow)
+}
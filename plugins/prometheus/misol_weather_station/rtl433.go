@@ -0,0 +1,111 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
+	"github.com/gorilla/websocket"
+)
+
+// readInput reads rtl_433 events from stdin, a file or pipe, or rtl_433's HTTP server, and passes each to handle
+func readInput(input string, handle func([]byte)) error {
+	switch {
+	case input == "-":
+		log.Println("Reading rtl_433 events from stdin")
+		if err := readEvents(os.Stdin, handle); err != nil {
+			return err
+		}
+		return errors.New("end of rtl_433 events on stdin")
+	case strings.HasPrefix(input, "http://"), strings.HasPrefix(input, "https://"),
+		strings.HasPrefix(input, "ws://"), strings.HasPrefix(input, "wss://"):
+		streamEvents(input, handle)
+		return nil
+	default:
+		log.Printf("Reading rtl_433 events from %s\n", input)
+		f, err := os.Open(input)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		if err := readEvents(f, handle); err != nil {
+			return err
+		}
+		return fmt.Errorf("end of rtl_433 events in %s", input)
+	}
+}
+
+// readEvents passes each JSON event in r to handle, one per line. Lines that aren't events, like the
+// log messages and `data:` prefixes in rtl_433's HTTP streams, are skipped.
+func readEvents(r io.Reader, handle func([]byte)) error {
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		line := bytes.TrimSpace(scanner.Bytes())
+		line = bytes.TrimSpace(bytes.TrimPrefix(line, []byte("data:")))
+		if !bytes.HasPrefix(line, []byte("{")) {
+			continue
+		}
+		handle(line)
+	}
+	return scanner.Err()
+}
+
+// streamEvents reads events from rtl_433's HTTP server forever, reconnecting with backoff when the stream ends
+func streamEvents(url string, handle func([]byte)) {
+	backoff := exporter.Backoff{Min: time.Second, Max: 2 * time.Minute}
+	for {
+		var received bool
+		err := readStream(url, func(event []byte) {
+			received = true
+			handle(event)
+		})
+		if received {
+			backoff.Reset()
+		}
+		delay := backoff.Next()
+		fmt.Printf("error: lost rtl_433 event stream, reconnecting in %s: %s\n", delay, err)
+		time.Sleep(delay)
+	}
+}
+
+// readStream reads events from a single connection to rtl_433's HTTP (or WebSocket) event stream
+func readStream(url string, handle func([]byte)) error {
+	log.Printf("Reading rtl_433 events from %s\n", url)
+	if strings.HasPrefix(url, "ws://") || strings.HasPrefix(url, "wss://") {
+		conn, _, err := websocket.DefaultDialer.Dial(url, nil)
+		if err != nil {
+			return err
+		}
+		defer conn.Close()
+		for {
+			_, msg, err := conn.ReadMessage()
+			if err != nil {
+				return err
+			}
+			if err := readEvents(bytes.NewReader(msg), handle); err != nil {
+				return err
+			}
+		}
+	}
+
+	resp, err := http.Get(url)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+	if err := readEvents(resp.Body, handle); err != nil {
+		return err
+	}
+	return io.EOF
+}
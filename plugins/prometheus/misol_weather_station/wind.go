@@ -0,0 +1,144 @@
+package main
+
+import (
+	"math"
+	"time"
+)
+
+// windWindow is the rolling window wind statistics are calculated over
+const windWindow = 10 * time.Minute
+
+// compassPoints are the 16 wind rose directions, clockwise from north
+var compassPoints = []string{"N", "NNE", "NE", "ENE", "E", "ESE", "SE", "SSE", "S", "SSW", "SW", "WSW", "W", "WNW", "NW", "NNW"}
+
+// pairWindow is how close together the speed and direction of one transmission arrive. Stations transmit
+// every 16 to 48 seconds, and rtl_433 publishes every field of a transmission at once.
+const pairWindow = 5 * time.Second
+
+// windSample is a wind measurement at a point in time
+type windSample struct {
+	t     time.Time
+	value float64
+	speed float64 // average speed from the same transmission as a direction, used to weight it
+}
+
+// windTracker keeps a rolling window of wind measurements, so gusts shorter than the scrape interval aren't lost.
+//
+// Speed, gust, and direction arrive as separate measurements, in no particular order, so a direction is paired
+// with the speed from the same transmission, whichever arrives first.
+type windTracker struct {
+	speeds     []windSample
+	gusts      []windSample
+	directions []windSample
+	// unpairedSpeed is the latest speed, until a direction is paired with it
+	unpairedSpeed *windSample
+	// pendingDirection is set while the latest direction is waiting for its speed
+	pendingDirection bool
+}
+
+// observeSpeed records an average wind speed. If it pairs with a direction waiting for its speed, that
+// direction is returned.
+func (w *windTracker) observeSpeed(t time.Time, v float64) (float64, bool) {
+	s := windSample{t: t, value: v}
+	w.speeds = prune(append(w.speeds, s), t)
+	if last := len(w.directions) - 1; w.pendingDirection && last >= 0 && t.Sub(w.directions[last].t) <= pairWindow {
+		w.pendingDirection = false
+		w.unpairedSpeed = nil
+		w.directions[last].speed = v
+		return w.directions[last].value, true
+	}
+	w.pendingDirection = false
+	w.unpairedSpeed = &s
+	return 0, false
+}
+
+// observeGust records a wind gust
+func (w *windTracker) observeGust(t time.Time, v float64) {
+	w.gusts = prune(append(w.gusts, windSample{t: t, value: v}), t)
+}
+
+// observeDirection records a wind direction in degrees, weighted by the speed from the same transmission. If
+// that speed has already arrived, it's returned.
+func (w *windTracker) observeDirection(t time.Time, v float64) (float64, bool) {
+	s := windSample{t: t, value: v}
+	paired := w.unpairedSpeed != nil && t.Sub(w.unpairedSpeed.t) <= pairWindow
+	if paired {
+		s.speed = w.unpairedSpeed.value
+	}
+	w.unpairedSpeed = nil
+	w.pendingDirection = !paired
+	w.directions = prune(append(w.directions, s), t)
+	return s.speed, paired
+}
+
+// prune drops samples that have fallen out of the window ending at now
+func prune(samples []windSample, now time.Time) []windSample {
+	cutoff := now.Add(-windWindow)
+	for len(samples) > 0 && samples[0].t.Before(cutoff) {
+		samples = samples[1:]
+	}
+	return samples
+}
+
+// maxGust returns the highest gust in the window
+func (w *windTracker) maxGust() float64 {
+	if len(w.gusts) == 0 {
+		return math.NaN()
+	}
+	max := w.gusts[0].value
+	for _, s := range w.gusts[1:] {
+		max = math.Max(max, s.value)
+	}
+	return max
+}
+
+// meanSpeed returns the mean average speed in the window
+func (w *windTracker) meanSpeed() float64 {
+	if len(w.speeds) == 0 {
+		return math.NaN()
+	}
+	var sum float64
+	for _, s := range w.speeds {
+		sum += s.value
+	}
+	return sum / float64(len(w.speeds))
+}
+
+// meanDirection returns the vector average of wind directions in the window, in degrees.
+//
+// Directions are summed as vectors weighted by wind speed, so 350° and 10° average to 0° rather than 180°,
+// and calm readings don't pull the average around. If it's been calm the whole window, every direction
+// is weighted equally.
+func (w *windTracker) meanDirection() float64 {
+	if len(w.directions) == 0 {
+		return math.NaN()
+	}
+	weighted := false
+	for _, s := range w.directions {
+		if s.speed > 0 {
+			weighted = true
+		}
+	}
+
+	var x, y float64
+	for _, s := range w.directions {
+		weight := 1.0
+		if weighted {
+			weight = s.speed
+		}
+		rad := s.value * math.Pi / 180
+		x += weight * math.Sin(rad)
+		y += weight * math.Cos(rad)
+	}
+	if x == 0 && y == 0 {
+		return math.NaN() // directions cancel out
+	}
+	deg := math.Atan2(x, y) * 180 / math.Pi
+	return math.Mod(deg+360, 360)
+}
+
+// compassPoint returns the wind rose direction a bearing in degrees falls in
+func compassPoint(deg float64) string {
+	i := int(math.Floor(math.Mod(deg+360, 360)/22.5+0.5)) % len(compassPoints)
+	return compassPoints[i]
+}
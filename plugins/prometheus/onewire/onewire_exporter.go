@@ -0,0 +1,317 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// temperatureFamilies are the 1-Wire family codes of temperature sensors: DS18S20, DS1822, DS18B20 and MAX31850
+var temperatureFamilies = []string{"10", "22", "28", "3b"}
+
+// powerOnReset is the first two bytes of each family's scratchpad when it hasn't converted a temperature since
+// it powered on, which reads as 85°C. The MAX31850 has no such value.
+var powerOnReset = map[string][2]byte{
+	"10": {0xaa, 0x00},
+	"22": {0x50, 0x05},
+	"28": {0x50, 0x05},
+}
+
+// Errors reading a sensor
+var (
+	ErrCRC          = errors.New("CRC check failed")
+	ErrPowerOnReset = errors.New("sensor returned its power-on reset value")
+)
+
+// Sensor is a 1-Wire temperature sensor, with the directory the w1 kernel module exposes it in
+type Sensor struct {
+	ID   string
+	Path string
+}
+
+// Family returns the sensor's 1-Wire family code, the start of its ID
+func (s Sensor) Family() string {
+	family, _, _ := strings.Cut(s.ID, "-")
+	return family
+}
+
+// labels returns the sensor's metric labels, with its friendly name, or its ID if it has none
+func (s Sensor) labels(names map[string]string) prometheus.Labels {
+	name, ok := names[s.ID]
+	if !ok {
+		name = s.ID
+	}
+	return prometheus.Labels{"sensor": s.ID, "name": name}
+}
+
+// findSensors lists the temperature sensors in root, like /sys/bus/w1/devices
+func findSensors(root string) ([]Sensor, error) {
+	var sensors []Sensor
+	for _, family := range temperatureFamilies {
+		paths, err := filepath.Glob(filepath.Join(root, family+"-*", "w1_slave"))
+		if err != nil {
+			return nil, err
+		}
+		for _, p := range paths {
+			dir := filepath.Dir(p)
+			sensors = append(sensors, Sensor{ID: filepath.Base(dir), Path: dir})
+		}
+	}
+	sort.Slice(sensors, func(i, j int) bool { return sensors[i].ID < sensors[j].ID })
+	return sensors, nil
+}
+
+// crc8 calculates the Dallas/Maxim 1-Wire CRC of data
+func crc8(data []byte) byte {
+	var crc byte
+	for _, b := range data {
+		for i := 0; i < 8; i++ {
+			mix := (crc ^ b) & 0x01
+			crc >>= 1
+			if mix != 0 {
+				crc ^= 0x8c
+			}
+			b >>= 1
+		}
+	}
+	return crc
+}
+
+// parseW1Slave reads the temperature in degrees celsius from the contents of a w1_slave file of a sensor in
+// family, like:
+//
+//	72 01 4b 46 7f ff 0e 10 57 : crc=57 YES
+//	72 01 4b 46 7f ff 0e 10 57 t=23125
+func parseW1Slave(family string, s string) (float64, error) {
+	lines := strings.Split(strings.TrimSpace(s), "\n")
+	if len(lines) != 2 {
+		return 0, fmt.Errorf("expected 2 lines, got %d", len(lines))
+	}
+
+	// the kernel checks the CRC, and says YES or NO
+	if !strings.HasSuffix(strings.TrimSpace(lines[0]), "YES") {
+		return 0, ErrCRC
+	}
+	before, _, _ := strings.Cut(lines[0], ":")
+	fields := strings.Fields(before)
+	if len(fields) != 9 {
+		return 0, fmt.Errorf("expected 9 bytes of scratchpad, got %d", len(fields))
+	}
+	scratchpad := make([]byte, len(fields))
+	for i, f := range fields {
+		b, err := strconv.ParseUint(f, 16, 8)
+		if err != nil {
+			return 0, fmt.Errorf("bad scratchpad: %w", err)
+		}
+		scratchpad[i] = byte(b)
+	}
+	// and check it ourselves, in case the file is garbled
+	if crc8(scratchpad[:8]) != scratchpad[8] {
+		return 0, ErrCRC
+	}
+	// 85°C is read when a conversion didn't happen, usually because of a power problem
+	if reset, ok := powerOnReset[family]; ok && scratchpad[0] == reset[0] && scratchpad[1] == reset[1] {
+		return 0, ErrPowerOnReset
+	}
+
+	_, t, ok := strings.Cut(lines[1], "t=")
+	if !ok {
+		return 0, errors.New("no temperature")
+	}
+	milli, err := strconv.Atoi(strings.TrimSpace(t))
+	if err != nil {
+		return 0, fmt.Errorf("bad temperature: %w", err)
+	}
+	return float64(milli) / 1000, nil
+}
+
+// Metrics are the readings exported for each sensor
+type Metrics struct {
+	gauges  *exporter.GaugeSet
+	sensors prometheus.Gauge
+	errors  *prometheus.CounterVec
+}
+
+// NewMetrics registers metrics for 1-Wire sensors with reg
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		gauges: exporter.NewGaugeSet(reg, "sensor", "name"),
+		sensors: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "onewire_sensors",
+			Help: "Number of 1-Wire temperature sensors found.",
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "onewire_read_errors_total",
+			Help: "Number of failed reads from a sensor, including CRC failures.",
+		}, []string{"sensor", "name"}),
+	}
+	reg.MustRegister(m.sensors)
+	reg.MustRegister(m.errors)
+	if err := m.gauges.Register("temperature", "onewire_temperature_celsius", "Temperature, in degrees celsius."); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// Reader reads every sensor in a w1 devices directory, finding sensors as they're plugged in
+type Reader struct {
+	Root    string
+	Names   map[string]string
+	metrics *Metrics
+	refresh chan time.Time
+	known   map[string]bool
+}
+
+// NewReader sets up a reader for the sensors in root, labelling them with names
+func NewReader(root string, names map[string]string, metrics *Metrics, refresh chan time.Time) *Reader {
+	return &Reader{Root: root, Names: names, metrics: metrics, refresh: refresh, known: map[string]bool{}}
+}
+
+// ReadAll finds sensors, and reads each of them. Sensors that go away are left to expire.
+func (r *Reader) ReadAll() error {
+	sensors, err := findSensors(r.Root)
+	if err != nil {
+		return err
+	}
+	r.metrics.sensors.Set(float64(len(sensors)))
+
+	present := map[string]bool{}
+	for _, s := range sensors {
+		present[s.ID] = true
+		if !r.known[s.ID] {
+			log.Printf("info: found sensor %s (%s)\n", s.ID, s.labels(r.Names)["name"])
+		}
+		if err := r.Read(s); err != nil {
+			fmt.Printf("error: unable to read sensor %s: %s\n", s.ID, err)
+			r.metrics.errors.With(s.labels(r.Names)).Inc()
+		}
+	}
+	for id := range r.known {
+		if !present[id] {
+			fmt.Printf("warning: sensor %s went away\n", id)
+		}
+	}
+	r.known = present
+	return nil
+}
+
+// Read reads a sensor's temperature, and updates metrics
+func (r *Reader) Read(s Sensor) error {
+	b, err := os.ReadFile(filepath.Join(s.Path, "w1_slave"))
+	if err != nil {
+		return err
+	}
+	t, err := parseW1Slave(s.Family(), string(b))
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	r.metrics.gauges.Set("temperature", s.labels(r.Names), t, now)
+	r.refresh <- now
+	return nil
+}
+
+// parseNames parses comma separated id=name pairs
+func parseNames(s string) (map[string]string, error) {
+	names := map[string]string{}
+	for _, pair := range strings.Split(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if len(pair) == 0 {
+			continue
+		}
+		id, name, ok := strings.Cut(pair, "=")
+		id, name = strings.TrimSpace(id), strings.TrimSpace(name)
+		if !ok || len(id) == 0 || len(name) == 0 {
+			return nil, fmt.Errorf("bad name %q, want <sensor id>=<name>", pair)
+		}
+		names[id] = name
+	}
+	return names, nil
+}
+
+// loadNames reads id=name pairs from a file, one per line. Blank lines and # comments are ignored.
+func loadNames(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	var pairs []string
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line, _, _ := strings.Cut(scanner.Text(), "#")
+		pairs = append(pairs, line)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return parseNames(strings.Join(pairs, ","))
+}
+
+var (
+	opts      exporter.Options
+	root      string
+	nameList  string
+	namesPath string
+	interval  time.Duration
+)
+
+func init() {
+	opts.RegisterServeFlags(flag.CommandLine, ":10004", 5*time.Minute)
+	flag.StringVar(&root, "root", "/sys/bus/w1/devices", "directory the w1 kernel module exposes 1-Wire devices in")
+	flag.StringVar(&nameList, "names", "", "comma separated sensor id=name pairs, like 28-0316a2792bff=office")
+	flag.StringVar(&namesPath, "c", "", "path to a file of sensor id=name pairs, one per line")
+	flag.DurationVar(&interval, "interval", 30*time.Second, "how often to read sensors")
+}
+
+func main() {
+	flag.Parse()
+
+	names := map[string]string{}
+	if len(namesPath) > 0 {
+		fromFile, err := loadNames(namesPath)
+		if err != nil {
+			log.Fatalf("error: %s", err)
+		}
+		names = fromFile
+	}
+	fromFlag, err := parseNames(nameList)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	for id, name := range fromFlag {
+		names[id] = name
+	}
+	e, err := exporter.New("onewire_exporter", "onewire", opts)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+
+	// Create new metrics and register them using the exporter's registry.
+	metrics := NewMetrics(e.Registry)
+
+	// Read sensors, update metrics, and expose them on /metrics
+	reader := NewReader(root, names, metrics, e.Refresh)
+	log.Fatal(e.RunInput(metrics.gauges, func() error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := reader.ReadAll(); err != nil {
+				return err
+			}
+			<-ticker.C
+		}
+	}))
+}
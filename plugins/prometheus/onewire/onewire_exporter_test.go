@@ -0,0 +1,112 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exportertest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+const (
+	w1Good       = "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	w1Negative   = "5e fe 4b 46 7f ff 02 10 8b : crc=8b YES\n5e fe 4b 46 7f ff 02 10 8b t=-26125\n"
+	w1CRCFailed  = "72 01 4b 46 7f ff 0e 10 57 : crc=57 NO\n72 01 4b 46 7f ff 0e 10 57 t=23125\n"
+	w1Garbled    = "72 01 4b 46 7f ff 0e 11 57 : crc=57 YES\n72 01 4b 46 7f ff 0e 11 57 t=23125\n"
+	w1PowerOn    = "50 05 4b 46 7f ff 0c 10 1c : crc=1c YES\n50 05 4b 46 7f ff 0c 10 1c t=85000\n"
+	w1S20PowerOn = "aa 00 4b 46 ff ff 0c 10 87 : crc=87 YES\naa 00 4b 46 ff ff 0c 10 87 t=85000\n"
+	w1MAX31850   = "50 05 ff ff f0 ff ff ff 5c : crc=5c YES\n50 05 ff ff f0 ff ff ff 5c t=85000\n"
+	w1Incomplete = "72 01 4b 46 7f ff 0e 10 57 : crc=57 YES\n"
+)
+
+// helperWriteSensor writes a sensor's w1_slave file into a fake /sys/bus/w1/devices
+func helperWriteSensor(t *testing.T, root string, id string, contents string) {
+	dir := filepath.Join(root, id)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(filepath.Join(dir, "w1_slave"), []byte(contents), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestParseW1Slave(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		family   string
+		contents string
+		expect   float64
+		err      string
+	}{
+		{"28", w1Good, 23.125, ""},
+		{"28", w1Negative, -26.125, ""},
+		{"28", w1CRCFailed, 0, "CRC"},
+		{"28", w1Garbled, 0, "CRC"},
+		{"28", w1PowerOn, 0, "power-on reset"},
+		{"22", w1PowerOn, 0, "power-on reset"},
+		{"10", w1S20PowerOn, 0, "power-on reset"},
+		{"3b", w1MAX31850, 85, ""}, // the MAX31850 has no power-on value, so 85°C is a real reading
+		{"28", w1Incomplete, 0, "expected 2 lines"},
+	}
+	for _, tc := range testCases {
+		v, err := parseW1Slave(tc.family, tc.contents)
+		if len(tc.err) > 0 {
+			assert.ErrorContains(err, tc.err)
+			continue
+		}
+		assert.NoError(err)
+		assert.Equal(tc.expect, v)
+	}
+}
+
+func TestNames(t *testing.T) {
+	assert := assert.New(t)
+
+	names, err := parseNames("28-0316a2792bff=office, 28-0416a1b2c3ff = outside,")
+	assert.NoError(err)
+	assert.Equal(map[string]string{"28-0316a2792bff": "office", "28-0416a1b2c3ff": "outside"}, names)
+	_, err = parseNames("28-0316a2792bff")
+	assert.Error(err)
+
+	path := filepath.Join(t.TempDir(), "names")
+	assert.NoError(os.WriteFile(path, []byte("# sensors in the office\n28-0316a2792bff=office\n\n28-0416a1b2c3ff=outside # under the eaves\n"), 0644))
+	names, err = loadNames(path)
+	assert.NoError(err)
+	assert.Equal(map[string]string{"28-0316a2792bff": "office", "28-0416a1b2c3ff": "outside"}, names)
+}
+
+func TestReadAll(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	root := t.TempDir()
+	helperWriteSensor(t, root, "28-0316a2792bff", w1Good)
+	helperWriteSensor(t, root, "28-0416a1b2c3ff", w1CRCFailed)
+	assert.NoError(os.MkdirAll(filepath.Join(root, "w1_bus_master1"), 0755))
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	refresh := make(chan time.Time, 1000)
+	reader := NewReader(root, map[string]string{"28-0316a2792bff": "office"}, metrics, refresh)
+
+	assert.NoError(reader.ReadAll())
+	assert.Len(refresh, 1)
+	body := exportertest.Scrape(t, reg)
+	assert.Contains(body, `onewire_temperature_celsius{name="office",sensor="28-0316a2792bff"} 23.125`)
+	assert.Contains(body, `onewire_read_errors_total{name="28-0416a1b2c3ff",sensor="28-0416a1b2c3ff"} 1`)
+	assert.NotContains(body, `onewire_temperature_celsius{name="28-0416a1b2c3ff"`)
+	assert.Contains(body, "onewire_sensors 2")
+
+	// sensors plugged in later are found, and ones unplugged are no longer read
+	helperWriteSensor(t, root, "10-000802b4c1d2", w1Negative)
+	assert.NoError(os.RemoveAll(filepath.Join(root, "28-0416a1b2c3ff")))
+	assert.NoError(reader.ReadAll())
+	assert.Len(refresh, 3)
+	body = exportertest.Scrape(t, reg)
+	assert.Contains(body, `onewire_temperature_celsius{name="10-000802b4c1d2",sensor="10-000802b4c1d2"} -26.125`)
+	assert.Contains(body, `onewire_read_errors_total{name="28-0416a1b2c3ff",sensor="28-0416a1b2c3ff"} 1`)
+	assert.Contains(body, "onewire_sensors 2")
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/eclipse/paho.mqtt.golang"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// QingpingSettingMsg represents a settings command (type 17) sent to a device on its down topic
+type QingpingSettingMsg struct {
+	ID      int             `json:"id"`
+	NeedAck int             `json:"need_ack"`
+	Type    string          `json:"type"`
+	Setting QingpingSetting `json:"setting"`
+}
+
+// QingpingSetting represents the settings in a settings command, in seconds
+type QingpingSetting struct {
+	ReportInterval  int `json:"report_interval"`
+	CollectInterval int `json:"collect_interval"`
+}
+
+// Configurer sets the report and collect intervals on devices, and tracks whether they were acknowledged
+type Configurer struct {
+	ReportInterval  time.Duration
+	CollectInterval time.Duration
+	// DownTopic is the topic commands are published to, formatted with the device MAC, until a device's up
+	// topic is seen
+	DownTopic string
+
+	mu       sync.Mutex
+	nextID   int
+	pending  map[int]Device
+	learned  map[string]string
+	acked    *prometheus.GaugeVec
+	ackCodes *prometheus.GaugeVec
+}
+
+// NewConfigurer registers metrics for tracking acknowledgements of settings commands
+func NewConfigurer(reg prometheus.Registerer, report time.Duration, collect time.Duration, downTopic string) *Configurer {
+	c := &Configurer{
+		ReportInterval:  report,
+		CollectInterval: collect,
+		DownTopic:       downTopic,
+		nextID:          1,
+		pending:         map[int]Device{},
+		learned:         map[string]string{},
+		acked: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_configuration_acknowledged",
+			Help: "Whether the device accepted the last settings command (1), or hasn't yet (0).",
+		}, []string{"device", "mac"}),
+		ackCodes: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_configuration_ack_code",
+			Help: "Result code the device acknowledged the last settings command with. 0 is success.",
+		}, []string{"device", "mac"}),
+	}
+	reg.MustRegister(c.acked)
+	reg.MustRegister(c.ackCodes)
+	return c
+}
+
+// topic returns the down topic for a device
+func (c *Configurer) topic(d Device) string {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if topic, ok := c.learned[d.MAC]; ok {
+		return topic
+	}
+	return fmt.Sprintf(c.DownTopic, d.MAC)
+}
+
+// observe learns a device's down topic from the up topic it publishes to, like /qingping/<MAC>/up, and
+// resends the settings command if it went to another topic
+func (c *Configurer) observe(client mqtt.Client, d Device, topic string) {
+	if !strings.HasSuffix(topic, "/up") {
+		return
+	}
+	down := strings.TrimSuffix(topic, "/up") + "/down"
+	if down == c.topic(d) {
+		return
+	}
+	c.mu.Lock()
+	c.learned[d.MAC] = down
+	c.mu.Unlock()
+	log.Printf("info: %s publishes to %s, so sending settings to %s\n", d.Name, topic, down)
+	c.configureDevice(client, d)
+}
+
+// message builds a settings command for a device, and records it as awaiting acknowledgement
+func (c *Configurer) message(d Device) QingpingSettingMsg {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for id, sent := range c.pending {
+		if sent == d { // superseded, so a late ack is ignored
+			delete(c.pending, id)
+		}
+	}
+	id := c.nextID
+	c.nextID++
+	c.pending[id] = d
+	c.acked.With(d.labels()).Set(0)
+
+	return QingpingSettingMsg{
+		ID:      id,
+		NeedAck: 1,
+		Type:    "17",
+		Setting: QingpingSetting{
+			ReportInterval:  int(c.ReportInterval.Seconds()),
+			CollectInterval: int(c.CollectInterval.Seconds()),
+		},
+	}
+}
+
+// configure publishes a settings command to every device.
+//
+// It's called on every connect, as devices can miss commands sent while the broker was unreachable.
+func (c *Configurer) configure(client mqtt.Client, devices Devices) {
+	for _, d := range devices {
+		c.configureDevice(client, d)
+	}
+}
+
+// configureDevice publishes a settings command to a device
+func (c *Configurer) configureDevice(client mqtt.Client, d Device) {
+	payload, err := json.Marshal(c.message(d))
+	if err != nil {
+		log.Printf("error: unable to encode settings for %s: %s\n", d.Name, err)
+		return
+	}
+	topic := c.topic(d)
+	log.Printf("info: setting report interval to %s and collect interval to %s on %s via %s\n", c.ReportInterval, c.CollectInterval, d.Name, topic)
+	token := client.Publish(topic, 1, false, payload)
+	go func() {
+		if token.Wait() && token.Error() != nil {
+			log.Printf("error: unable to publish settings to %s: %s\n", d.Name, token.Error())
+		}
+	}()
+}
+
+// acknowledge records a device's acknowledgement of a settings command
+func (c *Configurer) acknowledge(d Device, id int, code int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	sent, ok := c.pending[id]
+	if !ok || sent != d {
+		log.Printf("debug: ignoring ack %d from %s for a command we didn't send\n", id, d.Name)
+		return
+	}
+	delete(c.pending, id)
+
+	c.ackCodes.With(d.labels()).Set(float64(code))
+	if code != 0 {
+		log.Printf("error: %s rejected settings command %d with code %d\n", d.Name, id, code)
+		c.acked.With(d.labels()).Set(0)
+		return
+	}
+	log.Printf("info: %s accepted settings command %d\n", d.Name, id)
+	c.acked.With(d.labels()).Set(1)
+}
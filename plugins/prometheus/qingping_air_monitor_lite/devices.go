@@ -0,0 +1,100 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// Device is a Qingping device, and the friendly name its metrics are labelled with
+type Device struct {
+	Name string `toml:"name"`
+	MAC  string `toml:"mac"`
+}
+
+// labels returns the labels a device's metrics are exported with
+func (d Device) labels() prometheus.Labels {
+	return prometheus.Labels{"device": d.Name, "mac": d.MAC}
+}
+
+// topic returns the topic a device publishes to
+func (d Device) topic() string {
+	return fmt.Sprintf("/+/%s/#", d.MAC)
+}
+
+// Devices are the devices being exported, by MAC address
+type Devices map[string]Device
+
+// NewDevices checks devices have a name and a unique MAC, and indexes them by MAC
+func NewDevices(list []Device) (Devices, error) {
+	ds := Devices{}
+	names := map[string]bool{}
+	for _, d := range list {
+		d.MAC = normaliseMAC(d.MAC)
+		if len(d.Name) == 0 || len(d.MAC) == 0 {
+			return nil, fmt.Errorf("device %q (%s) needs both a name and a MAC", d.Name, d.MAC)
+		}
+		if _, ok := ds[d.MAC]; ok {
+			return nil, fmt.Errorf("device %s is configured more than once", d.MAC)
+		}
+		if names[d.Name] {
+			return nil, fmt.Errorf("device name %q is used more than once", d.Name)
+		}
+		names[d.Name] = true
+		ds[d.MAC] = d
+	}
+	if len(ds) == 0 {
+		return nil, fmt.Errorf("no devices configured")
+	}
+	return ds, nil
+}
+
+// lookup finds the device a message is from, by the MAC in its topic, then the MAC in its payload
+func (ds Devices) lookup(topic string, mac string) (Device, bool) {
+	parts := strings.Split(topic, "/")
+	if len(parts) > 2 {
+		if d, ok := ds[normaliseMAC(parts[2])]; ok {
+			return d, true
+		}
+	}
+	d, ok := ds[normaliseMAC(mac)]
+	return d, ok
+}
+
+// normaliseMAC converts a MAC address to the form Qingping devices use in topics, like 04CF8C28CEB7
+func normaliseMAC(mac string) string {
+	mac = strings.NewReplacer(":", "", "-", "").Replace(mac)
+	return strings.ToUpper(strings.TrimSpace(mac))
+}
+
+// parseDevices parses a comma separated list of name=MAC pairs
+func parseDevices(s string) ([]Device, error) {
+	var devices []Device
+	for _, pair := range strings.Split(s, ",") {
+		if len(strings.TrimSpace(pair)) == 0 {
+			continue
+		}
+		name, mac, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("bad device %q: expected name=MAC", pair)
+		}
+		devices = append(devices, Device{Name: strings.TrimSpace(name), MAC: mac})
+	}
+	return devices, nil
+}
+
+// deviceConfig is the config file devices can be read from
+type deviceConfig struct {
+	Devices []Device `toml:"devices"`
+}
+
+// loadDevices reads devices from a TOML config file
+func loadDevices(path string) ([]Device, error) {
+	var config deviceConfig
+	if _, err := toml.DecodeFile(path, &config); err != nil {
+		return nil, err
+	}
+	return config.Devices, nil
+}
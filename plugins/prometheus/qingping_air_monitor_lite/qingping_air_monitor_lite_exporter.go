@@ -5,94 +5,125 @@ import (
 	"flag"
 	"fmt"
 	"log"
-	"math"
-	"net/http"
-	"os"
+	"strconv"
+	"strings"
 	"time"
 
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
-	"github.com/prometheus/client_golang/prometheus/promhttp"
 )
 
+// sensorFields are the sensorData fields that are exported, and the metrics they're exported as
+var sensorFields = []struct {
+	field string
+	name  string
+	help  string
+}{
+	{"temperature", "qingping_temperature_celsius", "Current room temperature."},
+	{"humidity", "qingping_humidity_percentage", "Relative humidity in room."},
+	{"co2", "qingping_co2_parts_per_million", "Carbon dioxide in parts per million."},
+	{"pm25", "qingping_pm25_micrograms_per_meter_cubed", "PM2.5 µg/m3 averaged over 1 hour."},
+	{"pm10", "qingping_pm10_micrograms_per_meter_cubed", "PM10 µg/m3 averaged over 1 hour."},
+	{"battery", "qingping_battery_percentage", "Battery charge remaining."},
+	{"tvoc", "qingping_tvoc_parts_per_billion", "Total volatile organic compounds in parts per billion."},
+	{"noise", "qingping_noise_decibels", "Noise level in decibels."},
+	{"prob_temperature", "qingping_probe_temperature_celsius", "Temperature measured by an external probe."},
+	{"prob_humidity", "qingping_probe_humidity_percentage", "Relative humidity measured by an external probe."},
+}
+
 // Metrics represents metrics to be exported
 type Metrics struct {
-	temperature prometheus.Gauge
-	humidity    prometheus.Gauge
-	co2         prometheus.Gauge
-	pm25        prometheus.Gauge
-	pm10        prometheus.Gauge
+	// gauges are by sensorData field
+	gauges *exporter.GaugeSet
+	rssi   *prometheus.GaugeVec
+	info   *prometheus.GaugeVec
+
+	decodeErrors    prometheus.Counter
+	emptySensorData prometheus.Counter
+	unknownMessages *prometheus.CounterVec
 }
 
 // NewMetrics registers new metrics to export
 func NewMetrics(reg prometheus.Registerer) *Metrics {
+	labels := []string{"device", "mac"}
 	m := &Metrics{
-		temperature: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "upstairs_temperature_celsius",
-			Help: "Current room temperature.",
-		}),
-		humidity: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "upstairs_humidity_percentage",
-			Help: "Relative humidity in room.",
+		gauges: exporter.NewGaugeSet(reg, labels...),
+		rssi: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_wifi_rssi_dbm",
+			Help: "Wi-Fi signal strength when the device last connected.",
+		}, labels),
+		info: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "qingping_device_info",
+			Help: "Firmware and model of the device, from when it last connected.",
+		}, append(labels, "firmware", "model")),
+		decodeErrors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qingping_decode_errors_total",
+			Help: "Messages that couldn't be decoded as JSON.",
 		}),
-		co2: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "upstairs_co2_parts_per_million",
-			Help: "Carbon dioxide in parts per million.",
-		}),
-		pm25: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "upstairs_pm25_micrograms_per_meter_cubed",
-			Help: "PM2.5 µg/m3 averaged over 1 hour.",
-		}),
-		pm10: prometheus.NewGauge(prometheus.GaugeOpts{
-			Name: "upstairs_pm10_micrograms_per_meter_cubed",
-			Help: "PM10 µg/m3 averaged over 1 hour.",
+		emptySensorData: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "qingping_empty_sensor_data_total",
+			Help: "Sensor data messages (type 17) without any sensorData.",
 		}),
+		unknownMessages: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "qingping_unknown_messages_total",
+			Help: "Messages of a type the exporter doesn't know about.",
+		}, []string{"type"}),
+	}
+	for _, f := range sensorFields {
+		if err := m.gauges.Register(f.field, f.name, f.help); err != nil {
+			panic(err)
+		}
 	}
-	reg.MustRegister(m.temperature)
-	reg.MustRegister(m.humidity)
-	reg.MustRegister(m.co2)
-	reg.MustRegister(m.pm25)
-	reg.MustRegister(m.pm10)
+	reg.MustRegister(m.rssi)
+	reg.MustRegister(m.info)
+	reg.MustRegister(m.decodeErrors)
+	reg.MustRegister(m.emptySensorData)
+	reg.MustRegister(m.unknownMessages)
 
 	return m
 }
 
-func readMeasurementLoop(metrics *Metrics, host string, port int, mac string, ttl time.Duration) {
-	opts := mqtt.NewClientOptions()
-	hostname, err := os.Hostname()
-	if err != nil {
-		panic(err)
+// measurements maps each field to its value in sensor data, which is nil if the device didn't send it
+func (data QingpingSensorData) measurements() map[string]*QingpingFloatValue {
+	return map[string]*QingpingFloatValue{
+		"temperature":      data.Temperature,
+		"humidity":         data.Humidity,
+		"co2":              data.CO2,
+		"pm25":             data.PM25,
+		"pm10":             data.PM10,
+		"battery":          data.Battery,
+		"tvoc":             data.TVOC,
+		"noise":            data.Noise,
+		"prob_temperature": data.ProbeTemperature,
+		"prob_humidity":    data.ProbeHumidity,
 	}
-	pid := os.Getpid()
-
-	clientID := fmt.Sprintf("qingping_air_monitor_lite_exporter-%s-%d", hostname, pid)
-	log.Printf("Connecting with ClientID: %s\n", clientID)
-	opts.SetClientID(clientID)
-	opts.AddBroker(fmt.Sprintf("tcp://%s:%d", host, port))
-	opts.SetPingTimeout(1 * time.Second)
-	opts.SetKeepAlive(60 * time.Second)
-	opts.SetOrderMatters(false)
-	opts.SetAutoReconnect(true)
-	opts.SetConnectRetry(true)
-
-	// Set up the TTL checker early, in case MQTT is unavailable
-	refresh := make(chan time.Time)
-	readMeasurement := measurementReader(metrics, refresh)
-	exit := ttl * 10
-	go nilIfTTLExpired(metrics, refresh, ttl, exit)
-
-	// Set up the client
-	client := mqtt.NewClient(opts)
-	if token := client.Connect(); token.Wait() && token.Error() != nil {
-		panic(token.Error())
+}
+
+// set updates a device's metrics from its sensor data, skipping values the device didn't send
+func (m *Metrics) set(d Device, data QingpingSensorData) {
+	now := time.Now()
+	for field, v := range data.measurements() {
+		if v != nil {
+			m.gauges.Set(field, d.labels(), v.Value, now)
+		}
 	}
+}
 
-	topic := fmt.Sprintf("/+/%s/#", mac)
-	if token := client.Subscribe(topic, 1, readMeasurement); token.Wait() && token.Error() != nil {
-		fmt.Printf("error: %s", token.Error())
-		os.Exit(1)
+// setStatus updates a device's signal strength and info from a status message
+func (m *Metrics) setStatus(d Device, msg QingpingMQTTMsg) {
+	if rssi, err := msg.RSSI(); err == nil {
+		m.rssi.With(d.labels()).Set(rssi)
+	} else if len(msg.WifiInfo) > 0 {
+		log.Printf("warning: unable to read RSSI from %s: %s\n", d.Name, err)
 	}
-	log.Printf("Subscribed to topic: %s\n", topic)
+
+	// only keep the current firmware and model
+	m.info.DeletePartialMatch(d.labels())
+	labels := d.labels()
+	labels["firmware"] = msg.SWVersion
+	labels["model"] = msg.Model
+	m.info.With(labels).Set(1)
 }
 
 // QingpingMQTTMsg represents a MQTT message from the Qingping Air Monitor Lite sensor
@@ -100,17 +131,42 @@ type QingpingMQTTMsg struct {
 	Type       string `json:"type"`
 	MAC        string `json:"mac"`
 	Timestamp  int    `json:"timestamp"`
+	AckID      *int   `json:"ack_id"`
+	Code       int    `json:"code"`
 	SensorData []QingpingSensorData
+
+	// status (type 13) fields
+	WifiInfo  string `json:"wifi_info"`
+	SWVersion string `json:"sw_version"`
+	Model     string `json:"model"`
+}
+
+// RSSI returns the Wi-Fi signal strength from a status message.
+//
+// wifi_info is "SSID,RSSI,channel,BSSID", and the SSID may contain commas, so it's read from the end.
+func (m QingpingMQTTMsg) RSSI() (float64, error) {
+	parts := strings.Split(m.WifiInfo, ",")
+	if len(parts) < 4 {
+		return 0, fmt.Errorf("unexpected wifi_info %q", m.WifiInfo)
+	}
+	return strconv.ParseFloat(strings.TrimSpace(parts[len(parts)-3]), 64)
 }
 
-// QingpingSensorData represents sensor data in an MQTT message (type 17) from the Qingping Air Monitor Lite sensor
+// QingpingSensorData represents sensor data in an MQTT message (type 17) from a Qingping sensor.
+//
+// Values are nil when the device doesn't measure them.
 type QingpingSensorData struct {
-	Timestamp   QingpingIntValue   `json:"timestamp"`
-	Temperature QingpingFloatValue `json:"temperature"`
-	Humidity    QingpingFloatValue `json:"humidity"`
-	CO2         QingpingFloatValue `json:"co2"`
-	PM25        QingpingFloatValue `json:"pm25"`
-	PM10        QingpingFloatValue `json:"pm10"`
+	Timestamp        QingpingIntValue    `json:"timestamp"`
+	Temperature      *QingpingFloatValue `json:"temperature"`
+	Humidity         *QingpingFloatValue `json:"humidity"`
+	CO2              *QingpingFloatValue `json:"co2"`
+	PM25             *QingpingFloatValue `json:"pm25"`
+	PM10             *QingpingFloatValue `json:"pm10"`
+	Battery          *QingpingFloatValue `json:"battery"`
+	TVOC             *QingpingFloatValue `json:"tvoc"`
+	Noise            *QingpingFloatValue `json:"noise"`
+	ProbeTemperature *QingpingFloatValue `json:"prob_temperature"` // sic
+	ProbeHumidity    *QingpingFloatValue `json:"prob_humidity"`
 }
 
 // QingpingIntValue represents an integer value, found in sensor data in an MQTT message (type 17) from the Qingping Air Monitor Lite sensor
@@ -123,115 +179,155 @@ type QingpingFloatValue struct {
 	Value float64 `json:"value"`
 }
 
-func measurementReader(metrics *Metrics, refresh chan time.Time) func(mqtt.Client, mqtt.Message) {
+// newestSensorData returns the sensor data with the latest timestamp.
+//
+// After reconnecting, the device sends the readings it buffered while offline, not necessarily in order.
+func (m QingpingMQTTMsg) newestSensorData() QingpingSensorData {
+	newest := m.SensorData[0]
+	for _, d := range m.SensorData[1:] {
+		if d.Timestamp.Value > newest.Timestamp.Value {
+			newest = d
+		}
+	}
+	return newest
+}
+
+func measurementReader(metrics *Metrics, devices Devices, configurer *Configurer, refresh chan time.Time) func(mqtt.Client, mqtt.Message) {
 	return func(c mqtt.Client, msg mqtt.Message) {
-		if debug {
+		if opts.Debug {
 			fmt.Printf("topic: %s, payload: %s\n", msg.Topic(), msg.Payload())
 		}
 
 		var qmsg QingpingMQTTMsg
 		err := json.Unmarshal(msg.Payload(), &qmsg)
 		if err != nil {
-			log.Fatalf("error: unable to decode JSON: %s", err)
+			log.Printf("error: unable to decode JSON on %s: %s\n", msg.Topic(), err)
+			metrics.decodeErrors.Inc()
+			return
 		}
 
-		// Ignore everything but messages with sensorData
-		if qmsg.Type != "17" {
-			log.Printf("ignoring message (type %s) without sensorData\n", qmsg.Type)
+		device, ok := devices.lookup(msg.Topic(), qmsg.MAC)
+		if !ok {
+			log.Printf("warning: ignoring message on %s from unknown device %q\n", msg.Topic(), qmsg.MAC)
 			return
 		}
-		log.Printf("got sensorData")
-		refresh <- time.Now()
 
-		if len(qmsg.SensorData) > 1 {
-			log.Printf("warning: multiple sensorData received: expected 1, got %d", len(qmsg.SensorData))
+		if configurer != nil {
+			if msg.Topic() == configurer.topic(device) {
+				return // our own settings command
+			}
+			configurer.observe(c, device, msg.Topic())
+		}
+		if qmsg.AckID != nil {
+			if configurer != nil {
+				configurer.acknowledge(device, *qmsg.AckID, qmsg.Code)
+			}
+			return
 		}
 
-		metrics.temperature.Set(qmsg.SensorData[0].Temperature.Value)
-		metrics.humidity.Set(qmsg.SensorData[0].Humidity.Value)
-		metrics.co2.Set(qmsg.SensorData[0].CO2.Value)
-		metrics.pm25.Set(qmsg.SensorData[0].PM25.Value)
-		metrics.pm10.Set(qmsg.SensorData[0].PM10.Value)
-	}
-}
-
-func rateLimitedPrintln(s string, d time.Duration) {
-	last := rateLimitedPrintlnTable[s]
-	now := time.Now()
-	if now.Sub(last) > d {
-		fmt.Println(s)
-		rateLimitedPrintlnTable[s] = now
-	}
-}
-
-// nilIfTTLExpired nils out a metric if an update isn't received within a timeout
-func nilIfTTLExpired(metrics *Metrics, refresh chan time.Time, ttl time.Duration, exit time.Duration) {
-	NaN := math.Log(-1.0)
-	last := time.Now()
-
-	// read for updates
-	go func() {
-		for t := range refresh {
-			last = t
+		switch qmsg.Type {
+		case "17": // sensorData
+		case "13": // status, sent on connect
+			log.Printf("got status from %s (firmware %s)\n", device.Name, qmsg.SWVersion)
+			metrics.setStatus(device, qmsg)
+			return
+		default:
+			log.Printf("warning: ignoring message with unknown type %q\n", qmsg.Type)
+			metrics.unknownMessages.WithLabelValues(qmsg.Type).Inc()
+			return
 		}
-	}()
-
-	// check if the TTL has expired
-	ticker := time.NewTicker(time.Second)
-	for {
-		now := <-ticker.C
-		if now.Sub(last) > ttl {
-			rateLimitedPrintln("error: TTL expired on last measurement - setting all measurements to NaN", 30*time.Second)
-			metrics.temperature.Set(NaN)
-			metrics.humidity.Set(NaN)
-			metrics.co2.Set(NaN)
-			metrics.pm25.Set(NaN)
-			metrics.pm10.Set(NaN)
+
+		if len(qmsg.SensorData) == 0 {
+			log.Printf("warning: got sensorData message without any sensorData")
+			metrics.emptySensorData.Inc()
+			return
 		}
-		if now.Sub(last) > exit {
-			fmt.Printf("error: no updates for %s - exiting\n", exit)
-			os.Exit(2)
+		log.Printf("got sensorData from %s\n", device.Name)
+		refresh <- time.Now()
+
+		if len(qmsg.SensorData) > 1 {
+			log.Printf("info: multiple sensorData received (%d), using the newest", len(qmsg.SensorData))
 		}
+		metrics.set(device, qmsg.newestSensorData())
 	}
 }
 
 var (
-	host                    string
-	port                    int
-	mac                     string
-	debug                   bool
-	ttl                     time.Duration
-	rateLimitedPrintlnTable map[string]time.Time
+	opts            exporter.Options
+	mac             string
+	name            string
+	deviceList      string
+	configPath      string
+	reportInterval  time.Duration
+	collectInterval time.Duration
+	downTopic       string
 )
 
 func init() {
-	flag.StringVar(&host, "h", "[::1]", "hostname/address of MQTT broker")
-	flag.IntVar(&port, "p", 1883, "tcp port of MQTT broker")
-	flag.StringVar(&mac, "m", "", "MAC address of Qingping device")
-	flag.BoolVar(&debug, "d", false, "turn on debug output")
-	flag.DurationVar(&ttl, "t", 10*time.Minute, "how long to wait for updates before returning NaNs")
-	rateLimitedPrintlnTable = make(map[string]time.Time)
+	opts.RegisterFlags(flag.CommandLine, ":10001")
+	flag.StringVar(&mac, "m", "", "MAC address of a single Qingping device")
+	flag.StringVar(&name, "n", "upstairs", "name of the device set with -m")
+	flag.StringVar(&deviceList, "devices", "", "comma separated list of name=MAC Qingping devices")
+	flag.StringVar(&configPath, "c", "", "path to a TOML config file listing Qingping devices")
+	flag.DurationVar(&reportInterval, "report-interval", 0, "set how often devices report, on connect (requires -collect-interval)")
+	flag.DurationVar(&collectInterval, "collect-interval", 0, "set how often devices take a measurement, on connect (requires -report-interval)")
+	flag.StringVar(&downTopic, "down-topic", "/qingping/%s/down", "topic settings are published to, where %s is the device MAC, until the device's up topic is seen")
+}
+
+// configuredDevices gathers devices from -m, -devices, and the -c config file
+func configuredDevices() (Devices, error) {
+	var list []Device
+	if len(mac) > 0 {
+		list = append(list, Device{Name: name, MAC: mac})
+	}
+	parsed, err := parseDevices(deviceList)
+	if err != nil {
+		return nil, err
+	}
+	list = append(list, parsed...)
+	if len(configPath) > 0 {
+		loaded, err := loadDevices(configPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to read config file %s: %w", configPath, err)
+		}
+		list = append(list, loaded...)
+	}
+	return NewDevices(list)
 }
 
 func main() {
 	flag.Parse()
+	exporter.SetupLogging()
 
-	mqtt.ERROR = log.New(os.Stdout, "[ERROR] ", 0)
-	mqtt.CRITICAL = log.New(os.Stdout, "[CRIT] ", 0)
-	mqtt.WARN = log.New(os.Stdout, "[WARN]  ", 0)
-	//mqtt.DEBUG = log.New(os.Stdout, "[DEBUG] ", 0)
-
-	// Create a non-global registry.
-	reg := prometheus.NewRegistry()
+	devices, err := configuredDevices()
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	e, err := exporter.New("qingping_air_monitor_lite_exporter", "qingping", opts)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
 
-	// Create new metrics and register them using the custom registry.
-	metrics := NewMetrics(reg)
+	// Create new metrics and register them using the exporter's registry.
+	metrics := NewMetrics(e.Registry)
 
-	// Read measurements via MQTT, update metrics
-	go readMeasurementLoop(metrics, host, port, mac, ttl)
+	// Configure devices on connect, if intervals are set
+	var configurer *Configurer
+	sub := exporter.Subscription{Topics: map[string]byte{}}
+	if reportInterval > 0 || collectInterval > 0 {
+		if reportInterval < time.Second || collectInterval < time.Second {
+			log.Fatalf("error: -report-interval and -collect-interval must both be set, to at least 1s")
+		}
+		configurer = NewConfigurer(e.Registry, reportInterval, collectInterval, downTopic)
+		sub.OnConnect = func(c mqtt.Client) {
+			configurer.configure(c, devices)
+		}
+	}
 
-	// Expose metrics and custom registry via an HTTP server
-	// using the HandleFor function. "/metrics" is the usual endpoint for that.
-	http.Handle("/metrics", promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
-	log.Fatal(http.ListenAndServe(":10001", nil))
+	// Read measurements via MQTT, update metrics, and expose them on /metrics
+	for _, d := range devices {
+		sub.Topics[d.topic()] = 1
+	}
+	sub.Handler = measurementReader(metrics, devices, configurer, e.Refresh)
+	log.Fatal(e.Run(metrics.gauges, sub))
 }
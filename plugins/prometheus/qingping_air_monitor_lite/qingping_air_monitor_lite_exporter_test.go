@@ -1,6 +1,8 @@
 package main
 
 import (
+	"encoding/json"
+	"fmt"
 	"io"
 	"net/http"
 	"net/http/httptest"
@@ -9,6 +11,7 @@ import (
 	"testing"
 	"time"
 
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
 	"github.com/eclipse/paho.mqtt.golang"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
@@ -49,6 +52,11 @@ func (tm TestMsg) Payload() []byte {
 }
 func (tm TestMsg) Ack() {}
 
+var testDevices = Devices{
+	"04CF8C28CEB7": {Name: "upstairs", MAC: "04CF8C28CEB7"},
+	"582D3470B1C2": {Name: "downstairs", MAC: "582D3470B1C2"},
+}
+
 func TestMeasurementReader(t *testing.T) {
 	assert := assert.New(t)
 
@@ -59,18 +67,18 @@ func TestMeasurementReader(t *testing.T) {
 	defer ts.Close()
 	refresh := make(chan time.Time, 1000)
 
-	readMeasurement := measurementReader(metrics, refresh)
+	readMeasurement := measurementReader(metrics, testDevices, nil, refresh)
 	c := mqtt.NewClient(mqtt.NewClientOptions())
 
 	testCases := []struct {
 		msg      TestMsg
 		expected string
 	}{
-		{TestMsg{TopicString: "/topic/MACADDR/user/update", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, "upstairs_temperature_celsius 22.29"},
-		{TestMsg{TopicString: "/topic/MACADDR/user/update", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, "upstairs_humidity_percentage 58.18"},
-		{TestMsg{TopicString: "/topic/MACADDR/user/update", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, "upstairs_co2_parts_per_million 538"},
-		{TestMsg{TopicString: "/topic/MACADDR/user/update", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, "upstairs_pm25_micrograms_per_meter_cubed 2"},
-		{TestMsg{TopicString: "/topic/MACADDR/user/update", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, "upstairs_pm10_micrograms_per_meter_cubed 2"},
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, `qingping_temperature_celsius{device="upstairs",mac="04CF8C28CEB7"} 22.29`},
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, `qingping_humidity_percentage{device="upstairs",mac="04CF8C28CEB7"} 58.18`},
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, `qingping_co2_parts_per_million{device="upstairs",mac="04CF8C28CEB7"} 538`},
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, `qingping_pm25_micrograms_per_meter_cubed{device="upstairs",mac="04CF8C28CEB7"} 2`},
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "metric_sample.json")}, `qingping_pm10_micrograms_per_meter_cubed{device="upstairs",mac="04CF8C28CEB7"} 2`},
 	}
 
 	for _, tc := range testCases {
@@ -89,7 +97,7 @@ func TestMeasurementReader(t *testing.T) {
 
 }
 
-func TestTTLExpiry(t *testing.T) {
+func TestMeasurementReaderUsesNewestSensorData(t *testing.T) {
 	assert := assert.New(t)
 
 	// setup
@@ -97,28 +105,364 @@ func TestTTLExpiry(t *testing.T) {
 	metrics := NewMetrics(reg)
 	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
 	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	readMeasurement := measurementReader(metrics, testDevices, nil, refresh)
+	c := mqtt.NewClient(mqtt.NewClientOptions())
+	readMeasurement(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "buffered_sample.json")})
 
-	// get the latest metrics
 	resp, err := http.Get(ts.URL)
 	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	assert.Contains(string(body), `qingping_temperature_celsius{device="upstairs",mac="04CF8C28CEB7"} 22.81`)
+	assert.Contains(string(body), `qingping_co2_parts_per_million{device="upstairs",mac="04CF8C28CEB7"} 552`)
+	assert.Len(refresh, 1)
+}
+
+func TestMeasurementReaderSurvivesBadMessages(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	readMeasurement := measurementReader(metrics, testDevices, nil, refresh)
+	c := mqtt.NewClient(mqtt.NewClientOptions())
+
+	testCases := []struct {
+		msg      TestMsg
+		expected string
+	}{
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: []byte(`{"type":"17","sensorData":[`)}, "qingping_decode_errors_total 1"},
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "empty_sample.json")}, "qingping_empty_sensor_data_total 1"},
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: []byte(`{"type":"17","mac":"04CF8C28CEB7"}`)}, "qingping_empty_sensor_data_total 2"},
+		{TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "unknown_sample.json")}, `qingping_unknown_messages_total{type="10"} 1`},
+	}
+
+	for _, tc := range testCases {
+		t.Run(tc.expected, func(t *testing.T) {
+			readMeasurement(c, tc.msg)
+
+			resp, err := http.Get(ts.URL)
+			assert.NoError(err)
 
+			body, err := io.ReadAll(resp.Body)
+			assert.NoError(err)
+
+			assert.Contains(string(body), tc.expected)
+		})
+	}
+
+	// status messages are known, and aren't counted
+	readMeasurement(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "phone_home_sample.json")})
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
 	body, err := io.ReadAll(resp.Body)
 	assert.NoError(err)
-	assert.Contains(string(body), "upstairs_temperature_celsius 0")
+	assert.NotContains(string(body), `type="13"`)
+	assert.Empty(refresh)
+}
+
+func TestTTLExpiry(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	metrics.set(testDevices["04CF8C28CEB7"], QingpingSensorData{Temperature: &QingpingFloatValue{22.29}})
+	metrics.set(testDevices["582D3470B1C2"], QingpingSensorData{Temperature: &QingpingFloatValue{19.5}, Battery: &QingpingFloatValue{87}})
 
-	// setup the TTL checker
+	// setup the TTL checker, with a longer TTL on battery
 	refresh := make(chan time.Time, 1000)
-	ttl := time.Nanosecond * 2
-	exit := time.Second * 10
-	go nilIfTTLExpired(metrics, refresh, ttl, exit)
+	ttls := exporter.TTLs{Default: time.Millisecond * 1500, Fields: map[string]time.Duration{"battery": time.Hour}}
+	health := exporter.NewHealth(reg, "qingping_exporter_healthy", time.Second*10)
+	go exporter.Watch(metrics.gauges, refresh, ttls, health, false)
 
-	// wait
+	// only upstairs keeps sending updates
+	time.Sleep(time.Second)
+	metrics.set(testDevices["04CF8C28CEB7"], QingpingSensorData{Temperature: &QingpingFloatValue{22.29}})
 	time.Sleep(time.Millisecond * 1200)
 
-	// then check the TTL has expired
+	// then check the TTL has expired on downstairs temperature only
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Contains(string(body), `qingping_temperature_celsius{device="upstairs",mac="04CF8C28CEB7"} 22.29`)
+	assert.Contains(string(body), `qingping_temperature_celsius{device="downstairs",mac="582D3470B1C2"} NaN`)
+	assert.Contains(string(body), `qingping_battery_percentage{device="downstairs",mac="582D3470B1C2"} 87`)
+	assert.Contains(string(body), `qingping_battery_percentage_last_seen_timestamp_seconds{device="downstairs",mac="582D3470B1C2"} 1.`)
+	assert.NotContains(string(body), `qingping_battery_percentage_last_seen_timestamp_seconds{device="upstairs"`)
+	assert.Contains(string(body), "qingping_exporter_healthy 1")
+}
+
+func TestMeasurementReaderIgnoresUnknownDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	refresh := make(chan time.Time, 1000)
+
+	readMeasurement := measurementReader(metrics, testDevices, nil, refresh)
+	c := mqtt.NewClient(mqtt.NewClientOptions())
+	readMeasurement(c, TestMsg{TopicString: "/qingping/AABBCCDDEEFF/up", PayloadBytes: []byte(`{"type":"17","mac":"AABBCCDDEEFF","sensorData":[{"temperature":{"value":30}}]}`)})
+
+	assert.Empty(refresh)
+}
+
+func TestNewDevices(t *testing.T) {
+	assert := assert.New(t)
+
+	parsed, err := parseDevices("upstairs=04:cf:8c:28:ce:b7, downstairs = 582D3470B1C2")
+	assert.NoError(err)
+	devices, err := NewDevices(parsed)
+	assert.NoError(err)
+	assert.Equal(testDevices, devices)
+
+	d, ok := devices.lookup("/qingping/582D3470B1C2/up", "")
+	assert.True(ok)
+	assert.Equal("downstairs", d.Name)
+	d, ok = devices.lookup("/qingping/up", "04cf8c28ceb7")
+	assert.True(ok)
+	assert.Equal("upstairs", d.Name)
+
+	loaded, err := loadDevices(filepath.Join("testdata", "devices.toml"))
+	assert.NoError(err)
+	assert.Len(loaded, 3)
+	assert.Equal(Device{Name: "garage", MAC: "582D3470C9A0"}, loaded[2])
+
+	testCases := []struct {
+		devices []Device
+		expect  string
+	}{
+		{[]Device{}, "no devices configured"},
+		{[]Device{{Name: "upstairs"}}, "needs both a name and a MAC"},
+		{[]Device{{Name: "upstairs", MAC: "04CF8C28CEB7"}, {Name: "office", MAC: "04:CF:8C:28:CE:B7"}}, "configured more than once"},
+		{[]Device{{Name: "upstairs", MAC: "04CF8C28CEB7"}, {Name: "upstairs", MAC: "582D3470B1C2"}}, "used more than once"},
+	}
+	for _, tc := range testCases {
+		_, err := NewDevices(tc.devices)
+		assert.ErrorContains(err, tc.expect)
+	}
+
+	_, err = parseDevices("upstairs")
+	assert.Error(err)
+}
+
+type TestToken struct{}
+
+func (tt TestToken) Wait() bool                     { return true }
+func (tt TestToken) WaitTimeout(time.Duration) bool { return true }
+func (tt TestToken) Done() <-chan struct{} {
+	done := make(chan struct{})
+	close(done)
+	return done
+}
+func (tt TestToken) Error() error { return nil }
+
+// TestClient records messages published to it
+type TestClient struct {
+	mqtt.Client
+	Published map[string][]byte
+}
+
+func (tc *TestClient) Publish(topic string, qos byte, retained bool, payload interface{}) mqtt.Token {
+	tc.Published[topic] = payload.([]byte)
+	return TestToken{}
+}
+
+func TestConfigurerAcknowledgement(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	configurer := NewConfigurer(reg, 15*time.Minute, time.Minute, "/qingping/%s/down")
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	client := &TestClient{Published: map[string][]byte{}}
+	configurer.configure(client, testDevices)
+	assert.Len(client.Published, 2)
+
+	var setting QingpingSettingMsg
+	assert.NoError(json.Unmarshal(client.Published["/qingping/04CF8C28CEB7/down"], &setting))
+	assert.Equal("17", setting.Type)
+	assert.Equal(1, setting.NeedAck)
+	assert.Equal(QingpingSetting{ReportInterval: 900, CollectInterval: 60}, setting.Setting)
+
+	readMeasurement := measurementReader(metrics, testDevices, configurer, refresh)
+	c := client
+
+	// our own command echoed back isn't treated as a message from the device
+	readMeasurement(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/down", PayloadBytes: client.Published["/qingping/04CF8C28CEB7/down"]})
+
+	// upstairs accepts, downstairs acks a command we never sent
+	readMeasurement(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: []byte(fmt.Sprintf(`{"type":"18","ack_id":%d,"code":0}`, setting.ID))})
+	readMeasurement(c, TestMsg{TopicString: "/qingping/582D3470B1C2/up", PayloadBytes: []byte(`{"type":"18","ack_id":999,"code":0}`)})
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Contains(string(body), `qingping_configuration_acknowledged{device="upstairs",mac="04CF8C28CEB7"} 1`)
+	assert.Contains(string(body), `qingping_configuration_acknowledged{device="downstairs",mac="582D3470B1C2"} 0`)
+	assert.NotContains(string(body), "qingping_empty_sensor_data_total 1")
+	assert.NotContains(string(body), "qingping_unknown_messages_total")
+
+	// on reconnect, the command is resent, and rejected
+	configurer.configure(client, testDevices)
+	assert.NoError(json.Unmarshal(client.Published["/qingping/04CF8C28CEB7/down"], &setting))
+	readMeasurement(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: []byte(fmt.Sprintf(`{"type":"18","ack_id":%d,"code":2}`, setting.ID))})
+
 	resp, err = http.Get(ts.URL)
 	assert.NoError(err)
 	body, err = io.ReadAll(resp.Body)
 	assert.NoError(err)
-	assert.Contains(string(body), "upstairs_temperature_celsius NaN")
+	assert.Contains(string(body), `qingping_configuration_acknowledged{device="upstairs",mac="04CF8C28CEB7"} 0`)
+	assert.Contains(string(body), `qingping_configuration_ack_code{device="upstairs",mac="04CF8C28CEB7"} 2`)
+	assert.Empty(refresh)
+
+	// a device publishing to another topic gets its settings on the matching down topic
+	assert.Len(client.Published, 2)
+	readMeasurement(c, TestMsg{TopicString: "/custom/582D3470B1C2/up", PayloadBytes: []byte(`{"type":"13","mac":"582D3470B1C2"}`)})
+	assert.Len(client.Published, 3)
+	assert.NoError(json.Unmarshal(client.Published["/custom/582D3470B1C2/down"], &setting))
+	assert.Equal(QingpingSetting{ReportInterval: 900, CollectInterval: 60}, setting.Setting)
+	readMeasurement(c, TestMsg{TopicString: "/custom/582D3470B1C2/up", PayloadBytes: []byte(`{"type":"13","mac":"582D3470B1C2"}`)})
+	assert.Len(client.Published, 3)
+}
+
+func TestMeasurementReaderExtendedFields(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	readMeasurement := measurementReader(metrics, testDevices, nil, refresh)
+	c := mqtt.NewClient(mqtt.NewClientOptions())
+	readMeasurement(c, TestMsg{TopicString: "/qingping/582D3470B1C2/up", PayloadBytes: helperLoadBytes(t, "extended_sample.json")})
+	readMeasurement(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: helperLoadBytes(t, "phone_home_sample.json")})
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	downstairs := `{device="downstairs",mac="582D3470B1C2"}`
+	assert.Contains(string(body), "qingping_battery_percentage"+downstairs+" 87")
+	assert.Contains(string(body), "qingping_tvoc_parts_per_billion"+downstairs+" 112")
+	assert.Contains(string(body), "qingping_noise_decibels"+downstairs+" 38")
+	assert.Contains(string(body), "qingping_probe_temperature_celsius"+downstairs+" 4.25")
+	assert.Contains(string(body), "qingping_probe_humidity_percentage"+downstairs+" 0")
+
+	// omitted fields aren't reported as 0
+	assert.NotContains(string(body), "qingping_co2_parts_per_million"+downstairs)
+	assert.NotContains(string(body), "qingping_pm10_micrograms_per_meter_cubed"+downstairs)
+
+	// status
+	assert.Contains(string(body), `qingping_wifi_rssi_dbm{device="upstairs",mac="04CF8C28CEB7"} -29`)
+	assert.Contains(string(body), `qingping_device_info{device="upstairs",firmware="4.3.4",mac="04CF8C28CEB7",model=""} 1`)
+
+	// only seen measurements are expired
+	metrics.gauges.Expire(time.Now().Add(time.Hour), exporter.TTLs{Default: time.Minute})
+	resp, err = http.Get(ts.URL)
+	assert.NoError(err)
+	body, err = io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Contains(string(body), "qingping_battery_percentage"+downstairs+" NaN")
+	assert.NotContains(string(body), "qingping_co2_parts_per_million"+downstairs)
+
+	// a firmware upgrade replaces the info series
+	readMeasurement(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: []byte(`{"type":"13","wifi_info":"home,-61,1,DC:2C:6E:29:80:8E","sw_version":"4.4.0","model":"CGDN1"}`)})
+	resp, err = http.Get(ts.URL)
+	assert.NoError(err)
+	body, err = io.ReadAll(resp.Body)
+	assert.NoError(err)
+	assert.Contains(string(body), `qingping_wifi_rssi_dbm{device="upstairs",mac="04CF8C28CEB7"} -61`)
+	assert.Contains(string(body), `qingping_device_info{device="upstairs",firmware="4.4.0",mac="04CF8C28CEB7",model="CGDN1"} 1`)
+	assert.NotContains(string(body), `firmware="4.3.4"`)
+}
+
+func TestRSSI(t *testing.T) {
+	assert := assert.New(t)
+
+	testCases := []struct {
+		wifiInfo string
+		expected float64
+		err      bool
+	}{
+		{"MI\\u0020WIFI,-29,7,DC:2C:6E:29:80:8E", -29, false},
+		{"cafe, upstairs,-70,11,DC:2C:6E:29:80:8E", -70, false},
+		{"home,-29", 0, true},
+		{"", 0, true},
+	}
+	for _, tc := range testCases {
+		rssi, err := QingpingMQTTMsg{WifiInfo: tc.wifiInfo}.RSSI()
+		assert.Equal(tc.err, err != nil, tc.wifiInfo)
+		assert.Equal(tc.expected, rssi, tc.wifiInfo)
+	}
+}
+
+func TestReplayCapture(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	ts := httptest.NewServer(promhttp.HandlerFor(reg, promhttp.HandlerOpts{Registry: reg}))
+	defer ts.Close()
+	refresh := make(chan time.Time, 1000)
+
+	// replay traffic recorded with -record
+	f, err := os.Open(filepath.Join("testdata", "capture.jsonl"))
+	assert.NoError(err)
+	defer f.Close()
+	n, err := exporter.Replay(f, measurementReader(metrics, testDevices, nil, refresh), 0)
+	assert.NoError(err)
+	assert.Equal(4, n)
+
+	resp, err := http.Get(ts.URL)
+	assert.NoError(err)
+	body, err := io.ReadAll(resp.Body)
+	assert.NoError(err)
+
+	assert.Contains(string(body), `qingping_temperature_celsius{device="upstairs",mac="04CF8C28CEB7"} 22.29`)
+	assert.Contains(string(body), `qingping_co2_parts_per_million{device="downstairs",mac="582D3470B1C2"} 712`)
+	assert.Contains(string(body), `qingping_wifi_rssi_dbm{device="upstairs",mac="04CF8C28CEB7"} -29`)
+	assert.Contains(string(body), "qingping_empty_sensor_data_total 1")
+	assert.Len(refresh, 2)
+}
+
+func TestReplayCaptureWithConfigurer(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	configurer := NewConfigurer(reg, 15*time.Minute, time.Minute, "/custom/%s/down")
+	refresh := make(chan time.Time, 1000)
+
+	// the recording's up topics differ from -down-topic, so settings are resent, with nowhere to send them
+	f, err := os.Open(filepath.Join("testdata", "capture.jsonl"))
+	assert.NoError(err)
+	defer f.Close()
+	n, err := exporter.Replay(f, measurementReader(metrics, testDevices, configurer, refresh), 0)
+	assert.NoError(err)
+	assert.Equal(4, n)
+	assert.Equal("/qingping/04CF8C28CEB7/down", configurer.topic(testDevices["04CF8C28CEB7"]))
+	assert.Len(refresh, 2)
 }
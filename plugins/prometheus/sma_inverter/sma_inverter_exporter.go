@@ -0,0 +1,212 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exporter"
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+// statusKey is the key of the inverter's status, which is a tag rather than a number
+const statusKey = "6180_08214800"
+
+// inverterKeys are the numeric values exported, with the field name used for TTLs, their metric names and
+// help, what to divide the raw value by, and whether the inverter having no value means 0
+var inverterKeys = []struct {
+	key        string
+	field      string
+	name       string
+	help       string
+	factor     float64
+	nullIsZero bool
+}{
+	// power is null when the inverter isn't producing, like at night
+	{"6100_40263F00", "ac_power", "sma_ac_power_watts", "AC power fed into the grid, in watts.", 1, true},
+	{"6400_00262200", "daily_yield", "sma_daily_yield_watt_hours", "Energy produced today, in watt hours.", 1, false},
+	{"6400_00260100", "total_yield", "sma_total_yield_watt_hours", "Energy produced since the inverter was installed, in watt hours.", 1, false},
+	{"6100_00464800", "grid_voltage", "sma_grid_voltage_volts", "Grid voltage on phase L1, in volts.", 100, false},
+}
+
+// statuses are the names of the inverter's status tags
+var statuses = map[int]string{
+	35:  "fault",
+	303: "off",
+	307: "ok",
+	455: "warning",
+}
+
+// Metrics are the values exported for each inverter
+type Metrics struct {
+	gauges *exporter.GaugeSet
+	status *prometheus.GaugeVec
+	errors prometheus.Counter
+}
+
+// NewMetrics registers metrics for inverter values with reg
+func NewMetrics(reg *prometheus.Registry) *Metrics {
+	m := &Metrics{
+		gauges: exporter.NewGaugeSet(reg, "inverter"),
+		status: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sma_inverter_status",
+			Help: "The inverter's status, with a value of 1.",
+		}, []string{"inverter", "status"}),
+		errors: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "sma_request_errors_total",
+			Help: "Number of failed requests for the inverter's values.",
+		}),
+	}
+	reg.MustRegister(m.status)
+	reg.MustRegister(m.errors)
+	for _, k := range inverterKeys {
+		if err := m.gauges.Register(k.field, k.name, k.help); err != nil {
+			panic(err)
+		}
+	}
+	if err := m.gauges.Register("status", "sma_inverter_status_code", "The inverter's status, as its raw tag."); err != nil {
+		panic(err)
+	}
+	return m
+}
+
+// set updates metrics from an inverter's values. Values the inverter doesn't have are skipped rather than
+// zeroed, except for power, which is 0 when the inverter isn't producing.
+func (m *Metrics) set(inverter string, values map[string]map[string][]Value, now time.Time) {
+	labels := prometheus.Labels{"inverter": inverter}
+	for _, k := range inverterKeys {
+		v, ok := firstValue(values[k.key])
+		if !ok {
+			continue
+		}
+		f, ok := v.Number()
+		if !ok && k.nullIsZero {
+			f, ok = 0, v.IsNull()
+		}
+		if ok {
+			m.gauges.Set(k.field, labels, f/k.factor, now)
+		}
+	}
+
+	v, ok := firstValue(values[statusKey])
+	if !ok {
+		return
+	}
+	tag, ok := v.Tag()
+	if !ok {
+		return
+	}
+	status, ok := statuses[tag]
+	if !ok {
+		status = "unknown"
+	}
+	m.gauges.Set("status", labels, float64(tag), now)
+	m.status.DeletePartialMatch(labels)
+	m.status.With(prometheus.Labels{"inverter": inverter, "status": status}).Set(1)
+}
+
+// firstValue returns the first value of a key, whichever group it's in
+func firstValue(groups map[string][]Value) (Value, bool) {
+	for _, values := range groups {
+		if len(values) > 0 {
+			return values[0], true
+		}
+	}
+	return Value{}, false
+}
+
+// keys returns every key the exporter reads
+func keys() []string {
+	keys := []string{statusKey}
+	for _, k := range inverterKeys {
+		keys = append(keys, k.key)
+	}
+	return keys
+}
+
+// poll reads the inverter's values, and updates metrics
+func poll(client *Webconnect, metrics *Metrics, refresh chan time.Time) error {
+	values, err := client.Values(keys())
+	if err != nil {
+		metrics.errors.Inc()
+		return err
+	}
+	now := time.Now()
+	for inverter, v := range values {
+		metrics.set(inverter, v, now)
+	}
+	if len(values) > 0 {
+		refresh <- now
+	}
+	return nil
+}
+
+var (
+	opts     exporter.Options
+	address  string
+	password string
+	insecure bool
+	interval time.Duration
+)
+
+func init() {
+	opts.RegisterServeFlags(flag.CommandLine, ":10003", 5*time.Minute)
+	flag.StringVar(&address, "url", "", "URL of the inverter's web interface, like https://192.168.1.30")
+	flag.StringVar(&password, "password", "", "password of the inverter's user account (default $SMA_PASSWORD)")
+	flag.BoolVar(&insecure, "insecure", false, "don't verify the inverter's (usually self-signed) HTTPS certificate")
+	flag.DurationVar(&interval, "interval", 15*time.Second, "how often to read values from the inverter")
+}
+
+func main() {
+	flag.Parse()
+
+	if len(address) == 0 {
+		log.Fatalf("error: -url is required")
+	}
+	if len(password) == 0 {
+		password = os.Getenv("SMA_PASSWORD")
+	}
+	e, err := exporter.New("sma_inverter_exporter", "sma", opts)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+
+	// Create new metrics and register them using the exporter's registry.
+	metrics := NewMetrics(e.Registry)
+
+	// Log out on exit, however the exporter exits, so the session doesn't hold one of the inverter's slots until
+	// it expires
+	client := NewWebconnect(address, password, insecure)
+	exporter.OnShutdown(func() {
+		if err := client.Logout(); err != nil {
+			fmt.Printf("error: unable to log out of inverter: %s\n", err)
+		}
+	})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+
+	// Read values from the inverter, update metrics, and expose them on /metrics
+	err = e.RunInput(metrics.gauges, func() error {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			if err := poll(client, metrics, e.Refresh); err != nil {
+				fmt.Printf("error: unable to read values from inverter: %s\n", err)
+			}
+			select {
+			case <-ticker.C:
+			case sig := <-signals:
+				log.Printf("Got %s, exiting\n", sig)
+				return nil
+			}
+		}
+	})
+	exporter.Shutdown()
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+}
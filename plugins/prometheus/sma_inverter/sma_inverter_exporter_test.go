@@ -0,0 +1,181 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/auxesis/meteo/plugins/prometheus/internal/exportertest"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/stretchr/testify/assert"
+)
+
+// TestInverter stands in for an inverter's web API, with a limited number of session slots
+type TestInverter struct {
+	Password string
+	Slots    int
+	Values   string
+
+	mu       sync.Mutex
+	sessions map[string]bool
+	logins   int
+}
+
+func (ti *TestInverter) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	if ti.sessions == nil {
+		ti.sessions = map[string]bool{}
+	}
+	sid := r.URL.Query().Get("sid")
+
+	switch r.URL.Path {
+	case "/dyn/login.json":
+		var login struct {
+			Right string `json:"right"`
+			Pass  string `json:"pass"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&login); err != nil || login.Pass != ti.Password {
+			fmt.Fprint(w, `{"result":{"sid":null}}`)
+			return
+		}
+		if len(ti.sessions) >= ti.Slots {
+			fmt.Fprint(w, `{"err":503}`)
+			return
+		}
+		ti.logins++
+		sid = fmt.Sprintf("session-%d", ti.logins)
+		ti.sessions[sid] = true
+		fmt.Fprintf(w, `{"result":{"sid":%q}}`, sid)
+	case "/dyn/getValues.json":
+		if !ti.sessions[sid] {
+			fmt.Fprint(w, `{"err":401}`)
+			return
+		}
+		fmt.Fprintf(w, `{"result":%s}`, ti.Values)
+	case "/dyn/logout.json":
+		if !ti.sessions[sid] {
+			fmt.Fprint(w, `{"err":401}`)
+			return
+		}
+		delete(ti.sessions, sid)
+		fmt.Fprint(w, `{"result":{"isLogin":false}}`)
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// expire forgets every session, like the inverter does after a few idle minutes
+func (ti *TestInverter) expire() {
+	ti.mu.Lock()
+	defer ti.mu.Unlock()
+	ti.sessions = map[string]bool{}
+}
+
+const testValues = `{"0199-B32F1234":{
+	"6100_40263F00":{"1":[{"val":2845}]},
+	"6400_00262200":{"1":[{"val":10234}]},
+	"6400_00260100":{"1":[{"val":18735021}]},
+	"6100_00464800":{"1":[{"val":24012}]},
+	"6180_08214800":{"1":[{"val":[{"tag":307}]}]}
+}}`
+
+func TestWebconnectSessions(t *testing.T) {
+	assert := assert.New(t)
+
+	inverter := &TestInverter{Password: "s3cr3t", Slots: 2, Values: testValues}
+	ts := httptest.NewServer(inverter)
+	defer ts.Close()
+	client := NewWebconnect(ts.URL+"/", "s3cr3t", false)
+
+	// the session is reused between requests
+	for i := 0; i < 3; i++ {
+		values, err := client.Values(keys())
+		assert.NoError(err)
+		assert.Contains(values, "0199-B32F1234")
+	}
+	assert.Equal(1, inverter.logins)
+
+	// and renewed when it expires
+	inverter.expire()
+	_, err := client.Values(keys())
+	assert.NoError(err)
+	assert.Equal(2, inverter.logins)
+	assert.Len(inverter.sessions, 1)
+
+	// logging out frees the slot
+	assert.NoError(client.Logout())
+	assert.Len(inverter.sessions, 0)
+	assert.NoError(client.Logout(), "logging out again does nothing")
+
+	// a session that expired doesn't need logging out
+	_, err = client.Values(keys())
+	assert.NoError(err)
+	inverter.expire()
+	assert.NoError(client.Logout())
+}
+
+func TestWebconnectLoginErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	inverter := &TestInverter{Password: "s3cr3t", Slots: 1, Values: testValues}
+	ts := httptest.NewServer(inverter)
+	defer ts.Close()
+
+	_, err := NewWebconnect(ts.URL, "wrong", false).Values(keys())
+	assert.ErrorContains(err, "wrong password")
+
+	first := NewWebconnect(ts.URL, "s3cr3t", false)
+	_, err = first.Values(keys())
+	assert.NoError(err)
+	_, err = NewWebconnect(ts.URL, "s3cr3t", false).Values(keys())
+	assert.ErrorIs(err, ErrNoSessions)
+}
+
+func TestPoll(t *testing.T) {
+	assert := assert.New(t)
+
+	// setup
+	inverter := &TestInverter{Password: "s3cr3t", Slots: 1, Values: testValues}
+	ts := httptest.NewServer(inverter)
+	defer ts.Close()
+	client := NewWebconnect(ts.URL, "s3cr3t", false)
+	reg := prometheus.NewRegistry()
+	metrics := NewMetrics(reg)
+	refresh := make(chan time.Time, 1000)
+
+	assert.NoError(poll(client, metrics, refresh))
+	assert.Len(refresh, 1)
+	body := exportertest.Scrape(t, reg)
+	labels := `{inverter="0199-B32F1234"}`
+	assert.Contains(body, "sma_ac_power_watts"+labels+" 2845")
+	assert.Contains(body, "sma_daily_yield_watt_hours"+labels+" 10234")
+	assert.Contains(body, "sma_total_yield_watt_hours"+labels+" 1.8735021e+07")
+	assert.Contains(body, "sma_grid_voltage_volts"+labels+" 240.12")
+	assert.Contains(body, "sma_inverter_status_code"+labels+" 307")
+	assert.Contains(body, `sma_inverter_status{inverter="0199-B32F1234",status="ok"} 1`)
+
+	// at night, power is null, and the status changes
+	inverter.Values = `{"0199-B32F1234":{
+		"6100_40263F00":{"1":[{"val":null}]},
+		"6400_00262200":{"1":[{"val":18420}]},
+		"6400_00260100":{"1":[{"val":null}]},
+		"6180_08214800":{"1":[{"val":[{"tag":303}]}]}
+	}}`
+	assert.NoError(poll(client, metrics, refresh))
+	body = exportertest.Scrape(t, reg)
+	assert.Contains(body, "sma_ac_power_watts"+labels+" 0", "null power is zero")
+	assert.Contains(body, "sma_total_yield_watt_hours"+labels+" 1.8735021e+07", "null yields aren't zeroed")
+	assert.Contains(body, "sma_daily_yield_watt_hours"+labels+" 18420")
+	assert.Contains(body, `sma_inverter_status{inverter="0199-B32F1234",status="off"} 1`)
+	assert.NotContains(body, `status="ok"`)
+
+	// failures are counted
+	ts.Close()
+	assert.Error(poll(client, metrics, refresh))
+	assert.Contains(exportertest.Scrape(t, reg), "sma_request_errors_total 1")
+}
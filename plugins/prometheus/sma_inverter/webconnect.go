@@ -0,0 +1,191 @@
+package main
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Webconnect error codes
+const (
+	errSessionExpired = 401
+	errNoSessions     = 503
+)
+
+// ErrNoSessions is returned when the inverter has no free session slots, usually because earlier sessions
+// weren't logged out. They expire after a few minutes.
+var ErrNoSessions = errors.New("no free sessions on the inverter")
+
+// Webconnect is a client for the web API of an SMA inverter. It logs in when needed, logs in again when its
+// session expires, and must be logged out of, so the inverter's few session slots aren't used up.
+type Webconnect struct {
+	URL      string
+	Password string
+	// Group is the user group to log in as, "usr" or "istl" (installer)
+	Group string
+	HTTP  *http.Client
+
+	mu  sync.Mutex
+	sid string
+}
+
+// NewWebconnect sets up a client for the inverter at url
+func NewWebconnect(url string, password string, insecure bool) *Webconnect {
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	// inverters serve HTTPS with a self-signed certificate
+	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: insecure}
+	return &Webconnect{
+		URL:      strings.TrimSuffix(url, "/"),
+		Password: password,
+		Group:    "usr",
+		HTTP:     &http.Client{Timeout: 10 * time.Second, Transport: transport},
+	}
+}
+
+// webconnectResponse is the envelope of every response. Err is set instead of Result on failure.
+type webconnectResponse struct {
+	Result json.RawMessage `json:"result"`
+	Err    int             `json:"err"`
+}
+
+// Value is a single value of a key. Val is a number, null when the inverter has no value (like at night),
+// or a list of tags for enumerations like the status.
+type Value struct {
+	Val json.RawMessage `json:"val"`
+}
+
+// Number returns the value as a number, if it is one
+func (v Value) Number() (float64, bool) {
+	var f *float64
+	if err := json.Unmarshal(v.Val, &f); err != nil || f == nil {
+		return 0, false
+	}
+	return *f, true
+}
+
+// IsNull checks if the inverter has no value
+func (v Value) IsNull() bool {
+	return len(v.Val) == 0 || string(v.Val) == "null"
+}
+
+// Tag returns the first tag of an enumerated value, if it is one
+func (v Value) Tag() (int, bool) {
+	var tags []struct {
+		Tag int `json:"tag"`
+	}
+	if err := json.Unmarshal(v.Val, &tags); err != nil || len(tags) == 0 {
+		return 0, false
+	}
+	return tags[0].Tag, true
+}
+
+// Values are the values of keys for each device (inverter) behind the web API, by device then key. Keys can
+// have several values, like one per phase.
+type Values map[string]map[string]map[string][]Value
+
+// post sends a request to the web API, and decodes its result into v
+func (w *Webconnect) post(path string, body interface{}, v interface{}) error {
+	b, err := json.Marshal(body)
+	if err != nil {
+		return err
+	}
+	resp, err := w.HTTP.Post(w.URL+path, "application/json", bytes.NewReader(b))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("unexpected status: %s", resp.Status)
+	}
+
+	var r webconnectResponse
+	if err := json.NewDecoder(resp.Body).Decode(&r); err != nil {
+		return fmt.Errorf("unable to decode JSON: %w", err)
+	}
+	if r.Err != 0 {
+		return &webconnectError{Code: r.Err}
+	}
+	if v == nil {
+		return nil
+	}
+	return json.Unmarshal(r.Result, v)
+}
+
+type webconnectError struct {
+	Code int
+}
+
+func (e *webconnectError) Error() string {
+	return fmt.Sprintf("inverter returned error %d", e.Code)
+}
+
+func isCode(err error, code int) bool {
+	var we *webconnectError
+	return errors.As(err, &we) && we.Code == code
+}
+
+// login starts a session, if there isn't one already. The caller holds mu.
+func (w *Webconnect) login() error {
+	if len(w.sid) > 0 {
+		return nil
+	}
+	var result struct {
+		SID string `json:"sid"`
+	}
+	err := w.post("/dyn/login.json", map[string]string{"right": w.Group, "pass": w.Password}, &result)
+	if isCode(err, errNoSessions) {
+		return ErrNoSessions
+	}
+	if err != nil {
+		return fmt.Errorf("unable to log in: %w", err)
+	}
+	if len(result.SID) == 0 {
+		return errors.New("unable to log in: wrong password?")
+	}
+	w.sid = result.SID
+	return nil
+}
+
+// Values gets the values of keys, logging in first if needed, and again if the session has expired
+func (w *Webconnect) Values(keys []string) (Values, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	body := map[string]interface{}{"destDev": []string{}, "keys": keys}
+	var values Values
+	for attempt := 0; attempt < 2; attempt++ {
+		if err := w.login(); err != nil {
+			return nil, err
+		}
+		err := w.post("/dyn/getValues.json?sid="+w.sid, body, &values)
+		if isCode(err, errSessionExpired) {
+			// the inverter already forgot the session, so there's nothing to log out of
+			w.sid = ""
+			continue
+		}
+		return values, err
+	}
+	return nil, errors.New("session expired straight after logging in")
+}
+
+// Logout ends the session, freeing its slot on the inverter
+func (w *Webconnect) Logout() error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if len(w.sid) == 0 {
+		return nil
+	}
+	err := w.post("/dyn/logout.json?sid="+w.sid, map[string]string{}, nil)
+	w.sid = ""
+	if isCode(err, errSessionExpired) {
+		return nil
+	}
+	return err
+}
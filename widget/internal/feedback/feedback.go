@@ -22,6 +22,16 @@ func NewSignal(metric string) Signal {
 	return Signal{time.Now(), true, metric, nil}
 }
 
+// Collect closes a channel of buffered signals, and returns the signals in it
+func Collect(sigs chan Signal) []Signal {
+	close(sigs)
+	var signals []Signal
+	for s := range sigs {
+		signals = append(signals, s)
+	}
+	return signals
+}
+
 // Status represents the current status of polling data sources
 type Status struct {
 	Ok      bool
@@ -32,7 +42,7 @@ type Status struct {
 //
 // The status is used by the HTTP endpoint when rendering responses.
 //
-// The only data collector right now is Prometheus.
+// Data collectors are the sources registered with source.PollForSamples.
 func ProcessSignals(sigs chan Signal, status *Status) {
 	metrics := map[string]Signal{}
 	for {
@@ -13,7 +13,7 @@ import (
 	"github.com/shopspring/decimal"
 )
 
-// Samples is a map of the latest metric samples (currently from Prometheus)
+// Samples is a map of the latest metric samples, from any data source
 type Samples map[string]float64
 
 // HandleWidgetQuery handles rendering a widget in the WCS widget.json format
@@ -80,6 +80,14 @@ func addDataFromSamples(w widget.Widget, s *Samples) widget.Widget {
 			vs = v.RoundDown(1).String()
 		}
 		w.Data[k] = fmt.Sprintf("%s%s", vs, c.DisplayUnit)
+
+		if c.Tendency {
+			// there's no tendency until there's enough history to work it out
+			w.Data[k+widget.TendencySuffix] = ""
+			if change, ok := (*s)[k+widget.TendencySuffix]; ok && !math.IsNaN(change) {
+				w.Data[k+widget.TendencySuffix] = widget.Tendency(change)
+			}
+		}
 	}
 	return w
 }
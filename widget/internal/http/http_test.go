@@ -64,7 +64,7 @@ func TestWidgetsHasData(t *testing.T) {
 	ws, err := widget.LoadWidgets("testdata/config.toml")
 	assert.NoError(err)
 	var s Samples
-	st := feedback.Status{true, ""}
+	st := feedback.Status{Ok: true, Message: ""}
 	HandleWidgetQuery(ws, &s, &st)(w, r)
 	res := w.Result()
 
@@ -77,7 +77,7 @@ func TestWidgetsHasData(t *testing.T) {
 	assert.NotEmpty(widget.Name)
 	assert.NotEmpty(widget.Description)
 	assert.NotEmpty(widget.Data)
-	for _, k := range []string{"content_url", "temperature", "humidity", "wind_gust", "rainfall"} {
+	for _, k := range []string{"content_url", "temperature", "humidity", "wind_gust", "rainfall", "pressure"} {
 		t.Run(k, func(t *testing.T) {
 			assert.NotEmpty(widget.Data[k])
 		})
@@ -120,7 +120,7 @@ func TestWidgetsUsesDataRefs(t *testing.T) {
 	ws, err := widget.LoadWidgets("testdata/config.toml")
 	assert.NoError(err)
 	var s Samples
-	st := feedback.Status{true, ""}
+	st := feedback.Status{Ok: true, Message: ""}
 	HandleWidgetQuery(ws, &s, &st)(w, r)
 	res := w.Result()
 
@@ -163,8 +163,8 @@ func TestWidgetsUsesLatestSamples(t *testing.T) {
 	r := httptest.NewRequest("GET", "http://a.test/widgets/sydney?token=s3cr3t", nil)
 	ws, err := widget.LoadWidgets("testdata/config.toml")
 	assert.NoError(err)
-	s := Samples{"temperature": 30.2, "humidity": 50, "rainfall": 1.2, "wind_gust": 3.6}
-	st := feedback.Status{true, ""}
+	s := Samples{"temperature": 30.2, "humidity": 50, "rainfall": 1.2, "wind_gust": 3.6, "pressure": 1013.2}
+	st := feedback.Status{Ok: true, Message: ""}
 	HandleWidgetQuery(ws, &s, &st)(w, r)
 	res := w.Result()
 
@@ -178,6 +178,11 @@ func TestWidgetsUsesLatestSamples(t *testing.T) {
 	assert.Greater(len(widget.Data), 1)
 	assert.NotEmpty(widget.Data["content_url"])
 	for k, v := range widget.Data {
+		// tendencies are words, and there isn't one yet
+		if k == "pressure_tendency" {
+			assert.Empty(v)
+			continue
+		}
 		if k != "content_url" {
 			vs := regexp.MustCompile(`\d+.?\d+?`).FindString(v)
 			d, err := strconv.ParseFloat(vs, 64)
@@ -265,7 +270,7 @@ func TestWidgetsUsesColorsForThresholds(t *testing.T) {
 			w := httptest.NewRecorder()
 			r := httptest.NewRequest("GET", "http://a.test/widgets/sydney?token=s3cr3t", nil)
 			s := Samples{tc.metric: tc.value, "humidity": 0, "rainfall": 0, "wind_gust": 0}
-			st := feedback.Status{true, ""}
+			st := feedback.Status{Ok: true, Message: ""}
 			HandleWidgetQuery(ws, &s, &st)(w, r)
 			res := w.Result()
 
@@ -356,3 +361,35 @@ func TestValueFormatting(t *testing.T) {
 		})
 	}
 }
+
+func TestPressureTendency(t *testing.T) {
+	assert := assert.New(t)
+	ws, err := widget.LoadWidgets("testdata/config.toml")
+	assert.NoError(err)
+	wdgt := ws[0]
+	assert.Equal(58.0, wdgt.StationAltitude)
+	assert.True(wdgt.Metrics["pressure"].SeaLevel)
+
+	var tests = []struct {
+		change float64
+		expect string
+	}{
+		{2.4, "rising"},
+		{1.0, "rising"},
+		{0.9, "steady"},
+		{0, "steady"},
+		{-0.9, "steady"},
+		{-1.0, "falling"},
+		{-5.1, "falling"},
+		{math.NaN(), ""},
+	}
+
+	for _, tc := range tests {
+		t.Run(fmt.Sprintf("%.1f", tc.change), func(t *testing.T) {
+			samples := Samples{"pressure": 1013.2, "pressure_tendency": tc.change}
+			w := addDataFromSamples(wdgt, &samples)
+			assert.Equal("1013.2 hPa", w.Data["pressure"])
+			assert.Equal(tc.expect, w.Data["pressure_tendency"])
+		})
+	}
+}
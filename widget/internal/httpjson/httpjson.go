@@ -0,0 +1,158 @@
+package httpjson
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	h "github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/jsonpath"
+	"github.com/auxesis/meteo/widget/internal/widget"
+)
+
+// DefaultTimeout is how long to wait for a response when a metric doesn't set a timeout
+const DefaultTimeout = 10 * time.Second
+
+// Source fetches samples from arbitrary JSON APIs, extracting values with a JSON path
+type Source struct {
+	client     *http.Client
+	mu         sync.Mutex
+	fetched    map[string]time.Time
+	subscribed map[string]bool
+}
+
+// NewSource initialises a Source
+func NewSource() *Source {
+	return &Source{client: &http.Client{}, fetched: map[string]time.Time{}, subscribed: map[string]bool{}}
+}
+
+// Subscribe fetches each metric with a poll interval on its own ticker, and pushes its samples to updates.
+//
+// Metrics without a poll interval are fetched on every widget poll instead.
+func (s *Source) Subscribe(metrics map[string]widget.MetricConfig, updates chan h.Samples, sigs chan feedback.Signal) error {
+	for k, v := range metrics {
+		if v.PollInterval <= 0 {
+			continue
+		}
+		s.mu.Lock()
+		s.subscribed[k] = true
+		s.mu.Unlock()
+		go s.poll(k, v, updates, sigs)
+	}
+	return nil
+}
+
+// poll fetches a metric every poll interval
+func (s *Source) poll(k string, v widget.MetricConfig, updates chan h.Samples, sigs chan feedback.Signal) {
+	ticker := time.NewTicker(v.PollInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		if samples := s.fetch(map[string]widget.MetricConfig{k: v}, sigs); len(samples) > 0 {
+			updates <- samples
+		}
+	}
+}
+
+// Fetch requests each metric that's due: metrics without a poll interval every time, and metrics with one
+// when they haven't been fetched successfully, so a failed fetch is retried on the next widget poll rather
+// than waiting for the metric's own ticker.
+func (s *Source) Fetch(metrics map[string]widget.MetricConfig) (h.Samples, []feedback.Signal) {
+	now := time.Now()
+	due := map[string]widget.MetricConfig{}
+	s.mu.Lock()
+	for k, v := range metrics {
+		fetched, ok := s.fetched[k]
+		switch {
+		case s.subscribed[k]:
+			if !ok {
+				due[k] = v
+			}
+		case now.Sub(fetched) >= v.PollInterval:
+			due[k] = v
+		}
+	}
+	s.mu.Unlock()
+
+	sigs := make(chan feedback.Signal, len(due))
+	samples := s.fetch(due, sigs)
+	return samples, feedback.Collect(sigs)
+}
+
+// fetch requests metrics, and records when the ones that succeeded were fetched
+func (s *Source) fetch(metrics map[string]widget.MetricConfig, sigs chan feedback.Signal) h.Samples {
+	now := time.Now()
+	samples := fetchHTTPJSON(s.client, metrics, sigs)
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for k := range metrics {
+		if _, ok := samples[k]; ok {
+			s.fetched[k] = now
+		} else {
+			delete(s.fetched, k)
+		}
+	}
+	return samples
+}
+
+func fetchHTTPJSON(client *http.Client, metrics map[string]widget.MetricConfig, sigs chan feedback.Signal) h.Samples {
+	samples := make(h.Samples)
+	for k, v := range metrics {
+		log.Printf("debug: fetching %s from %s\n", k, v.HTTPURL)
+		body, err := get(client, v)
+		if err != nil {
+			log.Printf("error: unable to fetch %s: %s\n", k, err)
+			sigs <- feedback.NewSignalWithError(k, err)
+			continue
+		}
+		f, err := jsonpath.Float(body, v.JSONPath)
+		if err != nil {
+			err = fmt.Errorf("unable to read %s from %s (%s): %w", k, v.HTTPURL, v.JSONPath, err)
+			log.Printf("error: %s\n", err)
+			sigs <- feedback.NewSignalWithError(k, err)
+			continue
+		}
+		samples[k] = f
+		sigs <- feedback.NewSignal(k)
+	}
+	return samples
+}
+
+// get requests the URL for a metric, with its headers, credentials, and timeout
+func get(client *http.Client, m widget.MetricConfig) ([]byte, error) {
+	timeout := m.Timeout
+	if timeout == 0 {
+		timeout = DefaultTimeout
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.HTTPURL, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/json")
+	for k, v := range m.HTTPHeaders {
+		req.Header.Set(k, v)
+	}
+	switch {
+	case len(m.HTTPBearerToken) > 0:
+		req.Header.Set("Authorization", "Bearer "+m.HTTPBearerToken)
+	case len(m.HTTPUsername) > 0:
+		req.SetBasicAuth(m.HTTPUsername, m.HTTPPassword)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from %s: %s", m.HTTPURL, resp.Status)
+	}
+	return io.ReadAll(resp.Body)
+}
@@ -0,0 +1,197 @@
+package httpjson
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	h "github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/widget"
+	"github.com/stretchr/testify/assert"
+)
+
+const bom = `{"observations":{"data":[{"name":"Gosford","air_temp":21.3,"rel_hum":68,"press":null}]}}`
+
+func TestHTTPJSONFeedbackIsSentWhenOk(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("meteo/1.0", r.Header.Get("User-Agent"))
+		assert.Equal("Bearer t0k3n", r.Header.Get("Authorization"))
+		fmt.Fprint(w, bom)
+	}))
+	defer ts.Close()
+
+	metrics := map[string]widget.MetricConfig{
+		"temperature": {HTTPURL: ts.URL, JSONPath: "$.observations.data[0].air_temp", HTTPHeaders: map[string]string{"User-Agent": "meteo/1.0"}, HTTPBearerToken: "t0k3n"},
+		"humidity":    {HTTPURL: ts.URL, JSONPath: "$.observations.data[0].rel_hum", HTTPHeaders: map[string]string{"User-Agent": "meteo/1.0"}, HTTPBearerToken: "t0k3n"},
+	}
+	sigs := make(chan feedback.Signal, 2)
+
+	samples := fetchHTTPJSON(http.DefaultClient, metrics, sigs)
+
+	assert.Equal(21.3, samples["temperature"])
+	assert.Equal(68.0, samples["humidity"])
+	assert.Len(sigs, 2)
+	for len(sigs) > 0 {
+		assert.True((<-sigs).Ok)
+	}
+}
+
+func TestHTTPJSONUsesBasicAuth(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user, pass, ok := r.BasicAuth()
+		if !ok || user != "installer" || pass != "s3cr3t" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		fmt.Fprint(w, `{"result":{"pac":1523}}`)
+	}))
+	defer ts.Close()
+
+	metrics := map[string]widget.MetricConfig{"solar": {HTTPURL: ts.URL, JSONPath: "result.pac", HTTPUsername: "installer", HTTPPassword: "s3cr3t"}}
+	sigs := make(chan feedback.Signal, 1)
+
+	samples := fetchHTTPJSON(http.DefaultClient, metrics, sigs)
+
+	assert.Equal(1523.0, samples["solar"])
+	assert.True((<-sigs).Ok)
+}
+
+func TestHTTPJSONFeedbackIsSentWhenFailing(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/forbidden":
+			w.WriteHeader(http.StatusForbidden)
+		case "/slow":
+			time.Sleep(100 * time.Millisecond)
+			fmt.Fprint(w, bom)
+		default:
+			fmt.Fprint(w, bom)
+		}
+	}))
+	defer ts.Close()
+
+	tests := []struct {
+		metric widget.MetricConfig
+		expect string
+	}{
+		{widget.MetricConfig{HTTPURL: ts.URL + "/forbidden", JSONPath: "$.observations.data[0].air_temp"}, "403 Forbidden"},
+		{widget.MetricConfig{HTTPURL: ts.URL + "/slow", JSONPath: "$.observations.data[0].air_temp", Timeout: time.Millisecond}, "context deadline exceeded"},
+		{widget.MetricConfig{HTTPURL: ts.URL, JSONPath: "$.observations.data[0].press"}, "path not found"},
+		{widget.MetricConfig{HTTPURL: ts.URL, JSONPath: "$.observations.data[0].name"}, "unable to read pressure"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.expect, func(t *testing.T) {
+			sigs := make(chan feedback.Signal, 1)
+			samples := fetchHTTPJSON(http.DefaultClient, map[string]widget.MetricConfig{"pressure": tc.metric}, sigs)
+			assert.Empty(samples)
+			f := <-sigs
+			assert.False(f.Ok)
+			assert.Contains(f.Error.Error(), tc.expect)
+		})
+	}
+}
+
+func TestHTTPJSONHonoursPollInterval(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests int
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprint(w, bom)
+	}))
+	defer ts.Close()
+
+	s := NewSource()
+	metrics := map[string]widget.MetricConfig{
+		"temperature": {HTTPURL: ts.URL, JSONPath: "$.observations.data[0].air_temp", PollInterval: time.Hour},
+		"humidity":    {HTTPURL: ts.URL, JSONPath: "$.observations.data[0].rel_hum"},
+	}
+
+	samples, sigs := s.Fetch(metrics)
+	assert.Len(samples, 2)
+	assert.Len(sigs, 2)
+	assert.Equal(2, requests)
+
+	samples, sigs = s.Fetch(metrics)
+	assert.Len(samples, 1)
+	assert.Contains(samples, "humidity")
+	assert.Len(sigs, 1)
+	assert.Equal(3, requests)
+}
+
+func TestHTTPJSONRetriesFailuresOnNextPoll(t *testing.T) {
+	assert := assert.New(t)
+
+	failing := true
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if failing {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		fmt.Fprint(w, bom)
+	}))
+	defer ts.Close()
+
+	s := NewSource()
+	metrics := map[string]widget.MetricConfig{
+		"temperature": {HTTPURL: ts.URL, JSONPath: "$.observations.data[0].air_temp", PollInterval: time.Hour},
+	}
+
+	samples, sigs := s.Fetch(metrics)
+	assert.Empty(samples)
+	assert.False(sigs[0].Ok)
+
+	// the failure doesn't count as a fetch, so it's retried straight away
+	failing = false
+	samples, _ = s.Fetch(metrics)
+	assert.Equal(21.3, samples["temperature"])
+	samples, _ = s.Fetch(metrics)
+	assert.Empty(samples)
+}
+
+func TestHTTPJSONSubscribePollsOnOwnTicker(t *testing.T) {
+	assert := assert.New(t)
+
+	var requests atomic.Int32
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests.Add(1)
+		fmt.Fprint(w, bom)
+	}))
+	defer ts.Close()
+
+	s := NewSource()
+	metrics := map[string]widget.MetricConfig{
+		"temperature": {HTTPURL: ts.URL, JSONPath: "$.observations.data[0].air_temp", PollInterval: 10 * time.Millisecond},
+		"humidity":    {HTTPURL: ts.URL, JSONPath: "$.observations.data[0].rel_hum"},
+	}
+	updates := make(chan h.Samples, 100)
+	sigs := make(chan feedback.Signal, 100)
+	assert.NoError(s.Subscribe(metrics, updates, sigs))
+
+	// the first widget poll fetches everything, and later ones leave subscribed metrics to their ticker
+	samples, _ := s.Fetch(metrics)
+	assert.Len(samples, 2)
+	samples, _ = s.Fetch(metrics)
+	assert.Equal(h.Samples{"humidity": 68}, samples)
+
+	// metrics are pushed more often than the widget polls
+	for i := 0; i < 3; i++ {
+		select {
+		case update := <-updates:
+			assert.Equal(h.Samples{"temperature": 21.3}, update)
+		case <-time.After(time.Second):
+			assert.Fail("no update pushed")
+		}
+	}
+	assert.GreaterOrEqual(requests.Load(), int32(6))
+}
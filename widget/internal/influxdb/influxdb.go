@@ -0,0 +1,287 @@
+package influxdb
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	h "github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/widget"
+)
+
+// DefaultMaxAge is how old the latest point can be before it's considered stale.
+//
+// This matches the lookback window Prometheus uses before a series goes stale.
+const DefaultMaxAge = 5 * time.Minute
+
+// errNoData is returned when a query succeeds but returns no points
+var errNoData = errors.New("no data")
+
+// Source fetches samples by querying an InfluxDB server with InfluxQL or Flux
+type Source struct {
+	client *http.Client
+	config widget.InfluxDBConfig
+}
+
+// NewSource initialises a Source that queries the InfluxDB server in config
+func NewSource(config widget.InfluxDBConfig) *Source {
+	if config.MaxAge == 0 {
+		config.MaxAge = DefaultMaxAge
+	}
+	return &Source{client: &http.Client{Timeout: 10 * time.Second}, config: config}
+}
+
+// Fetch queries InfluxDB for the latest point of each metric
+func (s *Source) Fetch(metrics map[string]widget.MetricConfig) (h.Samples, []feedback.Signal) {
+	sigs := make(chan feedback.Signal, len(metrics))
+	samples := fetchInfluxDB(s.client, s.config, metrics, sigs)
+	return samples, feedback.Collect(sigs)
+}
+
+func fetchInfluxDB(client *http.Client, config widget.InfluxDBConfig, metrics map[string]widget.MetricConfig, sigs chan feedback.Signal) h.Samples {
+	samples := make(h.Samples)
+	log.Printf("debug: polling InfluxDB\n")
+	for k, v := range metrics {
+		var (
+			value float64
+			t     time.Time
+			err   error
+			query string
+		)
+		switch {
+		case len(v.FluxQuery) > 0:
+			query = v.FluxQuery
+			value, t, err = queryFlux(client, config, query)
+		case len(v.InfluxQLQuery) > 0:
+			query = v.InfluxQLQuery
+			value, t, err = queryInfluxQL(client, config, query)
+		default:
+			err = fmt.Errorf("no influxql_query or flux_query for %s", k)
+		}
+
+		if errors.Is(err, errNoData) {
+			err = fmt.Errorf("no data from InfluxDB when querying %s (%s)", k, query)
+			log.Printf("warning: %s\n", err)
+			sigs <- feedback.NewSignalWithError(k, err)
+			continue
+		}
+		if err != nil {
+			log.Printf("error: unable to query InfluxDB: %s\n", err)
+			sigs <- feedback.NewSignalWithError(k, err)
+			continue
+		}
+		if age := time.Since(t); age > config.MaxAge {
+			err := fmt.Errorf("stale data from InfluxDB when querying %s (%s old)", k, age.Round(time.Second))
+			log.Printf("warning: %s\n", err)
+			sigs <- feedback.NewSignalWithError(k, err)
+			continue
+		}
+		samples[k] = value
+		sigs <- feedback.NewSignal(k)
+	}
+	return samples
+}
+
+// influxQLResponse is a response from the InfluxDB 1.x /query endpoint
+type influxQLResponse struct {
+	Results []struct {
+		Series []struct {
+			Columns []string        `json:"columns"`
+			Values  [][]json.Number `json:"values"`
+		} `json:"series"`
+		Error string `json:"error"`
+	} `json:"results"`
+	Error string `json:"error"`
+}
+
+// queryInfluxQL runs an InfluxQL query, and returns the last value of the first series
+func queryInfluxQL(client *http.Client, config widget.InfluxDBConfig, query string) (float64, time.Time, error) {
+	var t time.Time
+	params := url.Values{}
+	params.Set("db", config.Database)
+	params.Set("q", query)
+	params.Set("epoch", "ms")
+	req, err := http.NewRequest(http.MethodGet, strings.TrimRight(config.URL, "/")+"/query?"+params.Encode(), nil)
+	if err != nil {
+		return 0, t, err
+	}
+	authorize(req, config)
+
+	body, err := do(client, req)
+	if err != nil {
+		return 0, t, err
+	}
+
+	var r influxQLResponse
+	d := json.NewDecoder(bytes.NewReader(body))
+	d.UseNumber()
+	if err := d.Decode(&r); err != nil {
+		return 0, t, fmt.Errorf("unable to decode InfluxQL response: %w", err)
+	}
+	if len(r.Error) > 0 {
+		return 0, t, errors.New(r.Error)
+	}
+	if len(r.Results) == 0 {
+		return 0, t, errNoData
+	}
+	if len(r.Results[0].Error) > 0 {
+		return 0, t, errors.New(r.Results[0].Error)
+	}
+	if len(r.Results[0].Series) == 0 {
+		return 0, t, errNoData
+	}
+
+	series := r.Results[0].Series[0]
+	timeCol, valueCol := -1, -1
+	for i, c := range series.Columns {
+		if c == "time" {
+			timeCol = i
+		} else if valueCol < 0 {
+			valueCol = i
+		}
+	}
+	if timeCol < 0 || valueCol < 0 || len(series.Values) == 0 {
+		return 0, t, errNoData
+	}
+
+	row := series.Values[len(series.Values)-1]
+	if len(row) <= timeCol || len(row) <= valueCol || len(row[valueCol]) == 0 {
+		return 0, t, errNoData
+	}
+	ms, err := row[timeCol].Int64()
+	if err != nil {
+		return 0, t, fmt.Errorf("unable to parse time from InfluxDB: %w", err)
+	}
+	v, err := strconv.ParseFloat(row[valueCol].String(), 64)
+	if err != nil {
+		return 0, t, err
+	}
+	return v, time.UnixMilli(ms), nil
+}
+
+// queryFlux runs a Flux query, and returns the value of the last row
+func queryFlux(client *http.Client, config widget.InfluxDBConfig, query string) (float64, time.Time, error) {
+	var t time.Time
+	params := url.Values{}
+	params.Set("org", config.Org)
+	req, err := http.NewRequest(http.MethodPost, strings.TrimRight(config.URL, "/")+"/api/v2/query?"+params.Encode(), strings.NewReader(query))
+	if err != nil {
+		return 0, t, err
+	}
+	req.Header.Set("Content-Type", "application/vnd.flux")
+	req.Header.Set("Accept", "application/csv")
+	authorize(req, config)
+
+	body, err := do(client, req)
+	if err != nil {
+		return 0, t, err
+	}
+
+	r := csv.NewReader(bytes.NewReader(body))
+	r.FieldsPerRecord = -1
+	r.Comment = '#'
+	timeCol, valueCol := -1, -1
+	// the value and time of the last row, taken as it's read, as each table has its own columns
+	var lastValue, lastTime string
+	var found, hasTime bool
+	for {
+		record, err := r.Read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return 0, t, fmt.Errorf("unable to decode Flux response: %w", err)
+		}
+		if isFluxHeader(record) {
+			timeCol, valueCol = -1, -1
+			for i, c := range record {
+				switch c {
+				case "_time":
+					timeCol = i
+				case "_value":
+					valueCol = i
+				}
+			}
+			continue
+		}
+		if valueCol >= 0 && len(record) > valueCol {
+			found = true
+			lastValue = record[valueCol]
+			hasTime = timeCol >= 0 && len(record) > timeCol
+			if hasTime {
+				lastTime = record[timeCol]
+			}
+		}
+	}
+	if !found || len(lastValue) == 0 {
+		return 0, t, errNoData
+	}
+
+	v, err := strconv.ParseFloat(lastValue, 64)
+	if err != nil {
+		return 0, t, err
+	}
+	if !hasTime {
+		return 0, t, errors.New("no _time column in Flux response")
+	}
+	t, err = time.Parse(time.RFC3339Nano, lastTime)
+	if err != nil {
+		return 0, t, fmt.Errorf("unable to parse time from InfluxDB: %w", err)
+	}
+	return v, t, nil
+}
+
+// isFluxHeader checks if a CSV record is the header row of a Flux table
+func isFluxHeader(record []string) bool {
+	for _, c := range record {
+		if c == "_value" || c == "result" {
+			return true
+		}
+	}
+	return false
+}
+
+// authorize adds credentials from config to a request
+func authorize(req *http.Request, config widget.InfluxDBConfig) {
+	switch {
+	case len(config.Token) > 0:
+		req.Header.Set("Authorization", "Token "+config.Token)
+	case len(config.Username) > 0:
+		req.SetBasicAuth(config.Username, config.Password)
+	}
+}
+
+// do sends a request to InfluxDB, and returns the body of a successful response
+func do(client *http.Client, req *http.Request) ([]byte, error) {
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		var e struct {
+			Message string `json:"message"`
+			Error   string `json:"error"`
+		}
+		if json.Unmarshal(body, &e) == nil && len(e.Message+e.Error) > 0 {
+			return nil, fmt.Errorf("InfluxDB returned %s: %s", resp.Status, e.Message+e.Error)
+		}
+		return nil, fmt.Errorf("InfluxDB returned %s", resp.Status)
+	}
+	return body, nil
+}
@@ -0,0 +1,219 @@
+package influxdb
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	"github.com/auxesis/meteo/widget/internal/widget"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestInfluxQLFeedbackIsSentWhenOk(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UnixMilli()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal("/query", r.URL.Path)
+		assert.Equal("collectd", r.URL.Query().Get("db"))
+		assert.Equal("ms", r.URL.Query().Get("epoch"))
+		user, pass, ok := r.BasicAuth()
+		assert.True(ok)
+		assert.Equal("meteo", user)
+		assert.Equal("s3cr3t", pass)
+		fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"digitemp_value","columns":["time","last"],"values":[[%d,17.5],[%d,18.25]]}]}]}`, now-60000, now)
+	}))
+	defer ts.Close()
+
+	config := widget.InfluxDBConfig{URL: ts.URL, Database: "collectd", Username: "meteo", Password: "s3cr3t", MaxAge: DefaultMaxAge}
+	metrics := map[string]widget.MetricConfig{"temperature": {InfluxQLQuery: `SELECT last("value") FROM "digitemp_value"`}}
+	sigs := make(chan feedback.Signal, 1)
+
+	samples := fetchInfluxDB(http.DefaultClient, config, metrics, sigs)
+
+	assert.Equal(18.25, samples["temperature"])
+	f := <-sigs
+	assert.True(f.Ok)
+	assert.Equal("temperature", f.Metric)
+}
+
+func TestFluxFeedbackIsSentWhenOk(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UTC()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(http.MethodPost, r.Method)
+		assert.Equal("/api/v2/query", r.URL.Path)
+		assert.Equal("home", r.URL.Query().Get("org"))
+		assert.Equal("Token t0k3n", r.Header.Get("Authorization"))
+		assert.Equal("application/vnd.flux", r.Header.Get("Content-Type"))
+		body, _ := io.ReadAll(r.Body)
+		assert.Contains(string(body), `from(bucket: "collectd")`)
+		fmt.Fprintf(w, "#datatype,string,long,dateTime:RFC3339,double,string\r\n"+
+			"#group,false,false,false,false,true\r\n"+
+			"#default,_result,,,,\r\n"+
+			",result,table,_time,_value,_field\r\n"+
+			",,0,%s,17.5,value\r\n"+
+			",,0,%s,18.25,value\r\n\r\n",
+			now.Add(-time.Minute).Format(time.RFC3339Nano), now.Format(time.RFC3339Nano))
+	}))
+	defer ts.Close()
+
+	config := widget.InfluxDBConfig{URL: ts.URL, Org: "home", Token: "t0k3n", MaxAge: DefaultMaxAge}
+	metrics := map[string]widget.MetricConfig{"temperature": {FluxQuery: `from(bucket: "collectd") |> range(start: -1h) |> last()`}}
+	sigs := make(chan feedback.Signal, 1)
+
+	samples := fetchInfluxDB(http.DefaultClient, config, metrics, sigs)
+
+	assert.Equal(18.25, samples["temperature"])
+	f := <-sigs
+	assert.True(f.Ok)
+}
+
+func TestFluxWithSeveralTables(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now().UTC()
+	earlier := now.Add(-time.Minute).Format(time.RFC3339Nano)
+	latest := now.Format(time.RFC3339Nano)
+
+	tests := []struct {
+		name   string
+		body   string
+		expect float64
+	}{
+		{
+			"later table without values",
+			",result,table,_time,_value\r\n" +
+				",,0," + latest + ",18.25\r\n\r\n" +
+				",result,table,_start,count\r\n" +
+				",,1," + earlier + ",42\r\n",
+			18.25,
+		},
+		{
+			"later table with columns in another order",
+			",result,table,_time,_value\r\n" +
+				",,0," + earlier + ",17.5\r\n\r\n" +
+				",result,table,_value,_field,_time\r\n" +
+				",,1,18.25,value," + latest + "\r\n",
+			18.25,
+		},
+		{
+			"later table with a shorter row",
+			",result,table,_start,_time,_value\r\n" +
+				",,0," + earlier + "," + latest + ",18.25\r\n\r\n" +
+				",result,table,_value\r\n" +
+				",,1,\r\n",
+			0,
+		},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				fmt.Fprint(w, tc.body)
+			}))
+			defer ts.Close()
+
+			config := widget.InfluxDBConfig{URL: ts.URL, MaxAge: DefaultMaxAge}
+			metrics := map[string]widget.MetricConfig{"temperature": {FluxQuery: `from(bucket: "collectd") |> last()`}}
+			sigs := make(chan feedback.Signal, 1)
+
+			samples := fetchInfluxDB(http.DefaultClient, config, metrics, sigs)
+
+			f := <-sigs
+			assert.Equal(tc.expect != 0, f.Ok)
+			if tc.expect != 0 {
+				assert.Equal(tc.expect, samples["temperature"])
+			}
+		})
+	}
+}
+
+func TestInfluxDBFeedbackIsSentWhenNoValue(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/query":
+			fmt.Fprintln(w, `{"results":[{"statement_id":0}]}`)
+		default:
+			fmt.Fprint(w, "\r\n")
+		}
+	}))
+	defer ts.Close()
+
+	config := widget.InfluxDBConfig{URL: ts.URL, MaxAge: DefaultMaxAge}
+	metrics := map[string]widget.MetricConfig{
+		"temperature": {InfluxQLQuery: `SELECT last("value") FROM "digitemp_value"`},
+		"humidity":    {FluxQuery: `from(bucket: "collectd") |> range(start: -1h) |> last()`},
+	}
+	sigs := make(chan feedback.Signal, 2)
+
+	samples := fetchInfluxDB(http.DefaultClient, config, metrics, sigs)
+
+	assert.Empty(samples)
+	for len(sigs) > 0 {
+		f := <-sigs
+		assert.False(f.Ok)
+		assert.Contains(f.Error.Error(), "no data from InfluxDB when querying "+f.Metric)
+	}
+}
+
+func TestInfluxDBFeedbackIsSentWhenStale(t *testing.T) {
+	assert := assert.New(t)
+
+	then := time.Now().Add(-time.Hour).UnixMilli()
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, `{"results":[{"statement_id":0,"series":[{"name":"digitemp_value","columns":["time","last"],"values":[[%d,18.25]]}]}]}`, then)
+	}))
+	defer ts.Close()
+
+	config := widget.InfluxDBConfig{URL: ts.URL, MaxAge: DefaultMaxAge}
+	metrics := map[string]widget.MetricConfig{"temperature": {InfluxQLQuery: `SELECT last("value") FROM "digitemp_value"`}}
+	sigs := make(chan feedback.Signal, 1)
+
+	samples := fetchInfluxDB(http.DefaultClient, config, metrics, sigs)
+
+	assert.Empty(samples)
+	f := <-sigs
+	assert.False(f.Ok)
+	assert.Contains(f.Error.Error(), "stale data from InfluxDB when querying temperature")
+}
+
+func TestInfluxDBFeedbackIsSentWhenQueryFails(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/query":
+			fmt.Fprintln(w, `{"results":[{"statement_id":0,"error":"database not found: collectd"}]}`)
+		default:
+			w.WriteHeader(http.StatusUnauthorized)
+			fmt.Fprintln(w, `{"code":"unauthorized","message":"unauthorized access"}`)
+		}
+	}))
+	defer ts.Close()
+
+	config := widget.InfluxDBConfig{URL: ts.URL, MaxAge: DefaultMaxAge}
+	tests := []struct {
+		metric widget.MetricConfig
+		expect string
+	}{
+		{widget.MetricConfig{InfluxQLQuery: `SELECT last("value") FROM "digitemp_value"`}, "database not found: collectd"},
+		{widget.MetricConfig{FluxQuery: `from(bucket: "collectd")`}, "401 Unauthorized: unauthorized access"},
+		{widget.MetricConfig{}, "no influxql_query or flux_query for temperature"},
+	}
+	for _, tc := range tests {
+		t.Run(tc.expect, func(t *testing.T) {
+			sigs := make(chan feedback.Signal, 1)
+			fetchInfluxDB(http.DefaultClient, config, map[string]widget.MetricConfig{"temperature": tc.metric}, sigs)
+			f := <-sigs
+			assert.False(f.Ok)
+			assert.Contains(f.Error.Error(), tc.expect)
+		})
+	}
+}
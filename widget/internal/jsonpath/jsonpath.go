@@ -0,0 +1,132 @@
+package jsonpath
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// ErrNotFound is returned when a path doesn't exist in a document
+var ErrNotFound = errors.New("path not found")
+
+// step is a single step in a path: either an object key, or an array index
+type step struct {
+	key   string
+	index int
+	isKey bool
+}
+
+// parse splits a path like `$.observations.data[0].air_temp` into steps.
+//
+// Keys can be written as `.key`, `['key']`, or `["key"]`. Negative indexes count back from the end of an array.
+func parse(path string) ([]step, error) {
+	var steps []step
+	p := strings.TrimPrefix(strings.TrimSpace(path), "$")
+	for len(p) > 0 {
+		switch p[0] {
+		case '.':
+			p = p[1:]
+			end := strings.IndexAny(p, ".[")
+			if end < 0 {
+				end = len(p)
+			}
+			if end == 0 {
+				return nil, fmt.Errorf("empty key in path %q", path)
+			}
+			steps = append(steps, step{key: p[:end], isKey: true})
+			p = p[end:]
+		case '[':
+			end := strings.IndexByte(p, ']')
+			if end < 0 {
+				return nil, fmt.Errorf("unterminated [ in path %q", path)
+			}
+			inner := strings.TrimSpace(p[1:end])
+			p = p[end+1:]
+			if len(inner) >= 2 && (inner[0] == '\'' || inner[0] == '"') && inner[len(inner)-1] == inner[0] {
+				steps = append(steps, step{key: inner[1 : len(inner)-1], isKey: true})
+				continue
+			}
+			i, err := strconv.Atoi(inner)
+			if err != nil {
+				return nil, fmt.Errorf("bad index %q in path %q", inner, path)
+			}
+			steps = append(steps, step{index: i})
+		default:
+			// allow a bare leading key, e.g. `observations.data[0]`
+			if len(steps) == 0 {
+				p = "." + p
+				continue
+			}
+			return nil, fmt.Errorf("unexpected %q in path %q", p[0], path)
+		}
+	}
+	return steps, nil
+}
+
+// Lookup finds the value at path in a decoded JSON document
+func Lookup(doc interface{}, path string) (interface{}, error) {
+	steps, err := parse(path)
+	if err != nil {
+		return nil, err
+	}
+	v := doc
+	for _, s := range steps {
+		if s.isKey {
+			obj, ok := v.(map[string]interface{})
+			if !ok {
+				return nil, fmt.Errorf("%w: %s is not an object", ErrNotFound, s.key)
+			}
+			if v, ok = obj[s.key]; !ok {
+				return nil, fmt.Errorf("%w: no key %s", ErrNotFound, s.key)
+			}
+			continue
+		}
+		arr, ok := v.([]interface{})
+		if !ok {
+			return nil, fmt.Errorf("%w: [%d] is not an array", ErrNotFound, s.index)
+		}
+		i := s.index
+		if i < 0 {
+			i += len(arr)
+		}
+		if i < 0 || i >= len(arr) {
+			return nil, fmt.Errorf("%w: index %d out of range", ErrNotFound, s.index)
+		}
+		v = arr[i]
+	}
+	return v, nil
+}
+
+// Float decodes a JSON document, and returns the number at path.
+//
+// Booleans are returned as 1 or 0, and strings are parsed as numbers.
+func Float(data []byte, path string) (float64, error) {
+	var doc interface{}
+	d := json.NewDecoder(bytes.NewReader(data))
+	d.UseNumber()
+	if err := d.Decode(&doc); err != nil {
+		return 0, fmt.Errorf("unable to decode JSON: %w", err)
+	}
+	v, err := Lookup(doc, path)
+	if err != nil {
+		return 0, err
+	}
+	switch n := v.(type) {
+	case json.Number:
+		return n.Float64()
+	case bool:
+		if n {
+			return 1, nil
+		}
+		return 0, nil
+	case string:
+		return strconv.ParseFloat(strings.TrimSpace(n), 64)
+	case nil:
+		return 0, fmt.Errorf("%w: %s is null", ErrNotFound, path)
+	default:
+		return 0, fmt.Errorf("value at %s is not a number: %v", path, v)
+	}
+}
@@ -0,0 +1,65 @@
+package jsonpath
+
+import (
+	"errors"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const qingping = `{"type":"17","mac":"04CF8C28CEB7","timestamp":1681190770,"sensorData":[{"timestamp":{"value":1681190760},"temperature":{"value":22.29}},{"timestamp":{"value":1681190820},"temperature":{"value":22.4}}]}`
+
+const bom = `{"observations":{"data":[{"name":"Gosford","air_temp":21.3,"rain_trace":"0.4","press":null,"cloud":"-"}]}}`
+
+func TestFloatExtractsValues(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		doc    string
+		path   string
+		expect float64
+	}{
+		{qingping, "$.sensorData[0].temperature.value", 22.29},
+		{qingping, "sensorData[-1].temperature.value", 22.4},
+		{qingping, "$['sensorData'][1][\"temperature\"].value", 22.4},
+		{qingping, "$.timestamp", 1681190770},
+		{bom, "$.observations.data[0].air_temp", 21.3},
+		{bom, "observations.data[0].rain_trace", 0.4},
+		{`{"battery_ok":true}`, "$.battery_ok", 1},
+		{`18.3`, "$", 18.3},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			v, err := Float([]byte(tc.doc), tc.path)
+			assert.NoError(err)
+			assert.Equal(tc.expect, v)
+		})
+	}
+}
+
+func TestFloatReturnsErrors(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		doc      string
+		path     string
+		notFound bool
+	}{
+		{qingping, "$.sensorData[2].temperature.value", true},
+		{qingping, "$.sensorData.temperature", true},
+		{qingping, "$.wifi_info", true},
+		{bom, "$.observations.data[0].press", true},
+		{bom, "$.observations.data[0].cloud", false},
+		{bom, "$.observations.data[0].name", false},
+		{bom, "$.observations.data[x]", false},
+		{bom, "$.observations..data", false},
+		{`{"type":`, "$.type", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.path, func(t *testing.T) {
+			_, err := Float([]byte(tc.doc), tc.path)
+			assert.Error(err)
+			assert.Equal(tc.notFound, errors.Is(err, ErrNotFound))
+		})
+	}
+}
@@ -0,0 +1,192 @@
+package mqtt
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	h "github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/jsonpath"
+	"github.com/auxesis/meteo/widget/internal/widget"
+)
+
+// DefaultMaxAge is how long a metric can go without a message before it's considered stale
+const DefaultMaxAge = 10 * time.Minute
+
+// Source pushes samples from messages published to an MQTT broker
+type Source struct {
+	config  widget.MQTTConfig
+	started time.Time
+	mu      sync.Mutex
+	seen    map[string]time.Time
+}
+
+// NewSource initialises a Source that subscribes to the MQTT broker in config
+func NewSource(config widget.MQTTConfig) *Source {
+	if config.MaxAge == 0 {
+		config.MaxAge = DefaultMaxAge
+	}
+	return &Source{config: config, started: time.Now(), seen: map[string]time.Time{}}
+}
+
+// Subscribe connects to the broker, and pushes a sample every time a message arrives for one of metrics.
+//
+// Topics are (re-)subscribed every time the client connects, so subscriptions survive broker restarts.
+func (s *Source) Subscribe(metrics map[string]widget.MetricConfig, updates chan h.Samples, sigs chan feedback.Signal) error {
+	if len(s.config.Broker) == 0 {
+		return errors.New("no MQTT broker configured")
+	}
+
+	clientID := s.config.ClientID
+	if len(clientID) == 0 {
+		hostname, err := os.Hostname()
+		if err != nil {
+			return err
+		}
+		clientID = fmt.Sprintf("weather_widget-%s-%d", hostname, os.Getpid())
+	}
+
+	topics := map[string]byte{}
+	for _, v := range metrics {
+		topics[v.MQTTTopic] = 1
+	}
+	handler := messageHandler(metrics, updates, sigs, s.markSeen)
+
+	opts := paho.NewClientOptions()
+	opts.AddBroker(s.config.Broker)
+	opts.SetClientID(clientID)
+	opts.SetUsername(s.config.Username)
+	opts.SetPassword(s.config.Password)
+	opts.SetKeepAlive(60 * time.Second)
+	opts.SetOrderMatters(false)
+	opts.SetAutoReconnect(true)
+	opts.SetConnectRetry(true)
+	opts.SetOnConnectHandler(func(c paho.Client) {
+		log.Printf("info: connected to MQTT broker %s as %s\n", s.config.Broker, clientID)
+		if token := c.SubscribeMultiple(topics, handler); token.Wait() && token.Error() != nil {
+			log.Printf("error: unable to subscribe to MQTT topics: %s\n", token.Error())
+			for k := range metrics {
+				sigs <- feedback.NewSignalWithError(k, token.Error())
+			}
+		}
+	})
+	opts.SetConnectionLostHandler(func(c paho.Client, err error) {
+		log.Printf("warning: lost connection to MQTT broker: %s\n", err)
+	})
+
+	paho.NewClient(opts).Connect() // retries in the background until connected
+	return nil
+}
+
+// Check ensures a metric has a topic to subscribe to, as the broker rejects an empty one, and with it every
+// other subscription
+func (s *Source) Check(metric string, m widget.MetricConfig) error {
+	if len(m.MQTTTopic) == 0 {
+		return fmt.Errorf("no mqtt_topic for metric %s", metric)
+	}
+	return nil
+}
+
+// Fetch reports metrics that haven't had a message within the max age.
+//
+// Samples are only ever pushed through Subscribe, so Fetch never returns any.
+func (s *Source) Fetch(metrics map[string]widget.MetricConfig) (h.Samples, []feedback.Signal) {
+	return nil, staleSignals(metrics, s.lastSeen(), s.started, time.Now(), s.config.MaxAge)
+}
+
+func (s *Source) markSeen(metric string, t time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seen[metric] = t
+}
+
+func (s *Source) lastSeen() map[string]time.Time {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	seen := make(map[string]time.Time, len(s.seen))
+	for k, v := range s.seen {
+		seen[k] = v
+	}
+	return seen
+}
+
+// staleSignals returns an error signal for each metric not seen within maxAge
+func staleSignals(metrics map[string]widget.MetricConfig, seen map[string]time.Time, started time.Time, now time.Time, maxAge time.Duration) []feedback.Signal {
+	var signals []feedback.Signal
+	for k, v := range metrics {
+		last, ok := seen[k]
+		if !ok {
+			last = started
+		}
+		if now.Sub(last) > maxAge {
+			err := fmt.Errorf("no data from MQTT for %s (%s) in %s", k, v.MQTTTopic, maxAge)
+			log.Printf("warning: %s\n", err)
+			signals = append(signals, feedback.NewSignalWithError(k, err))
+		}
+	}
+	return signals
+}
+
+// messageHandler returns a function to be used as a callback when messages are received in client.Subscribe
+func messageHandler(metrics map[string]widget.MetricConfig, updates chan h.Samples, sigs chan feedback.Signal, seen func(string, time.Time)) paho.MessageHandler {
+	return func(c paho.Client, msg paho.Message) {
+		samples := h.Samples{}
+		for k, v := range metrics {
+			if !topicMatches(v.MQTTTopic, msg.Topic()) {
+				continue
+			}
+			f, err := extractValue(msg.Payload(), v.JSONPath)
+			if errors.Is(err, jsonpath.ErrNotFound) {
+				// Devices publish different kinds of messages to the same topic
+				log.Printf("debug: ignoring message on %s for %s: %s\n", msg.Topic(), k, err)
+				continue
+			}
+			if err != nil {
+				err = fmt.Errorf("unable to read %s from %s: %w", k, msg.Topic(), err)
+				log.Printf("error: %s\n", err)
+				sigs <- feedback.NewSignalWithError(k, err)
+				continue
+			}
+			samples[k] = f
+			seen(k, time.Now())
+			sigs <- feedback.NewSignal(k)
+		}
+		if len(samples) > 0 {
+			updates <- samples
+		}
+	}
+}
+
+// extractValue reads a number from a payload, either at a JSON path, or from the whole payload
+func extractValue(payload []byte, path string) (float64, error) {
+	if len(path) == 0 {
+		return strconv.ParseFloat(strings.TrimSpace(string(payload)), 64)
+	}
+	return jsonpath.Float(payload, path)
+}
+
+// topicMatches checks if a topic matches a subscription filter, including `+` and `#` wildcards
+func topicMatches(filter string, topic string) bool {
+	fs := strings.Split(filter, "/")
+	ts := strings.Split(topic, "/")
+	for i, f := range fs {
+		if f == "#" {
+			return true
+		}
+		if i >= len(ts) {
+			return false
+		}
+		if f != "+" && f != ts[i] {
+			return false
+		}
+	}
+	return len(fs) == len(ts)
+}
@@ -0,0 +1,145 @@
+package mqtt
+
+import (
+	"testing"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	h "github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/widget"
+	"github.com/stretchr/testify/assert"
+)
+
+type TestMsg struct {
+	TopicString  string
+	PayloadBytes []byte
+}
+
+func (tm TestMsg) Duplicate() bool {
+	return false
+}
+func (tm TestMsg) Qos() byte {
+	return byte('a')
+}
+func (tm TestMsg) Retained() bool {
+	return false
+}
+func (tm TestMsg) Topic() string {
+	return tm.TopicString
+}
+func (tm TestMsg) MessageID() uint16 {
+	return uint16(0)
+}
+func (tm TestMsg) Payload() []byte {
+	return tm.PayloadBytes
+}
+func (tm TestMsg) Ack() {}
+
+func TestMetricsNeedATopic(t *testing.T) {
+	assert := assert.New(t)
+
+	s := NewSource(widget.MQTTConfig{Broker: "tcp://localhost:1883"})
+	assert.NoError(s.Check("co2", widget.MetricConfig{Source: widget.SourceMQTT, MQTTTopic: "/qingping/+/up"}))
+	assert.EqualError(s.Check("co2", widget.MetricConfig{Source: widget.SourceMQTT}), "no mqtt_topic for metric co2")
+}
+
+func TestTopicMatches(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []struct {
+		filter string
+		topic  string
+		expect bool
+	}{
+		{"sensors/rtl_433/temperature_C", "sensors/rtl_433/temperature_C", true},
+		{"sensors/rtl_433/#", "sensors/rtl_433/devices/Fineoffset-WHx080/240/temperature_C", true},
+		{"sensors/rtl_433/+/temperature_C", "sensors/rtl_433/240/temperature_C", true},
+		{"sensors/rtl_433/+/temperature_C", "sensors/rtl_433/240/humidity", false},
+		{"/+/04CF8C28CEB7/#", "/qingping/04CF8C28CEB7/up", true},
+		{"/+/04CF8C28CEB7/#", "/qingping/04CF8C28CEB8/up", false},
+		{"sensors/rtl_433", "sensors/rtl_433/temperature_C", false},
+		{"sensors/rtl_433/temperature_C", "sensors/rtl_433", false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.filter+" "+tc.topic, func(t *testing.T) {
+			assert.Equal(tc.expect, topicMatches(tc.filter, tc.topic))
+		})
+	}
+}
+
+func TestMessagesArePushedAsSamples(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := map[string]widget.MetricConfig{
+		"temperature":        {MQTTTopic: "sensors/rtl_433/+/temperature_C"},
+		"indoor_temperature": {MQTTTopic: "/+/04CF8C28CEB7/#", JSONPath: "$.sensorData[-1].temperature.value"},
+	}
+	updates := make(chan h.Samples, 10)
+	sigs := make(chan feedback.Signal, 10)
+	seen := map[string]time.Time{}
+	handler := messageHandler(metrics, updates, sigs, func(k string, t time.Time) { seen[k] = t })
+	c := paho.NewClient(paho.NewClientOptions())
+
+	handler(c, TestMsg{TopicString: "sensors/rtl_433/240/temperature_C", PayloadBytes: []byte("18.3")})
+	handler(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: []byte(`{"type":"17","sensorData":[{"temperature":{"value":22.29}}]}`)})
+	handler(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: []byte(`{"type":"13","sw_version":"4.3.4"}`)})
+
+	assert.Len(updates, 2)
+	assert.Equal(h.Samples{"temperature": 18.3}, <-updates)
+	assert.Equal(h.Samples{"indoor_temperature": 22.29}, <-updates)
+	assert.Len(sigs, 2)
+	for len(sigs) > 0 {
+		assert.True((<-sigs).Ok)
+	}
+	assert.Contains(seen, "temperature")
+	assert.Contains(seen, "indoor_temperature")
+}
+
+func TestFeedbackIsSentWhenPayloadWeird(t *testing.T) {
+	assert := assert.New(t)
+
+	metrics := map[string]widget.MetricConfig{
+		"temperature":        {MQTTTopic: "sensors/rtl_433/+/temperature_C"},
+		"indoor_temperature": {MQTTTopic: "/+/04CF8C28CEB7/#", JSONPath: "$.sensorData[0].temperature.value"},
+	}
+	updates := make(chan h.Samples, 10)
+	sigs := make(chan feedback.Signal, 10)
+	handler := messageHandler(metrics, updates, sigs, func(string, time.Time) {})
+	c := paho.NewClient(paho.NewClientOptions())
+
+	handler(c, TestMsg{TopicString: "sensors/rtl_433/240/temperature_C", PayloadBytes: []byte("18.3.1")})
+	handler(c, TestMsg{TopicString: "/qingping/04CF8C28CEB7/up", PayloadBytes: []byte(`{"type":"17",`)})
+
+	assert.Empty(updates)
+	assert.Len(sigs, 2)
+	for len(sigs) > 0 {
+		f := <-sigs
+		assert.False(f.Ok)
+		assert.Contains(f.Error.Error(), "unable to read "+f.Metric)
+	}
+}
+
+func TestFeedbackIsSentWhenStale(t *testing.T) {
+	assert := assert.New(t)
+
+	now := time.Now()
+	metrics := map[string]widget.MetricConfig{
+		"temperature": {MQTTTopic: "sensors/rtl_433/+/temperature_C"},
+		"humidity":    {MQTTTopic: "sensors/rtl_433/+/humidity"},
+		"rainfall":    {MQTTTopic: "sensors/rtl_433/+/rain_mm"},
+	}
+	seen := map[string]time.Time{
+		"temperature": now.Add(-time.Minute),
+		"humidity":    now.Add(-time.Hour),
+	}
+
+	sigs := staleSignals(metrics, seen, now.Add(-time.Minute), now, DefaultMaxAge)
+	assert.Len(sigs, 1)
+	assert.Equal("humidity", sigs[0].Metric)
+	assert.Contains(sigs[0].Error.Error(), "no data from MQTT for humidity")
+
+	sigs = staleSignals(metrics, seen, now.Add(-time.Hour), now, DefaultMaxAge)
+	assert.Len(sigs, 2)
+}
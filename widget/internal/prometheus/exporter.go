@@ -0,0 +1,212 @@
+package prometheus
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	h "github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/widget"
+)
+
+// exposedSample is a single sample read from a Prometheus text or OpenMetrics exposition
+type exposedSample struct {
+	Name   string
+	Labels map[string]string
+	Value  float64
+}
+
+// matches checks if a sample has a metric name, and all the labels in matchers
+func (s exposedSample) matches(name string, matchers map[string]string) bool {
+	if s.Name != name {
+		return false
+	}
+	for k, v := range matchers {
+		if s.Labels[k] != v {
+			return false
+		}
+	}
+	return true
+}
+
+// ExporterSource fetches samples by scraping exporters directly, without a Prometheus server
+type ExporterSource struct {
+	client *http.Client
+	urls   []string
+}
+
+// NewExporterSource initialises an ExporterSource that scrapes the exporters at urls
+func NewExporterSource(urls []string) *ExporterSource {
+	return &ExporterSource{client: &http.Client{Timeout: 10 * time.Second}, urls: urls}
+}
+
+// Fetch scrapes every exporter once, and selects the latest sample of each metric
+func (s *ExporterSource) Fetch(metrics map[string]widget.MetricConfig) (h.Samples, []feedback.Signal) {
+	sigs := make(chan feedback.Signal, len(metrics))
+	samples := fetchExporters(s.client, s.urls, metrics, sigs)
+	return samples, feedback.Collect(sigs)
+}
+
+// fetchExporters scrapes exporters directly, and returns samples for metrics that select from them
+func fetchExporters(client *http.Client, urls []string, metrics map[string]widget.MetricConfig, sigs chan feedback.Signal) h.Samples {
+	samples := make(h.Samples)
+
+	log.Printf("debug: scraping exporters\n")
+	var exposed []exposedSample
+	var errs []error
+	for _, u := range urls {
+		s, err := scrapeExporter(client, u)
+		if err != nil {
+			log.Printf("error: unable to scrape exporter: %s\n", err)
+			errs = append(errs, err)
+			continue
+		}
+		exposed = append(exposed, s...)
+	}
+
+	for k, v := range metrics {
+		var found []exposedSample
+		for _, s := range exposed {
+			if s.matches(v.ExporterMetric, v.ExporterLabels) {
+				found = append(found, s)
+			}
+		}
+		if len(found) == 0 {
+			err := fmt.Errorf("no data from exporters when scraping %s (%s)", k, v.ExporterMetric)
+			if len(errs) > 0 {
+				err = fmt.Errorf("%w: %w", err, errors.Join(errs...))
+			}
+			log.Printf("warning: %s\n", err)
+			sigs <- feedback.NewSignalWithError(k, err)
+			continue
+		}
+		if len(found) > 1 {
+			log.Printf("warning: %d series match %s (%s), using the first\n", len(found), k, v.ExporterMetric)
+		}
+		samples[k] = found[0].Value
+		sigs <- feedback.NewSignal(k)
+	}
+	return samples
+}
+
+// scrapeExporter fetches and parses the exposition served by an exporter
+func scrapeExporter(client *http.Client, url string) ([]exposedSample, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Accept", "application/openmetrics-text;version=1.0.0,text/plain;version=0.0.4;q=0.5")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("unexpected status from %s: %s", url, resp.Status)
+	}
+	return parseExposition(resp.Body)
+}
+
+// parseExposition parses samples out of the Prometheus text or OpenMetrics exposition formats.
+//
+// Comments, metadata, timestamps, and exemplars are ignored.
+func parseExposition(r io.Reader) ([]exposedSample, error) {
+	var samples []exposedSample
+	scanner := bufio.NewScanner(r)
+	for n := 1; scanner.Scan(); n++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		s, err := parseSampleLine(line)
+		if err != nil {
+			return samples, fmt.Errorf("line %d: %w", n, err)
+		}
+		samples = append(samples, s)
+	}
+	return samples, scanner.Err()
+}
+
+// parseSampleLine parses a single `name{label="value"} value [timestamp]` line
+func parseSampleLine(line string) (exposedSample, error) {
+	s := exposedSample{Labels: map[string]string{}}
+
+	i := strings.IndexAny(line, "{ \t")
+	if i <= 0 {
+		return s, fmt.Errorf("no value for sample: %q", line)
+	}
+	s.Name = line[:i]
+	rest := line[i:]
+
+	if rest[0] == '{' {
+		var err error
+		rest, err = parseLabels(rest[1:], s.Labels)
+		if err != nil {
+			return s, err
+		}
+	}
+
+	fields := strings.Fields(rest)
+	if len(fields) == 0 {
+		return s, fmt.Errorf("no value for sample: %q", line)
+	}
+	v, err := strconv.ParseFloat(fields[0], 64)
+	if err != nil {
+		return s, err
+	}
+	s.Value = v
+	return s, nil
+}
+
+// parseLabels reads `label="value",...}` into labels, and returns what's left after the closing brace
+func parseLabels(in string, labels map[string]string) (string, error) {
+	for {
+		in = strings.TrimLeft(in, " \t,")
+		if len(in) == 0 {
+			return in, errors.New("unterminated label set")
+		}
+		if in[0] == '}' {
+			return in[1:], nil
+		}
+
+		eq := strings.IndexByte(in, '=')
+		if eq <= 0 || eq+1 >= len(in) || in[eq+1] != '"' {
+			return in, fmt.Errorf("malformed label: %q", in)
+		}
+		name := strings.TrimSpace(in[:eq])
+		in = in[eq+2:]
+
+		var value strings.Builder
+		closed := false
+		for j := 0; j < len(in); j++ {
+			c := in[j]
+			if c == '\\' && j+1 < len(in) {
+				j++
+				switch in[j] {
+				case 'n':
+					value.WriteByte('\n')
+				default:
+					value.WriteByte(in[j])
+				}
+				continue
+			}
+			if c == '"' {
+				in = in[j+1:]
+				closed = true
+				break
+			}
+			value.WriteByte(c)
+		}
+		if !closed {
+			return in, fmt.Errorf("unterminated value for label %s", name)
+		}
+		labels[name] = value.String()
+	}
+}
@@ -0,0 +1,145 @@
+package prometheus
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	"github.com/auxesis/meteo/widget/internal/widget"
+	"github.com/stretchr/testify/assert"
+)
+
+const textExposition = `# HELP outdoor_temperature_celsius Current temperature outside of house.
+# TYPE outdoor_temperature_celsius gauge
+outdoor_temperature_celsius 18.3
+# HELP qingping_temperature_celsius Current room temperature.
+# TYPE qingping_temperature_celsius gauge
+qingping_temperature_celsius{device="upstairs",mac="04CF8C28CEB7"} 22.29
+qingping_temperature_celsius{device="downstairs",mac="04CF8C28CEB8"} 19.5 1704115202421
+`
+
+const openMetricsExposition = `# TYPE outdoor_rain_millimetres counter
+# UNIT outdoor_rain_millimetres millimetres
+outdoor_rain_millimetres_total{model="Fineoffset-WHx080",id="240"} 70.2 # {trace_id="abc"} 1.0
+outdoor_humidity_percentage{note="a \"quoted\" label, with commas"} NaN
+# EOF
+`
+
+func TestExporterParsesExpositionFormats(t *testing.T) {
+	assert := assert.New(t)
+
+	samples, err := parseExposition(strings.NewReader(textExposition))
+	assert.NoError(err)
+	assert.Len(samples, 3)
+	assert.Equal("outdoor_temperature_celsius", samples[0].Name)
+	assert.Equal(18.3, samples[0].Value)
+	assert.Equal("downstairs", samples[2].Labels["device"])
+	assert.Equal(19.5, samples[2].Value)
+
+	samples, err = parseExposition(strings.NewReader(openMetricsExposition))
+	assert.NoError(err)
+	assert.Len(samples, 2)
+	assert.Equal("240", samples[0].Labels["id"])
+	assert.Equal(70.2, samples[0].Value)
+	assert.Equal(`a "quoted" label, with commas`, samples[1].Labels["note"])
+	assert.True(math.IsNaN(samples[1].Value))
+}
+
+func TestExporterRejectsMalformedExposition(t *testing.T) {
+	assert := assert.New(t)
+
+	tests := []string{
+		"outdoor_temperature_celsius",
+		"outdoor_temperature_celsius{device=\"upstairs\" 1",
+		"outdoor_temperature_celsius{device=upstairs} 1",
+		"outdoor_temperature_celsius 1.0.0",
+	}
+	for _, tc := range tests {
+		t.Run(tc, func(t *testing.T) {
+			_, err := parseExposition(strings.NewReader(tc))
+			assert.Error(err)
+		})
+	}
+}
+
+func TestExporterSelectsMetricByNameAndLabels(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, textExposition)
+	}))
+	defer ts.Close()
+
+	w := widget.Widget{
+		ExporterURLs: []string{ts.URL},
+		Metrics: map[string]widget.MetricConfig{
+			"temperature": {ExporterMetric: "outdoor_temperature_celsius"},
+			"upstairs":    {ExporterMetric: "qingping_temperature_celsius", ExporterLabels: map[string]string{"device": "upstairs"}},
+			"downstairs":  {ExporterMetric: "qingping_temperature_celsius", ExporterLabels: map[string]string{"device": "downstairs"}},
+		},
+	}
+	sigs := make(chan feedback.Signal, 10)
+
+	samples := fetchExporters(http.DefaultClient, w.ExporterURLs, w.Metrics, sigs)
+
+	assert.Equal(18.3, samples["temperature"])
+	assert.Equal(22.29, samples["upstairs"])
+	assert.Equal(19.5, samples["downstairs"])
+	assert.Len(sigs, 3)
+	for len(sigs) > 0 {
+		f := <-sigs
+		assert.True(f.Ok)
+	}
+}
+
+func TestExporterFeedbackIsSentWhenNoMatch(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprint(w, textExposition)
+	}))
+	defer ts.Close()
+
+	w := widget.Widget{
+		ExporterURLs: []string{ts.URL},
+		Metrics: map[string]widget.MetricConfig{
+			"upstairs": {ExporterMetric: "qingping_temperature_celsius", ExporterLabels: map[string]string{"device": "attic"}},
+		},
+	}
+	sigs := make(chan feedback.Signal, 1)
+
+	fetchExporters(http.DefaultClient, w.ExporterURLs, w.Metrics, sigs)
+
+	assert.NotEmpty(sigs)
+	f := <-sigs
+	assert.False(f.Ok)
+	assert.Contains(f.Error.Error(), "no data from exporters when scraping upstairs")
+}
+
+func TestExporterFeedbackIsSentWhenExporterUnavailable(t *testing.T) {
+	assert := assert.New(t)
+
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+	}))
+	defer ts.Close()
+
+	w := widget.Widget{
+		ExporterURLs: []string{ts.URL},
+		Metrics: map[string]widget.MetricConfig{
+			"temperature": {ExporterMetric: "outdoor_temperature_celsius"},
+		},
+	}
+	sigs := make(chan feedback.Signal, 1)
+
+	fetchExporters(http.DefaultClient, w.ExporterURLs, w.Metrics, sigs)
+
+	assert.NotEmpty(sigs)
+	f := <-sigs
+	assert.False(f.Ok)
+	assert.Contains(f.Error.Error(), "502 Bad Gateway")
+}
@@ -4,7 +4,6 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"math"
 	"strconv"
 	"strings"
 	"time"
@@ -16,31 +15,33 @@ import (
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
 )
 
-// PollForSamples polls a Prometheus endpoint, and updates the cache of samples
-func PollForSamples(wdgts []widget.Widget, samples *http.Samples, errs chan feedback.Signal) {
-	w := wdgts[0]
+// Source fetches samples by querying a Prometheus server
+type Source struct {
+	api v1.API
+}
+
+// NewSource initialises a Source that queries the Prometheus server at url
+func NewSource(url string) (*Source, error) {
 	client, err := api.NewClient(api.Config{
-		Address: w.PrometheusURL,
+		Address: url,
 	})
 	if err != nil {
-		log.Fatalf("error: unable to create Prometheus client: %s", err)
+		return nil, fmt.Errorf("unable to create Prometheus client: %w", err)
 	}
-	v1api := v1.NewAPI(client)
-
-	latest := fetchPrometheus(v1api, w, errs) // first tick
-	updateSamples(samples, latest, w)
+	return &Source{api: v1.NewAPI(client)}, nil
+}
 
-	ticker := time.NewTicker(w.FetchInterval)
-	for range ticker.C {
-		latest = fetchPrometheus(v1api, w, errs)
-		updateSamples(samples, latest, w)
-	}
+// Fetch queries Prometheus for the latest sample of each metric
+func (s *Source) Fetch(metrics map[string]widget.MetricConfig) (http.Samples, []feedback.Signal) {
+	sigs := make(chan feedback.Signal, len(metrics))
+	samples := fetchPrometheus(s.api, metrics, sigs)
+	return samples, feedback.Collect(sigs)
 }
 
-func fetchPrometheus(v1api v1.API, w widget.Widget, sigs chan feedback.Signal) http.Samples {
+func fetchPrometheus(v1api v1.API, metrics map[string]widget.MetricConfig, sigs chan feedback.Signal) http.Samples {
 	samples := make(http.Samples)
 	log.Printf("debug: polling Prometheus\n")
-	for k, v := range w.Metrics {
+	for k, v := range metrics {
 		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer cancel()
 		result, warnings, err := v1api.Query(ctx, v.PrometheusQuery, time.Now(), v1.WithTimeout(10*time.Second))
@@ -70,40 +71,3 @@ func fetchPrometheus(v1api v1.API, w widget.Widget, sigs chan feedback.Signal) h
 	}
 	return samples
 }
-
-// updateSamples takes a new http.Samples and updates an existing http.Samples
-// updateSamples doesn't update if there's a > 50% variation in the value.
-// This is done to handle weird outlier measurements returned by the weather station.
-func updateSamples(old *http.Samples, latest http.Samples, w widget.Widget) {
-	for k, l := range latest {
-		var d float64
-		o := (*old)[k]
-		switch {
-		case o == 0.0: // just booted
-			// doesn't handle case where actual value is 0
-			(*old)[k] = l
-			continue
-		case l == o: // no change
-			continue
-		case l > o:
-			d = l - o
-		case l < o:
-			d = o - l
-		}
-		if math.IsNaN(l) || math.IsNaN(o) {
-			(*old)[k] = l
-			log.Printf("debug: blindly updating: got NaN value on %s (old: %f, new: %f)", k, o, l)
-			continue
-		}
-
-		if w.Metrics[k].DampenOutliers {
-			if d/o <= 0.5 {
-				(*old)[k] = l
-			} else {
-				log.Printf("debug: ignoring update: > 50%% change on %s (%f, %f)", k, o, l)
-			}
-		} else {
-			(*old)[k] = l
-		}
-	}
-}
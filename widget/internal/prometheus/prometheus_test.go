@@ -2,13 +2,11 @@ package prometheus
 
 import (
 	"fmt"
-	"math"
 	"net/http"
 	"net/http/httptest"
 	"testing"
 
 	"github.com/auxesis/meteo/widget/internal/feedback"
-	h "github.com/auxesis/meteo/widget/internal/http"
 	"github.com/auxesis/meteo/widget/internal/widget"
 	"github.com/prometheus/client_golang/api"
 	v1 "github.com/prometheus/client_golang/api/prometheus/v1"
@@ -29,7 +27,7 @@ func TestPrometheusFeedbackIsSentWhenOk(t *testing.T) {
 	w := widget.Widget{Metrics: map[string]widget.MetricConfig{"temperature": widget.MetricConfig{PrometheusQuery: "outdoor_temperature_celsius"}}}
 	feedback := make(chan feedback.Signal, 1)
 
-	fetchPrometheus(v1api, w, feedback)
+	fetchPrometheus(v1api, w.Metrics, feedback)
 
 	assert.NotEmpty(feedback)
 	f := <-feedback
@@ -49,7 +47,7 @@ func TestPrometheusFeedbackIsSentWhenPrometheusUnavailable(t *testing.T) {
 	w := widget.Widget{Metrics: map[string]widget.MetricConfig{"temperature": widget.MetricConfig{PrometheusQuery: "temperature_celsius"}}}
 	feedback := make(chan feedback.Signal, 1)
 
-	fetchPrometheus(v1api, w, feedback)
+	fetchPrometheus(v1api, w.Metrics, feedback)
 
 	assert.NotEmpty(feedback)
 	f := <-feedback
@@ -70,7 +68,7 @@ func TestPrometheusFeedbackIsSentWhenNoValue(t *testing.T) {
 	w := widget.Widget{Metrics: map[string]widget.MetricConfig{"temperature": widget.MetricConfig{PrometheusQuery: "outdoor_temperature_celsius"}}}
 	feedback := make(chan feedback.Signal, 1)
 
-	fetchPrometheus(v1api, w, feedback)
+	fetchPrometheus(v1api, w.Metrics, feedback)
 
 	assert.NotEmpty(feedback)
 	f := <-feedback
@@ -91,50 +89,10 @@ func TestPrometheusFeedbackIsSentWhenValueWeird(t *testing.T) {
 	w := widget.Widget{Metrics: map[string]widget.MetricConfig{"temperature": widget.MetricConfig{PrometheusQuery: "outdoor_temperature_celsius"}}}
 	feedback := make(chan feedback.Signal, 1)
 
-	fetchPrometheus(v1api, w, feedback)
+	fetchPrometheus(v1api, w.Metrics, feedback)
 
 	assert.NotEmpty(feedback)
 	f := <-feedback
 	assert.Error(f.Error)
 	assert.Contains(f.Error.Error(), "strconv.ParseFloat")
 }
-
-func TestPrometheusDoesNotUpdateWhenDeltaTooLarge(t *testing.T) {
-	assert := assert.New(t)
-
-	w := widget.Widget{Metrics: map[string]widget.MetricConfig{"temperature": widget.MetricConfig{DampenOutliers: true}}}
-	type test struct {
-		name      string
-		current   h.Samples
-		changes   h.Samples
-		widget    widget.Widget
-		different bool
-	}
-	tests := []test{
-		{"initial", h.Samples{"temperature": 0.0}, h.Samples{"temperature": 10.0}, w, true},
-		{"no change", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 10.0}, w, true}, // not actually true, but we need to trigger the right test path
-		{"20% increase", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 12.0}, w, true},
-		{"50% increase", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 15.0}, w, true},
-		{"100% increase", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 20.0}, w, false},
-		{"150% increase", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 25.0}, w, false},
-		{"20% decrease", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 8.0}, w, true},
-		{"50% decrease", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 5.0}, w, true},
-		{"100% decrease", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 0.0}, w, false},
-		{"150% decrease", h.Samples{"temperature": 10.0}, h.Samples{"temperature": -5.0}, w, false},
-		{"NaN new", h.Samples{"temperature": 10.0}, h.Samples{"temperature": math.NaN()}, w, false}, // not actually false, but math.NaN() != math.NaN()
-		{"NaN old", h.Samples{"temperature": math.NaN()}, h.Samples{"temperature": 10.0}, w, true},
-		{"NaN both", h.Samples{"temperature": math.NaN()}, h.Samples{"temperature": math.NaN()}, w, false},
-	}
-	for _, tc := range tests {
-		t.Run(tc.name, func(t *testing.T) {
-			updateSamples(&tc.current, tc.changes, w)
-			if tc.different {
-				// current should be updated to match changes
-				assert.Equal(tc.current, tc.changes)
-			} else {
-				// current should not be updated
-				assert.NotEqual(tc.current, tc.changes)
-			}
-		})
-	}
-}
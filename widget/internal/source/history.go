@@ -0,0 +1,85 @@
+package source
+
+import (
+	"math"
+	"time"
+
+	"github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/widget"
+)
+
+// point is a sample of a metric, and when it was taken
+type point struct {
+	t time.Time
+	v float64
+}
+
+// History keeps recent samples of metrics, to work out how they're changing
+type History map[string][]point
+
+// Add records a sample of a metric taken at t, and forgets samples older than needed to look back over window
+func (h History) Add(k string, v float64, t time.Time, window time.Duration) {
+	points := append(h[k], point{t: t, v: v})
+	// keep the newest sample from before the window, so there's always one to compare against
+	start := 0
+	for i, p := range points {
+		if !p.t.After(t.Add(-window)) {
+			start = i
+		}
+	}
+	h[k] = points[start:]
+}
+
+// Change returns how much a metric has changed over window, up to its latest sample. There's no change until
+// samples go back that far, or if there's a gap in samples around the start of the window: the sample before
+// the gap must have been taken within tolerance of the start, so a change over a longer time isn't reported.
+func (h History) Change(k string, window time.Duration, tolerance time.Duration) (float64, bool) {
+	points := h[k]
+	if len(points) < 2 {
+		return 0, false
+	}
+	first, latest := points[0], points[len(points)-1]
+	elapsed := latest.t.Sub(first.t)
+	if elapsed < window || elapsed > window+tolerance {
+		return 0, false
+	}
+	return latest.v - first.v, true
+}
+
+// updateTendencies records the samples of metrics with a tendency that were just updated, and adds their
+// change over widget.TendencyWindow to samples. Metrics without a change have their tendency removed.
+func updateTendencies(samples *http.Samples, latest http.Samples, history History, w widget.Widget, now time.Time) {
+	for k := range latest {
+		m := w.Metrics[k]
+		if !m.Tendency {
+			continue
+		}
+		// the cached sample, which outliers may not have replaced
+		v, ok := (*samples)[k]
+		if !ok || math.IsNaN(v) {
+			delete(*samples, k+widget.TendencySuffix)
+			continue
+		}
+		history.Add(k, v, now, widget.TendencyWindow)
+		// samples are at least a poll apart
+		tolerance := w.FetchInterval
+		if m.PollInterval > tolerance {
+			tolerance = m.PollInterval
+		}
+		change, ok := history.Change(k, widget.TendencyWindow, tolerance)
+		if !ok {
+			delete(*samples, k+widget.TendencySuffix)
+			continue
+		}
+		(*samples)[k+widget.TendencySuffix] = change
+	}
+}
+
+// correctSamples corrects station pressure samples to sea level, for metrics that ask for it
+func correctSamples(samples http.Samples, w widget.Widget) {
+	for k, v := range samples {
+		if w.Metrics[k].SeaLevel {
+			samples[k] = widget.SeaLevelPressure(v, w.StationAltitude)
+		}
+	}
+}
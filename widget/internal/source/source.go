@@ -0,0 +1,162 @@
+package source
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"time"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	"github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/widget"
+)
+
+// Source is a data source that metric samples can be fetched from
+type Source interface {
+	// Fetch returns the latest samples for metrics, and a signal for each metric it tried to fetch
+	Fetch(metrics map[string]widget.MetricConfig) (http.Samples, []feedback.Signal)
+}
+
+// Subscriber is a Source that also pushes samples as soon as they arrive
+type Subscriber interface {
+	Source
+	// Subscribe starts pushing samples for metrics to updates, and signals to sigs
+	Subscribe(metrics map[string]widget.MetricConfig, updates chan http.Samples, sigs chan feedback.Signal) error
+}
+
+// Checker is a Source that checks a metric's config has what it needs to be fetched
+type Checker interface {
+	Source
+	// Check returns an error if metric's config can't be fetched from the source
+	Check(metric string, m widget.MetricConfig) error
+}
+
+// Registry maps source names used in a MetricConfig to a Source
+type Registry map[string]Source
+
+// Check ensures every metric in a widget names a registered source, and is configured the way its source needs
+func (r Registry) Check(w widget.Widget) error {
+	for k, v := range w.Metrics {
+		src, ok := r[v.Source]
+		if !ok {
+			return fmt.Errorf("unknown source %q for metric %s", v.Source, k)
+		}
+		if checker, ok := src.(Checker); ok {
+			if err := checker.Check(k, v); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// PollForSamples polls the sources named by each metric, and updates the cache of samples.
+//
+// Samples pushed by a Subscriber update the cache as they arrive, between polls. Pressure is corrected to sea
+// level before it's cached, and the tendency of metrics that ask for one is worked out from their history.
+func PollForSamples(wdgts []widget.Widget, sources Registry, samples *http.Samples, sigs chan feedback.Signal) {
+	w := wdgts[0]
+
+	updates := make(chan http.Samples, 1024)
+	for name, metrics := range groupBySource(w) {
+		sub, ok := sources[name].(Subscriber)
+		if !ok {
+			continue
+		}
+		if err := sub.Subscribe(metrics, updates, sigs); err != nil {
+			log.Printf("error: unable to subscribe to %s: %s\n", name, err)
+			for k := range metrics {
+				sigs <- feedback.NewSignalWithError(k, err)
+			}
+		}
+	}
+
+	history := History{}
+	update := func(latest http.Samples) {
+		correctSamples(latest, w)
+		updateSamples(samples, latest, w)
+		updateTendencies(samples, latest, history, w, time.Now())
+	}
+
+	update(fetchSources(sources, w, sigs)) // first tick
+	ticker := time.NewTicker(w.FetchInterval)
+	for {
+		select {
+		case <-ticker.C:
+			update(fetchSources(sources, w, sigs))
+		case latest := <-updates:
+			update(latest)
+		}
+	}
+}
+
+// groupBySource groups a widget's metrics by the name of their source
+func groupBySource(w widget.Widget) map[string]map[string]widget.MetricConfig {
+	grouped := map[string]map[string]widget.MetricConfig{}
+	for k, v := range w.Metrics {
+		if grouped[v.Source] == nil {
+			grouped[v.Source] = map[string]widget.MetricConfig{}
+		}
+		grouped[v.Source][k] = v
+	}
+	return grouped
+}
+
+// fetchSources fetches the latest samples for a widget's metrics, grouped by source
+func fetchSources(sources Registry, w widget.Widget, sigs chan feedback.Signal) http.Samples {
+	latest := make(http.Samples)
+	for name, metrics := range groupBySource(w) {
+		src, ok := sources[name]
+		if !ok {
+			for k := range metrics {
+				sigs <- feedback.NewSignalWithError(k, fmt.Errorf("unknown source %q", name))
+			}
+			continue
+		}
+		samples, signals := src.Fetch(metrics)
+		for k, v := range samples {
+			latest[k] = v
+		}
+		for _, s := range signals {
+			sigs <- s
+		}
+	}
+	return latest
+}
+
+// updateSamples takes a new http.Samples and updates an existing http.Samples
+// updateSamples doesn't update if there's a > 50% variation in the value.
+// This is done to handle weird outlier measurements returned by the weather station.
+func updateSamples(old *http.Samples, latest http.Samples, w widget.Widget) {
+	for k, l := range latest {
+		var d float64
+		o := (*old)[k]
+		switch {
+		case o == 0.0: // just booted
+			// doesn't handle case where actual value is 0
+			(*old)[k] = l
+			continue
+		case l == o: // no change
+			continue
+		case l > o:
+			d = l - o
+		case l < o:
+			d = o - l
+		}
+		if math.IsNaN(l) || math.IsNaN(o) {
+			(*old)[k] = l
+			log.Printf("debug: blindly updating: got NaN value on %s (old: %f, new: %f)", k, o, l)
+			continue
+		}
+
+		if w.Metrics[k].DampenOutliers {
+			if d/o <= 0.5 {
+				(*old)[k] = l
+			} else {
+				log.Printf("debug: ignoring update: > 50%% change on %s (%f, %f)", k, o, l)
+			}
+		} else {
+			(*old)[k] = l
+		}
+	}
+}
@@ -0,0 +1,221 @@
+package source
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/auxesis/meteo/widget/internal/feedback"
+	h "github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/widget"
+	"github.com/stretchr/testify/assert"
+)
+
+type testSource struct {
+	samples h.Samples
+	err     error
+	fetched []string
+}
+
+func (s *testSource) Fetch(metrics map[string]widget.MetricConfig) (h.Samples, []feedback.Signal) {
+	samples := h.Samples{}
+	var sigs []feedback.Signal
+	for k := range metrics {
+		s.fetched = append(s.fetched, k)
+		if s.err != nil {
+			sigs = append(sigs, feedback.NewSignalWithError(k, s.err))
+			continue
+		}
+		samples[k] = s.samples[k]
+		sigs = append(sigs, feedback.NewSignal(k))
+	}
+	return samples, sigs
+}
+
+func TestSourcesAreFetchedByName(t *testing.T) {
+	assert := assert.New(t)
+
+	prom := &testSource{samples: h.Samples{"temperature": 18.3}}
+	influx := &testSource{err: errors.New("server error: 502")}
+	sources := Registry{"prometheus": prom, "influxdb": influx}
+	w := widget.Widget{Metrics: map[string]widget.MetricConfig{
+		"temperature": {Source: "prometheus"},
+		"rainfall":    {Source: "influxdb"},
+	}}
+	sigs := make(chan feedback.Signal, 2)
+
+	latest := fetchSources(sources, w, sigs)
+
+	assert.Equal(h.Samples{"temperature": 18.3}, latest)
+	assert.Equal([]string{"temperature"}, prom.fetched)
+	assert.Equal([]string{"rainfall"}, influx.fetched)
+	assert.Len(sigs, 2)
+	for len(sigs) > 0 {
+		f := <-sigs
+		assert.Equal(f.Metric == "temperature", f.Ok)
+	}
+}
+
+func TestSourcesAreChecked(t *testing.T) {
+	assert := assert.New(t)
+
+	sources := Registry{"prometheus": &testSource{}}
+	w := widget.Widget{Metrics: map[string]widget.MetricConfig{"temperature": {Source: "prometheus"}}}
+	assert.NoError(sources.Check(w))
+
+	w.Metrics["rainfall"] = widget.MetricConfig{Source: "mqtt"}
+	err := sources.Check(w)
+	assert.Error(err)
+	assert.Contains(err.Error(), `unknown source "mqtt" for metric rainfall`)
+}
+
+// testCheckedSource is a source that needs every metric to have a JSON path
+type testCheckedSource struct {
+	testSource
+}
+
+func (s *testCheckedSource) Check(metric string, m widget.MetricConfig) error {
+	if len(m.JSONPath) == 0 {
+		return fmt.Errorf("no json_path for metric %s", metric)
+	}
+	return nil
+}
+
+func TestSourcesCheckTheirMetrics(t *testing.T) {
+	assert := assert.New(t)
+
+	sources := Registry{"mqtt": &testCheckedSource{}}
+	w := widget.Widget{Metrics: map[string]widget.MetricConfig{"co2": {Source: "mqtt", JSONPath: "$.co2"}}}
+	assert.NoError(sources.Check(w))
+
+	w.Metrics["pm25"] = widget.MetricConfig{Source: "mqtt"}
+	assert.EqualError(sources.Check(w), "no json_path for metric pm25")
+}
+
+func TestSourcesDoNotUpdateWhenDeltaTooLarge(t *testing.T) {
+	assert := assert.New(t)
+
+	w := widget.Widget{Metrics: map[string]widget.MetricConfig{"temperature": widget.MetricConfig{DampenOutliers: true}}}
+	type test struct {
+		name      string
+		current   h.Samples
+		changes   h.Samples
+		widget    widget.Widget
+		different bool
+	}
+	tests := []test{
+		{"initial", h.Samples{"temperature": 0.0}, h.Samples{"temperature": 10.0}, w, true},
+		{"no change", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 10.0}, w, true}, // not actually true, but we need to trigger the right test path
+		{"20% increase", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 12.0}, w, true},
+		{"50% increase", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 15.0}, w, true},
+		{"100% increase", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 20.0}, w, false},
+		{"150% increase", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 25.0}, w, false},
+		{"20% decrease", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 8.0}, w, true},
+		{"50% decrease", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 5.0}, w, true},
+		{"100% decrease", h.Samples{"temperature": 10.0}, h.Samples{"temperature": 0.0}, w, false},
+		{"150% decrease", h.Samples{"temperature": 10.0}, h.Samples{"temperature": -5.0}, w, false},
+		{"NaN new", h.Samples{"temperature": 10.0}, h.Samples{"temperature": math.NaN()}, w, false}, // not actually false, but math.NaN() != math.NaN()
+		{"NaN old", h.Samples{"temperature": math.NaN()}, h.Samples{"temperature": 10.0}, w, true},
+		{"NaN both", h.Samples{"temperature": math.NaN()}, h.Samples{"temperature": math.NaN()}, w, false},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			updateSamples(&tc.current, tc.changes, w)
+			if tc.different {
+				// current should be updated to match changes
+				assert.Equal(tc.current, tc.changes)
+			} else {
+				// current should not be updated
+				assert.NotEqual(tc.current, tc.changes)
+			}
+		})
+	}
+}
+
+func TestHistoryChange(t *testing.T) {
+	assert := assert.New(t)
+
+	h := History{}
+	start := time.Date(2024, 1, 21, 9, 0, 0, 0, time.UTC)
+	for i, v := range []float64{1012.0, 1012.4, 1012.9, 1013.1, 1013.6, 1014.2, 1014.8} {
+		h.Add("pressure", v, start.Add(time.Duration(i)*time.Hour), 3*time.Hour)
+		change, ok := h.Change("pressure", 3*time.Hour, time.Hour)
+		// there's no change until there's 3 hours of history
+		assert.Equal(i >= 3, ok, "after %d hours", i)
+		if i == 3 {
+			assert.InDelta(1.1, change, 0.001)
+		}
+	}
+	change, ok := h.Change("pressure", 3*time.Hour, time.Hour)
+	assert.True(ok)
+	assert.InDelta(1.7, change, 0.001)
+	// samples no longer needed are forgotten
+	assert.Len(h["pressure"], 4)
+
+	_, ok = h.Change("temperature", 3*time.Hour, time.Hour)
+	assert.False(ok)
+
+	// after a gap, the sample before it is too old to compare against, until there's 3 hours of samples again
+	restart := start.Add(18 * time.Hour)
+	for i, v := range []float64{1001.0, 1001.2, 1001.5, 1001.9} {
+		h.Add("pressure", v, restart.Add(time.Duration(i)*time.Hour), 3*time.Hour)
+		change, ok := h.Change("pressure", 3*time.Hour, time.Hour)
+		assert.Equal(i == 3, ok, "%d hours after the gap", i)
+		if ok {
+			assert.InDelta(0.9, change, 0.001)
+		}
+	}
+}
+
+func TestPressureIsCorrectedAndHasTendency(t *testing.T) {
+	assert := assert.New(t)
+
+	w := widget.Widget{
+		StationAltitude: 100,
+		Metrics: map[string]widget.MetricConfig{
+			"pressure":    {SeaLevel: true, Tendency: true},
+			"temperature": {},
+		},
+	}
+	samples := h.Samples{}
+	history := History{}
+	start := time.Date(2024, 1, 21, 9, 0, 0, 0, time.UTC)
+	for i, v := range []float64{1000, 998.5, 997.6, 996.9} {
+		latest := h.Samples{"pressure": v, "temperature": 20}
+		correctSamples(latest, w)
+		updateSamples(&samples, latest, w)
+		updateTendencies(&samples, latest, history, w, start.Add(time.Duration(i)*time.Hour))
+	}
+
+	assert.InDelta(1008.8, samples["pressure"], 0.1)
+	assert.InDelta(-3.1*1.01194, samples["pressure"+widget.TendencySuffix], 0.01)
+	assert.Equal(20.0, samples["temperature"])
+	assert.NotContains(samples, "temperature"+widget.TendencySuffix)
+
+	// the tendency is cleared when the metric has no value, or after a gap
+	for _, tc := range []struct {
+		offset   time.Duration
+		value    float64
+		tendency bool
+	}{
+		{4 * time.Hour, math.NaN(), false},
+		{4 * time.Hour, 1008.8, true},
+		{12 * time.Hour, 1008.8, false},
+	} {
+		latest := h.Samples{"pressure": tc.value}
+		updateSamples(&samples, latest, w)
+		updateTendencies(&samples, latest, history, w, start.Add(tc.offset))
+		_, ok := samples["pressure"+widget.TendencySuffix]
+		assert.Equal(tc.tendency, ok, "after %s", tc.offset)
+	}
+
+	// a station at sea level needs no correction
+	latest := h.Samples{"pressure": 1000}
+	correctSamples(latest, widget.Widget{Metrics: w.Metrics})
+	assert.Equal(1000.0, latest["pressure"])
+	latest = h.Samples{"pressure": 1000}
+	correctSamples(latest, w)
+	assert.InDelta(1011.94, latest["pressure"], 0.01)
+}
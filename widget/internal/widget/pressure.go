@@ -0,0 +1,35 @@
+package widget
+
+import (
+	"math"
+	"time"
+)
+
+// TendencyWindow is how far back a metric's tendency looks. Pressure tendency is reported over 3 hours.
+const TendencyWindow = 3 * time.Hour
+
+// TendencySuffix is appended to a metric's name for the data key of its tendency
+const TendencySuffix = "_tendency"
+
+// steadyPressureChange is the change in pressure over TendencyWindow, in hectopascals, below which pressure
+// is reported as steady
+const steadyPressureChange = 1.0
+
+// SeaLevelPressure corrects the pressure measured at a station, in hectopascals, to mean sea level pressure,
+// using the barometric formula for the standard atmosphere. altitude is the station's height above sea
+// level, in metres.
+func SeaLevelPressure(pressure float64, altitude float64) float64 {
+	return pressure * math.Pow(1-0.0065*altitude/288.15, -5.25588)
+}
+
+// Tendency describes a change in pressure over TendencyWindow as rising, falling, or steady
+func Tendency(change float64) string {
+	switch {
+	case change >= steadyPressureChange:
+		return "rising"
+	case change <= -steadyPressureChange:
+		return "falling"
+	default:
+		return "steady"
+	}
+}
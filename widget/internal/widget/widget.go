@@ -8,24 +8,76 @@ import (
 
 // Widget is a container for a widget.json-formatted response, suitable for WCS
 type Widget struct {
-	Name          string                  `json:"name"`
-	Description   string                  `json:"description"`
-	Data          map[string]string       `json:"data"`
-	Layouts       map[string]Layout       `json:"layouts"`
-	ID            string                  `json:"-"`
-	Token         string                  `json:"-"`
-	Metrics       map[string]MetricConfig `json:"-"`
-	WidgetURL     string                  `json:"-" toml:"widget_url"`
-	PrometheusURL string                  `json:"-" toml:"prometheus_url"`
-	FetchInterval time.Duration           `json:"-" toml:"prometheus_fetch_interval"`
+	Name            string                  `json:"name"`
+	Description     string                  `json:"description"`
+	Data            map[string]string       `json:"data"`
+	Layouts         map[string]Layout       `json:"layouts"`
+	ID              string                  `json:"-"`
+	Token           string                  `json:"-"`
+	Metrics         map[string]MetricConfig `json:"-"`
+	WidgetURL       string                  `json:"-" toml:"widget_url"`
+	PrometheusURL   string                  `json:"-" toml:"prometheus_url"`
+	ExporterURLs    []string                `json:"-" toml:"exporter_urls"`
+	FetchInterval   time.Duration           `json:"-" toml:"prometheus_fetch_interval"`
+	InfluxDB        InfluxDBConfig          `json:"-" toml:"influxdb"`
+	MQTT            MQTTConfig              `json:"-" toml:"mqtt"`
+	StationAltitude float64                 `json:"-" toml:"station_altitude"`
 }
 
+// InfluxDBConfig defines how to connect to an InfluxDB server.
+//
+// Database, Username, and Password are used for InfluxQL queries against InfluxDB 1.x.
+// Org and Token are used for Flux queries against InfluxDB 2.x.
+type InfluxDBConfig struct {
+	URL      string        `toml:"url"`
+	Database string        `toml:"database"`
+	Username string        `toml:"username"`
+	Password string        `toml:"password"`
+	Org      string        `toml:"org"`
+	Token    string        `toml:"token"`
+	MaxAge   time.Duration `toml:"max_age"`
+}
+
+// MQTTConfig defines how to connect to an MQTT broker
+type MQTTConfig struct {
+	Broker   string        `toml:"broker"`
+	ClientID string        `toml:"client_id"`
+	Username string        `toml:"username"`
+	Password string        `toml:"password"`
+	MaxAge   time.Duration `toml:"max_age"`
+}
+
+// Names of the data sources a MetricConfig can gather a metric from
+const (
+	SourcePrometheus = "prometheus"
+	SourceExporter   = "exporter"
+	SourceInfluxDB   = "influxdb"
+	SourceMQTT       = "mqtt"
+	SourceHTTPJSON   = "http_json"
+)
+
 // MetricConfig defines how to gather and display a metric as data
 type MetricConfig struct {
-	DisplayUnit     string `toml:"display_unit"`
-	PrometheusQuery string `toml:"prometheus_query"`
+	Source          string            `toml:"source"`
+	DisplayUnit     string            `toml:"display_unit"`
+	PrometheusQuery string            `toml:"prometheus_query"`
+	ExporterMetric  string            `toml:"exporter_metric"`
+	ExporterLabels  map[string]string `toml:"exporter_labels"`
+	InfluxQLQuery   string            `toml:"influxql_query"`
+	FluxQuery       string            `toml:"flux_query"`
+	MQTTTopic       string            `toml:"mqtt_topic"`
+	JSONPath        string            `toml:"json_path"`
+	HTTPURL         string            `toml:"http_url"`
+	HTTPHeaders     map[string]string `toml:"http_headers"`
+	HTTPUsername    string            `toml:"http_username"`
+	HTTPPassword    string            `toml:"http_password"`
+	HTTPBearerToken string            `toml:"http_bearer_token"`
+	PollInterval    time.Duration     `toml:"poll_interval"`
+	Timeout         time.Duration     `toml:"timeout"`
 	Levels          map[string]int
 	DampenOutliers  bool `toml:"dampen_outliers"`
+	SeaLevel        bool `toml:"sea_level"`
+	Tendency        bool `toml:"tendency"`
 }
 
 // Layout is a layout for a widget.json widget
@@ -171,7 +223,7 @@ var WeatherLayout = map[string]Layout{
 							},
 						},
 					},
-					{Height: 1},
+					{Height: 0.5},
 					{
 						Height: 2.25,
 						Cells: []Cell{
@@ -217,7 +269,32 @@ var WeatherLayout = map[string]Layout{
 							},
 						},
 					},
-					{Height: 0.75},
+					{
+						Height: 1.75,
+						Cells: []Cell{
+							{
+								Width:   8,
+								Padding: 1.15,
+								Text: Text{
+									DataRef:       "pressure",
+									Size:          12,
+									ColorStyle:    "stone-100",
+									Justification: "left",
+								},
+							},
+							{
+								Width:   4,
+								Padding: 1.15,
+								Text: Text{
+									DataRef:       "pressure" + TendencySuffix,
+									Size:          12,
+									ColorStyle:    "stone-100",
+									Justification: "right",
+								},
+							},
+						},
+					},
+					{Height: 0.25},
 				},
 			},
 		},
@@ -232,5 +309,19 @@ func LoadWidgets(configPath string) (widgets []Widget, err error) {
 		return widgets, err
 	}
 	widget.Data = map[string]string{"content_url": widget.WidgetURL}
+	for k, m := range widget.Metrics {
+		if len(m.Source) == 0 {
+			m.Source = defaultSource(m)
+			widget.Metrics[k] = m
+		}
+	}
 	return []Widget{widget}, err
 }
+
+// defaultSource picks a data source for a metric that doesn't name one
+func defaultSource(m MetricConfig) string {
+	if len(m.ExporterMetric) > 0 {
+		return SourceExporter
+	}
+	return SourcePrometheus
+}
@@ -8,7 +8,11 @@ import (
 
 	"github.com/auxesis/meteo/widget/internal/feedback"
 	api "github.com/auxesis/meteo/widget/internal/http"
+	"github.com/auxesis/meteo/widget/internal/httpjson"
+	"github.com/auxesis/meteo/widget/internal/influxdb"
+	"github.com/auxesis/meteo/widget/internal/mqtt"
 	"github.com/auxesis/meteo/widget/internal/prometheus"
+	"github.com/auxesis/meteo/widget/internal/source"
 	"github.com/auxesis/meteo/widget/internal/widget"
 )
 
@@ -29,10 +33,26 @@ func main() {
 		log.Fatalf("error: %s", err)
 	}
 
+	w := widgets[0]
+	prom, err := prometheus.NewSource(w.PrometheusURL)
+	if err != nil {
+		log.Fatalf("error: %s", err)
+	}
+	sources := source.Registry{
+		widget.SourcePrometheus: prom,
+		widget.SourceExporter:   prometheus.NewExporterSource(w.ExporterURLs),
+		widget.SourceInfluxDB:   influxdb.NewSource(w.InfluxDB),
+		widget.SourceMQTT:       mqtt.NewSource(w.MQTT),
+		widget.SourceHTTPJSON:   httpjson.NewSource(),
+	}
+	if err := sources.Check(w); err != nil {
+		log.Fatalf("error: %s", err)
+	}
+
 	samples := api.Samples{}
 	sigs := make(chan feedback.Signal, 1024)
 	status := feedback.Status{}
-	go prometheus.PollForSamples(widgets, &samples, sigs)
+	go source.PollForSamples(widgets, sources, &samples, sigs)
 	go feedback.ProcessSignals(sigs, &status)
 	http.HandleFunc("/", api.HandleWidgetQuery(widgets, &samples, &status))
 